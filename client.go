@@ -25,6 +25,7 @@ type Client struct {
 	Hostname                  string
 	AuthToken                 string
 	ConnectedServerInstanceId string // ID of the server to which it is connected
+	factsSending              bool   // Facts are being collected and sent
 	mux                       sync.RWMutex
 }
 
@@ -38,6 +39,9 @@ func (s *Client) Start() bool {
 	// Get auth token from server
 	s.AuthServer()
 
+	// Facts inventory
+	go s.startFactsLoop()
+
 	// Is the client enabled?
 	if conf.isClientEnabled() {
 		// Start webserver
@@ -181,6 +185,11 @@ func (s *Client) PingServer() {
 					s.ConnectedServerInstanceId = serverInstanceId
 					log.Println(fmt.Sprintf("Client registered with server %s", s.ConnectedServerInstanceId))
 				}
+
+				// Server has no facts, e.g. after a restart or a failed first attempt
+				if known, knownE := obj.GetBoolean("facts_known"); knownE == nil && !known {
+					go s.SendFacts()
+				}
 			}
 		}
 	}
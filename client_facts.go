@@ -0,0 +1,506 @@
+package main
+
+// Facts about the host a client runs on, collected by the client and usable for targeting, e.g. os=ubuntu* AND memory_mb>=4096
+// @author Robin Verlangen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_FACTS_INTERVAL = 3600 // In seconds
+	FACT_SCRIPT_TIMEOUT    = 10   // In seconds
+	FACT_CUSTOM_PREFIX     = "custom."
+)
+
+// Version of the agent, set at build time with -ldflags "-X main.AgentVersion=1.2.3"
+var AgentVersion = "dev"
+
+var factKeyRegexp = regexp.MustCompile("^[a-z0-9_.-]+$")
+
+type ClientFacts struct {
+	Os            string // Distribution name, the GOOS if that is unknown
+	Kernel        string
+	Arch          string
+	Cpus          int
+	MemoryMb      uint64
+	IpAddresses   []string
+	UptimeSeconds int64
+	Disks         []*ClientDiskUsage
+	AgentVersion  string
+	Custom        map[string]string // From the scripts in Conf.FactsDir
+	CollectTime   int64             // Unix TS
+}
+
+type ClientDiskUsage struct {
+	Mount       string
+	SizeMb      uint64
+	UsedMb      uint64
+	UsedPercent int
+}
+
+// Facts by the name used in expressions, some facts have multiple values
+func (f *ClientFacts) Values() map[string][]string {
+	res := make(map[string][]string)
+	if f == nil {
+		return res
+	}
+	res["os"] = []string{f.Os}
+	res["kernel"] = []string{f.Kernel}
+	res["arch"] = []string{f.Arch}
+	res["cpus"] = []string{strconv.Itoa(f.Cpus)}
+	res["memory_mb"] = []string{strconv.FormatUint(f.MemoryMb, 10)}
+	res["ip"] = f.IpAddresses
+	res["uptime_seconds"] = []string{strconv.FormatInt(f.UptimeSeconds, 10)}
+	res["agent_version"] = []string{f.AgentVersion}
+	if len(f.Disks) > 0 {
+		fullest := 0
+		for _, disk := range f.Disks {
+			if disk.UsedPercent > fullest {
+				fullest = disk.UsedPercent
+			}
+		}
+		res["disk_used_percent"] = []string{strconv.Itoa(fullest)}
+	}
+	for key, value := range f.Custom {
+		res[FACT_CUSTOM_PREFIX+key] = []string{value}
+	}
+	return res
+}
+
+type FactCondition struct {
+	Fact  string
+	Op    string // =, !=, >, >=, < or <=
+	Value string // Glob pattern for = and !=, a number otherwise
+}
+
+// Is this an expression operand that compares a fact instead of a tag? Tags never contain these characters.
+func isFactCondition(s string) bool {
+	return strings.ContainsAny(s, "=!<>")
+}
+
+// Condition like os=ubuntu*, custom.role!=db or cpus>=4
+func parseFactCondition(s string) (*FactCondition, error) {
+	i := strings.IndexAny(s, "=!<>")
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid fact condition %s", s)
+	}
+	op := ""
+	for _, candidate := range []string{">=", "<=", "!=", "=", ">", "<"} {
+		if strings.HasPrefix(s[i:], candidate) {
+			op = candidate
+			break
+		}
+	}
+	c := &FactCondition{
+		Fact:  strings.ToLower(s[:i]),
+		Op:    op,
+		Value: s[i+len(op):],
+	}
+	if len(c.Op) == 0 || len(c.Fact) == 0 || len(c.Value) == 0 || strings.ContainsAny(c.Value, "=!<>") {
+		return nil, fmt.Errorf("Invalid fact condition %s, use fact=value", s)
+	}
+	if c.Op != "=" && c.Op != "!=" {
+		if _, err := strconv.ParseFloat(c.Value, 64); err != nil {
+			return nil, fmt.Errorf("Fact condition %s compares with %s, which is not a number", s, c.Value)
+		}
+	} else if _, err := path.Match(c.Value, ""); err != nil {
+		return nil, fmt.Errorf("Invalid pattern in fact condition %s", s)
+	}
+	return c, nil
+}
+
+// Does any of the values of the fact match? Missing facts only match !=
+func (c *FactCondition) Matches(facts *ClientFacts) bool {
+	values := facts.Values()[c.Fact]
+	if c.Op == "!=" {
+		for _, value := range values {
+			if factGlobMatch(c.Value, value) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, value := range values {
+		if c.Op == "=" {
+			if factGlobMatch(c.Value, value) {
+				return true
+			}
+			continue
+		}
+		have, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		want, _ := strconv.ParseFloat(c.Value, 64)
+		switch c.Op {
+		case ">":
+			if have > want {
+				return true
+			}
+		case ">=":
+			if have >= want {
+				return true
+			}
+		case "<":
+			if have < want {
+				return true
+			}
+		case "<=":
+			if have <= want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Case insensitive
+func factGlobMatch(pattern string, value string) bool {
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return matched
+}
+
+// Tag or fact condition, caller must hold the read lock
+func (c *RegisteredClient) hasTagOrFact(s string) bool {
+	if !isFactCondition(s) {
+		return c.HasTag(s)
+	}
+	condition, err := parseFactCondition(s)
+	if err != nil {
+		return false
+	}
+	return condition.Matches(c.Facts)
+}
+
+// Gather the facts of this host
+func collectClientFacts(factsDir string) *ClientFacts {
+	f := &ClientFacts{
+		Os:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Cpus:         runtime.NumCPU(),
+		IpAddresses:  localIpAddresses(),
+		AgentVersion: AgentVersion,
+		Custom:       make(map[string]string),
+		CollectTime:  time.Now().Unix(),
+	}
+	if b, err := ioutil.ReadFile("/etc/os-release"); err == nil {
+		if name := parseOsRelease(string(b)); len(name) > 0 {
+			f.Os = name
+		}
+	}
+	if b, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		f.Kernel = strings.TrimSpace(string(b))
+	} else if b, err := exec.Command("uname", "-r").Output(); err == nil {
+		f.Kernel = strings.TrimSpace(string(b))
+	}
+	if b, err := ioutil.ReadFile("/proc/meminfo"); err == nil {
+		f.MemoryMb = parseMemInfo(string(b))
+	}
+	if b, err := ioutil.ReadFile("/proc/uptime"); err == nil {
+		f.UptimeSeconds = parseUptime(string(b))
+	}
+	if b, err := exec.Command("df", "-P", "-k").Output(); err == nil {
+		f.Disks = parseDiskUsage(string(b))
+	}
+	if len(factsDir) > 0 {
+		f.Custom = runFactScripts(factsDir)
+	}
+	return f
+}
+
+// Pretty name of the distribution from /etc/os-release
+func parseOsRelease(content string) string {
+	name := ""
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(kv[1], "\"'")
+		if kv[0] == "PRETTY_NAME" {
+			return value
+		}
+		if kv[0] == "NAME" {
+			name = value
+		}
+	}
+	return name
+}
+
+// Total memory in MB from /proc/meminfo
+func parseMemInfo(content string) uint64 {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb / 1024
+		}
+	}
+	return 0
+}
+
+// Seconds since boot from /proc/uptime
+func parseUptime(content string) int64 {
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return 0
+	}
+	seconds, _ := strconv.ParseFloat(fields[0], 64)
+	return int64(seconds)
+}
+
+// Usage of device backed filesystems from the POSIX output of df -k
+func parseDiskUsage(content string) []*ClientDiskUsage {
+	disks := make([]*ClientDiskUsage, 0)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[0], "/") {
+			continue // Header and virtual filesystems
+		}
+		mount := strings.Join(fields[5:], " ")
+		if seen[mount] {
+			continue
+		}
+		size, sizeE := strconv.ParseUint(fields[1], 10, 64)
+		used, usedE := strconv.ParseUint(fields[2], 10, 64)
+		if sizeE != nil || usedE != nil || size == 0 {
+			continue
+		}
+		seen[mount] = true
+		disks = append(disks, &ClientDiskUsage{
+			Mount:       mount,
+			SizeMb:      size / 1024,
+			UsedMb:      used / 1024,
+			UsedPercent: int(used * 100 / size),
+		})
+	}
+	return disks
+}
+
+// Addresses of all interfaces, except loopback
+func localIpAddresses() []string {
+	ips := make([]string, 0)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		ips = append(ips, ipNet.IP.String())
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// Run every executable in the directory, a failing script is logged and skipped
+func runFactScripts(dir string) map[string]string {
+	facts := make(map[string]string)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return facts
+	}
+	for _, file := range files {
+		if file.IsDir() || file.Mode()&0111 == 0 {
+			continue
+		}
+		output, err := runFactScript(filepath.Join(dir, file.Name()), time.Duration(FACT_SCRIPT_TIMEOUT)*time.Second)
+		if err != nil {
+			log.Printf("Fact script %s failed: %s", file.Name(), err)
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		for key, value := range parseCustomFacts(name, output) {
+			facts[key] = value
+		}
+	}
+	return facts
+}
+
+// Output of the script, on timeout the processes it started are killed as well as they would keep the output open
+func runFactScript(file string, timeout time.Duration) (string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command(file)
+	cmd.Stdout = &stdout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	pgid := cmd.Process.Pid
+	timer := time.AfterFunc(timeout, func() {
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	return stdout.String(), err
+}
+
+// Script output as a JSON object, key=value lines or a single value named after the script
+func parseCustomFacts(name string, output string) map[string]string {
+	facts := make(map[string]string)
+	output = strings.TrimSpace(output)
+	if len(output) == 0 {
+		return facts
+	}
+
+	var m map[string]interface{}
+	if je := json.Unmarshal([]byte(output), &m); je == nil {
+		for key, value := range m {
+			if s, ok := value.(string); ok {
+				addCustomFact(facts, key, s)
+				continue
+			}
+			b, _ := json.Marshal(value)
+			addCustomFact(facts, key, string(b))
+		}
+		return facts
+	}
+
+	lines := strings.Split(output, "\n")
+	for _, line := range lines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			addCustomFact(facts, name, output)
+			return facts
+		}
+	}
+	for _, line := range lines {
+		kv := strings.SplitN(line, "=", 2)
+		addCustomFact(facts, kv[0], kv[1])
+	}
+	return facts
+}
+
+// Keys are lowercase names, invalid ones are dropped
+func addCustomFact(facts map[string]string, key string, value string) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if !factKeyRegexp.MatchString(key) {
+		return
+	}
+	facts[key] = strings.TrimSpace(value)
+}
+
+// Directory with fact scripts, relative to the home directory unless absolute
+func (c *Conf) GetFactsDir() string {
+	if len(c.FactsDir) == 0 || filepath.IsAbs(c.FactsDir) {
+		return c.FactsDir
+	}
+	return c.HomeFile(c.FactsDir)
+}
+
+// Collect and send the facts to the server, unless that is already in progress
+func (s *Client) SendFacts() {
+	s.mux.Lock()
+	if s.factsSending {
+		s.mux.Unlock()
+		return
+	}
+	s.factsSending = true
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		s.factsSending = false
+		s.mux.Unlock()
+	}()
+
+	facts := collectClientFacts(conf.GetFactsDir())
+	bytes, je := json.Marshal(facts)
+	if je != nil {
+		log.Printf("Failed to convert facts to JSON: %s", je)
+		return
+	}
+	b, e := s._req("PUT", fmt.Sprintf("client/%s/facts", url.QueryEscape(s.Id)), bytes)
+	if e != nil || len(b) < 1 {
+		log.Printf("Failed to send facts: %s", e)
+	}
+}
+
+// Facts of the client, replacing the previous ones
+func PutClientFacts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !auth(r) {
+		jr.Error("Client not authorized for PutClientFacts")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	registeredClient := server.GetClient(ps.ByName("clientId"))
+	if registeredClient == nil {
+		jr.Error("Client not registered")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		jr.Error("Failed to read body")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	facts, err := decodeClientFacts(body)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	registeredClient.mux.Lock()
+	registeredClient.Facts = facts
+	registeredClient.mux.Unlock()
+
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+func decodeClientFacts(body []byte) (*ClientFacts, error) {
+	var facts *ClientFacts
+	if je := json.Unmarshal(body, &facts); je != nil || facts == nil {
+		return nil, errors.New("Invalid facts")
+	}
+	if facts.Custom == nil {
+		facts.Custom = make(map[string]string)
+	}
+	if facts.CollectTime == 0 {
+		facts.CollectTime = time.Now().Unix()
+	}
+	return facts, nil
+}
+
+// Keep the facts fresh, the first collection happens right away
+func (s *Client) startFactsLoop() {
+	interval := conf.FactsInterval
+	if interval < 1 {
+		interval = DEFAULT_FACTS_INTERVAL
+	}
+	s.SendFacts()
+	for _ = range time.Tick(time.Duration(interval) * time.Second) {
+		s.SendFacts()
+	}
+}
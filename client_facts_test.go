@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseFactCondition(t *testing.T) {
+	c, err := parseFactCondition("cpus>=4")
+	assert.Nil(t, err)
+	assert.Equal(t, "cpus", c.Fact)
+	assert.Equal(t, ">=", c.Op)
+	assert.Equal(t, "4", c.Value)
+
+	c, err = parseFactCondition("custom.role!=db")
+	assert.Nil(t, err)
+	assert.Equal(t, "custom.role", c.Fact)
+	assert.Equal(t, "!=", c.Op)
+
+	for _, s := range []string{"=linux", "os=", "memory_mb>lots", "os==linux", "os=[linux"} {
+		_, err := parseFactCondition(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestFactConditionMatches(t *testing.T) {
+	facts := &ClientFacts{
+		Os:          "Ubuntu 16.04.1 LTS",
+		Cpus:        8,
+		MemoryMb:    2048,
+		IpAddresses: []string{"10.0.0.5", "192.168.1.5"},
+		Disks:       []*ClientDiskUsage{{Mount: "/", UsedPercent: 40}, {Mount: "/data", UsedPercent: 95}},
+		Custom:      map[string]string{"role": "db"},
+	}
+	match := func(s string) bool {
+		c, err := parseFactCondition(s)
+		assert.Nil(t, err, s)
+		return c.Matches(facts)
+	}
+	assert.True(t, match("os=ubuntu*"))
+	assert.False(t, match("os=centos*"))
+	assert.True(t, match("cpus>4"))
+	assert.False(t, match("memory_mb>=4096"))
+	assert.True(t, match("ip=192.168.*"))
+	assert.True(t, match("disk_used_percent>90"))
+	assert.True(t, match("custom.role=db"))
+	assert.False(t, match("custom.role!=db"))
+
+	// Unknown facts
+	assert.False(t, match("custom.zone=eu"))
+	assert.True(t, match("custom.zone!=eu"))
+	c, _ := parseFactCondition("os=linux")
+	assert.False(t, c.Matches(nil))
+}
+
+func TestFactsInTagExpression(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = &Server{clients: map[string]*RegisteredClient{
+		"db1":  {ClientId: "db1", Tags: []string{"prod"}, Facts: &ClientFacts{Os: "Ubuntu 16.04", MemoryMb: 16384}},
+		"db2":  {ClientId: "db2", Tags: []string{"prod"}, Facts: &ClientFacts{Os: "CentOS 7", MemoryMb: 16384}},
+		"web1": {ClientId: "web1", Tags: []string{"prod"}, Facts: &ClientFacts{Os: "Ubuntu 16.04", MemoryMb: 2048}},
+		"new1": {ClientId: "new1", Tags: []string{"prod"}},
+	}}
+
+	e, err := parseTagExpression("prod AND os=ubuntu* AND memory_mb>=8192")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"db1"}, server.FindClientIdsByExpression(e, nil))
+
+	e, err = parseTagExpression("prod AND NOT os=ubuntu*")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"db2", "new1"}, server.FindClientIdsByExpression(e, nil))
+
+	_, err = parseTagExpression("prod AND cpus>many")
+	assert.NotNil(t, err)
+}
+
+func TestParseHostFacts(t *testing.T) {
+	assert.Equal(t, "Ubuntu 16.04.1 LTS", parseOsRelease("NAME=\"Ubuntu\"\nVERSION=\"16.04.1 LTS\"\nPRETTY_NAME=\"Ubuntu 16.04.1 LTS\"\n"))
+	assert.Equal(t, "Alpine", parseOsRelease("NAME=Alpine\n"))
+	assert.Equal(t, uint64(2048), parseMemInfo("MemTotal:        2097152 kB\nMemFree:          102400 kB\n"))
+	assert.Equal(t, int64(3600), parseUptime("3600.52 7000.10\n"))
+
+	disks := parseDiskUsage("Filesystem     1024-blocks     Used Available Capacity Mounted on\n/dev/sda1        10485760  5242880   5242880      50% /\ntmpfs              102400        0    102400       0% /run\n/dev/sdb1        20971520 20971520         0     100% /mnt/my data\n")
+	assert.Len(t, disks, 2)
+	assert.Equal(t, "/", disks[0].Mount)
+	assert.Equal(t, uint64(10240), disks[0].SizeMb)
+	assert.Equal(t, 50, disks[0].UsedPercent)
+	assert.Equal(t, "/mnt/my data", disks[1].Mount)
+	assert.Equal(t, 100, disks[1].UsedPercent)
+}
+
+func TestParseCustomFacts(t *testing.T) {
+	assert.Equal(t, map[string]string{"role": "db", "replicas": "3"}, parseCustomFacts("app", "{\"role\": \"db\", \"replicas\": 3}"))
+	assert.Equal(t, map[string]string{"role": "db", "zone": "eu-west"}, parseCustomFacts("app", "role=db\nZone = eu-west\n"))
+	assert.Equal(t, map[string]string{"rack": "r12"}, parseCustomFacts("rack", "r12\n"))
+	assert.Equal(t, map[string]string{}, parseCustomFacts("rack", ""))
+
+	// Invalid keys are dropped
+	assert.Equal(t, map[string]string{"ok": "1"}, parseCustomFacts("app", "ok=1\nnot valid=2"))
+}
+
+func TestDecodeClientFacts(t *testing.T) {
+	facts, err := decodeClientFacts([]byte("{\"Os\": \"linux\", \"Cpus\": 2}"))
+	assert.Nil(t, err)
+	assert.Equal(t, "linux", facts.Os)
+	assert.NotNil(t, facts.Custom)
+	assert.True(t, facts.CollectTime > 0)
+
+	_, err = decodeClientFacts([]byte("null"))
+	assert.NotNil(t, err)
+	_, err = decodeClientFacts([]byte("nope"))
+	assert.NotNil(t, err)
+}
+
+func TestSendFactsInFlight(t *testing.T) {
+	// A send in progress is not repeated, the collection is not even started
+	c := &Client{Id: "a", factsSending: true}
+	c.SendFacts()
+	assert.True(t, c.factsSending)
+}
+
+func TestRunFactScriptTimeout(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "indispenso")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "role")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("#!/bin/sh\necho db\n"), 0755))
+	output, err := runFactScript(file, 5*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "db\n", output)
+
+	// A subprocess holding the output open is stopped at the deadline as well
+	assert.Nil(t, ioutil.WriteFile(file, []byte("#!/bin/sh\necho db\nsleep 30 &\nsleep 30\n"), 0755))
+	start := time.Now()
+	_, err = runFactScript(file, 500*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
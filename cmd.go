@@ -13,26 +13,33 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
 	"time"
 )
 
 // @author Robin Verlangen
 
 type Cmd struct {
-	Command              string   // Commands to execute
-	Pending              bool     // Did we dispatch it to the client?
-	Id                   string   // Unique ID for this command
-	ClientId             string   // Client ID on which the command is executed
-	TemplateId           string   // Reference to the template id
-	ConsensusRequestId   string   // Reference to the request id
-	Signature            string   // makes this only valid from the server to the client based on the preshared token and this is a signature with the command and id
-	Timeout              int      // in seconds
-	State                string   // Textual representation of the current state, e.g. finished, failed, etc.
-	RequestUserId        string   // User ID of the user that initiated this command
-	Created              int64    // Unix timestamp created
-	ExecutionIterationId int      // In which iteration the command was started
-	BufOutput            []string // Standard output
-	BufOutputErr         []string // Error output
+	Command              string                       // Commands to execute
+	Pending              bool                         // Did we dispatch it to the client?
+	Id                   string                       // Unique ID for this command
+	ClientId             string                       // Client ID on which the command is executed
+	TemplateId           string                       // Reference to the template id
+	TemplateVersion      int                          // Version of the template the command was created from
+	ConsensusRequestId   string                       // Reference to the request id
+	Signature            string                       // makes this only valid from the server to the client based on the preshared token and this is a signature with the command and id
+	Timeout              int                          // in seconds
+	State                string                       // Textual representation of the current state, e.g. finished, failed, etc.
+	RequestUserId        string                       // User ID of the user that initiated this command
+	Created              int64                        // Unix timestamp created
+	Dispatched           int64                        // Unix timestamp of submission to the client
+	Started              int64                        // Unix timestamp of the start of execution on the client
+	Completed            int64                        // Unix timestamp of reaching a final state
+	ExitCode             int                          // Exit code of the process, -1 if killed
+	ExecutionIterationId int                          // In which iteration the command was started
+	ValidationResults    []*ExecutionValidationResult // Outcome of the validation rules
+	BufOutput            []string                     // Standard output
+	BufOutputErr         []string                     // Error output
 }
 
 // Sign the command on the server
@@ -53,12 +60,47 @@ func (c *Cmd) SetState(state string) {
 		log.Printf("Cmd %s went from state %s to %s", c.Id, oldState, c.State)
 	}
 
+	// Timing
+	if c.State == "started_execution" {
+		c.Started = time.Now().Unix()
+	}
+
 	// Run validation
 	if oldState == "finished_execution" && c.State == "flushed_logs" {
 		c._validate()
-	} else if oldState == "failed_execution" && c.State == "flushed_logs" {
+	} else if oldState == "failed_execution" && c.State == "flushed_logs" && c.expectsExitCode() {
+		// Non-zero exit code that is expected by the template
+		c._validate()
+	} else if (oldState == "failed_execution" || oldState == "killed_execution") && c.State == "flushed_logs" {
 		c.State = "failed"
 	}
+
+	// Completed
+	if c.IsFinal() && c.Completed == 0 {
+		c.Completed = time.Now().Unix()
+
+		// Halt the execution, only on the server
+		if c.IsFailed() && conf.ServerEnabled {
+			ece := server.executionCoordinator.Get(c.ConsensusRequestId)
+			if ece != nil {
+				go ece.Halt(fmt.Sprintf("Cmd %s on %s failed with state %s", c.Id, c.ClientId, c.State))
+			}
+		}
+	}
+}
+
+// Is the command in a state it will never leave?
+func (c *Cmd) IsFinal() bool {
+	switch c.State {
+	case "finished", "failed", "failed_validation", "invalid_signature":
+		return true
+	}
+	return false
+}
+
+// Did the command end unsuccessfully?
+func (c *Cmd) IsFailed() bool {
+	return c.IsFinal() && c.State != "finished"
 }
 
 // Validate the execution of a command, only on the server
@@ -69,48 +111,18 @@ func (c *Cmd) _validate() {
 	}
 
 	// Get template
-	template := server.templateStore.Get(c.TemplateId)
+	template := server.templateVersionStore.Resolve(c.TemplateId, c.TemplateVersion)
 	if template == nil {
-		log.Printf("Unable to find template %s for validation of cmd %s", c.TemplateId, c.Id)
+		// Without the rules the command was approved with it can not pass
+		log.Printf("Unable to find version %d of template %s for validation of cmd %s", c.TemplateVersion, c.TemplateId, c.Id)
+		c.SetState("failed_validation")
 		return
 	}
 
-	// Iterate and run on templates
-	var failedValidation = false
-	for _, v := range template.ValidationRules {
-		// Select stream
-		var stream []string
-		if v.OutputStream == 1 {
-			stream = c.BufOutput
-		} else {
-			stream = c.BufOutputErr
-		}
-
-		// Match on line
-		var matched bool = false
-		for _, line := range stream {
-			if strings.Contains(line, v.Text) {
-				matched = true
-				break
-			}
-		}
-
-		// Did we match?
-		if v.MustContain == true && matched == false {
-			// Should BE there, but is NOT
-			c.SetState("failed_validation")
-			failedValidation = true
-			break
-		} else if v.MustContain == false && matched == true {
-			// Should NOT be there, but IS
-			c.SetState("failed_validation")
-			failedValidation = true
-			break
-		}
-	}
-
 	// Done and passed validation
-	if failedValidation == false {
+	if c.evaluateValidation(template.ValidationRules) {
+		c.SetState("failed_validation")
+	} else {
 		if conf.Debug {
 			log.Printf("Validation passed for %s", c.Id)
 		}
@@ -124,6 +136,38 @@ func (c *Cmd) _validate() {
 	}
 }
 
+// Run the rules on the output and keep the results, returns whether a fatal rule failed
+func (c *Cmd) evaluateValidation(rules []*ExecutionValidation) bool {
+	c.ValidationResults = make([]*ExecutionValidationResult, 0)
+	for _, v := range rules {
+		passed := v.Matches(c.BufOutput, c.BufOutputErr, c.ExitCode) == v.MustContain
+		c.ValidationResults = append(c.ValidationResults, newExecutionValidationResult(v, passed))
+
+		// Non fatal rules are only reported
+		if !passed && v.Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// Does the template accept the exit code of a failed execution?
+func (c *Cmd) expectsExitCode() bool {
+	if !conf.ServerEnabled {
+		return false
+	}
+	template := server.templateVersionStore.Resolve(c.TemplateId, c.TemplateVersion)
+	if template == nil {
+		return false
+	}
+	for _, v := range template.ValidationRules {
+		if v.GetType() == VALIDATION_EXIT_CODE && v.MustContain && v.Matches(nil, nil, c.ExitCode) {
+			return true
+		}
+	}
+	return false
+}
+
 // Notify state to server
 func (c *Cmd) NotifyServer(state string) {
 	// Update local client state
@@ -131,7 +175,7 @@ func (c *Cmd) NotifyServer(state string) {
 
 	// Update server state, only if this has a signature, else it is local
 	if len(c.Signature) > 0 {
-		client._req("PUT", fmt.Sprintf("client/%s/cmd/%s/state?state=%s", url.QueryEscape(client.Id), url.QueryEscape(c.Id), url.QueryEscape(state)), nil)
+		client._req("PUT", fmt.Sprintf("client/%s/cmd/%s/state?state=%s&exit_code=%d", url.QueryEscape(client.Id), url.QueryEscape(c.Id), url.QueryEscape(state), c.ExitCode), nil)
 	}
 }
 
@@ -318,10 +362,12 @@ func (c *Cmd) Execute(client *Client) {
 			return
 		}
 		<-done // allow goroutine to exit
+		c.ExitCode = -1
 		c.NotifyServer("killed_execution")
 		log.Printf("Process %s killed", c.Id)
 	case err := <-done:
 		if err != nil {
+			c.ExitCode = exitCode(err)
 			c.NotifyServer("failed_execution")
 			c.LogError(fmt.Sprintf("%v", err))
 			log.Printf("Process %s done with error = %v", c.Id, err)
@@ -343,6 +389,16 @@ func (c *Cmd) Execute(client *Client) {
 	c.NotifyServer("flushed_logs")
 }
 
+// Exit code from the error returned by a finished process
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
 func newCmd(command string, timeout int) *Cmd {
 	// Default timeout if not valid
 	if timeout < 1 {
@@ -28,6 +28,22 @@ type Conf struct {
 	Home              string //home directory
 	LdapConfigFile    string
 	EnableLdap        bool
+
+	ConsensusPendingExpiryDays int    // Days before unapproved requests expire, unless the template has a deadline
+	ConsensusRetentionDays     int    // Days finished requests are kept
+	NotificationWebhook        string // Url notifications are POSTed to as JSON
+	SmtpServer                 string // Host:port to e-mail notifications through
+	SmtpFrom                   string
+	SmtpUsername               string
+	SmtpPassword               string
+	StepUpGracePeriod          int      // Seconds a second factor proof stays valid for sensitive actions
+	StepUpActions              []string // Actions that require a recent second factor proof, see STEP_UP_*
+	BreakGlassReviewDays       int      // Days approvers have to review a break-glass execution
+	TemplateSyncDir            string   // Directory with template definitions to reconcile, empty to disable
+	TemplateLintDisabledRules  []string // Lint rules that are not checked, see LINT_*
+	TemplateLintBlockingRules  []string // Lint rules that prevent saving a template instead of warning
+	FactsDir                   string   // Directory with executables that output custom facts, relative to the home directory
+	FactsInterval              int      // Seconds between collecting and sending facts
 	//
 	ldapConfig *LdapConfig
 	ldapViper  *viper.Viper
@@ -59,6 +75,19 @@ func newConfig() *Conf {
 	viper.SetDefault("ClientPort", 898)
 	viper.SetDefault("EnableLdap", false)
 	viper.SetDefault("LdapConfigFile", "")
+	viper.SetDefault("ConsensusPendingExpiryDays", 14)
+	viper.SetDefault("ConsensusRetentionDays", 14)
+	viper.SetDefault("NotificationWebhook", "")
+	viper.SetDefault("SmtpServer", "")
+	viper.SetDefault("SmtpFrom", "indispenso@localhost")
+	viper.SetDefault("StepUpGracePeriod", 300)
+	viper.SetDefault("StepUpActions", []string{STEP_UP_CONSENSUS_APPROVE, STEP_UP_TEMPLATE_CREATE, STEP_UP_TEMPLATE_UPDATE, STEP_UP_TEMPLATE_DELETE, STEP_UP_BACKUP})
+	viper.SetDefault("BreakGlassReviewDays", DEFAULT_BREAK_GLASS_REVIEW_DAYS)
+	viper.SetDefault("TemplateSyncDir", "")
+	viper.SetDefault("TemplateLintDisabledRules", []string{})
+	viper.SetDefault("TemplateLintBlockingRules", []string{})
+	viper.SetDefault("FactsDir", "facts.d")
+	viper.SetDefault("FactsInterval", DEFAULT_FACTS_INTERVAL)
 
 	//Flags
 	c.confFlags = pflag.NewFlagSet(os.Args[0], pflag.ExitOnError)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/nu7hatch/gouuid"
 	"io/ioutil"
@@ -19,18 +20,44 @@ type Consensus struct {
 }
 
 type ConsensusRequest struct {
-	Id             string
-	TemplateId     string
-	ClientIds      []string
-	RequestUserId  string
-	Reason         string
-	ApproveUserIds map[string]bool
-	executeMux     sync.RWMutex
-	Executed       bool
-	CreateTime     int64                     // Unix TS for creation of consensus request
-	StartTime      int64                     // Unix TS for start of command execution
-	CompleteTime   int64                     // Unix TS for completion of command exectuion
-	Callbacks      []func(*ConsensusRequest) `json:"-"` // Will be called on completions
+	Id                  string
+	TemplateId          string
+	TemplateVersion     int // Version of the template that was requested and approved
+	ClientIds           []string
+	RequestUserId       string
+	Reason              string
+	ApproveUserIds      map[string]bool
+	ApproveTimes        map[string]int64 // Unix TS of each approval by user id
+	executeMux          sync.RWMutex
+	Executed            bool
+	State               string                         // Lifecycle state, see CONSENSUS_STATE_*
+	StateHistory        []*ConsensusStateTransition    // Every state change and rejection with its time and actor
+	Rejections          map[string]*ConsensusRejection // Rejections by user id
+	stateMux            sync.Mutex
+	Comments            []*ConsensusComment // Discussion between requester and approvers
+	commentMux          sync.RWMutex
+	Revisions           []*ConsensusRevision      // Every version of the request once it has been amended
+	BreakGlass          *ConsensusBreakGlass      // Set for emergency executions without approval
+	CreateTime          int64                     // Unix TS for creation of consensus request
+	StartTime           int64                     // Unix TS for start of command execution
+	CompleteTime        int64                     // Unix TS for completion of command exectuion
+	RollbackRequestId   string                    // Request that rolled back this one after a failure
+	RollbackOfRequestId string                    // Request this one is the rollback of
+	HaltReason          string                    // Why execution stopped before all hosts were done
+	ProbeResults        []*HealthProbeResult      // Health probes between batches
+	ApprovesScheduleId  string                    // Schedule that gets its standing approval from this request
+	ScheduleId          string                    // Schedule that created this request
+	TargetExpression    string                    // Tag expression the clients are resolved from when execution starts, empty for a fixed list
+	TargetResolveTime   int64                     // Unix TS the expression was resolved to ClientIds
+	SkippedClients      map[string]string         // Clients not executed on with the reason, by client id
+	HostResults         []*ConsensusReportHost    // Outcome per dispatched host, stored on completion
+	TargetLimitExceeded string                    // Why the request needs the higher authorization of the template, empty if within the limits
+	QueuedReason        string                    // Why execution is held back, by a maintenance window or a disabled template
+	MaintenanceOverride bool                      // Execute regardless of maintenance windows
+	FailWhenHeld        bool                      // Fail instead of queueing when execution is held back, the caller waits for the outcome
+	OverrideUserId      string                    // Admin that forced the override
+	Callbacks           []func(*ConsensusRequest) `json:"-"` // Will be called on completions
+	callbacksOnce       sync.Once
 }
 
 func (c *Consensus) Get(id string) *ConsensusRequest {
@@ -62,25 +89,60 @@ func (c *ConsensusRequest) Delete() bool {
 	return true
 }
 
-// Cancel the request
+// Cancel the request, the record is kept and running executions stop starting new work
 func (c *ConsensusRequest) Cancel(user *User) bool {
+	if c.IsFinal() {
+		return false
+	}
 	audit.Log(user, "Consensus", fmt.Sprintf("Cancel %s", c.Id))
-	return c.Delete()
+	c.setState(CONSENSUS_STATE_CANCELLED, user, "")
+	if ece := server.executionCoordinator.Get(c.Id); ece != nil {
+		// Callbacks are executed once the running work has stopped
+		ece.Halt(fmt.Sprintf("Cancelled by %s", user.Username))
+	} else {
+		c.executeCallbacks()
+	}
+	return true
+}
+
+// No longer valid, e.g. because the template changed after it was requested
+func (c *ConsensusRequest) Invalidate(user *User, reason string) bool {
+	c.executeMux.Lock()
+	if c.Executed || c.IsFinal() {
+		c.executeMux.Unlock()
+		return false
+	}
+	c.setState(CONSENSUS_STATE_CANCELLED, user, reason)
+	c.QueuedReason = ""
+	c.executeMux.Unlock()
+	c.executeCallbacks()
+
+	audit.Log(user, "Consensus", fmt.Sprintf("Invalidated %s: %s", c.Id, reason))
+	server.notifier.Notify([]string{c.RequestUserId}, "Request invalidated", fmt.Sprintf("Your request %s was invalidated and has to be requested again: %s", c.Id, reason))
+	return true
+}
+
+// Requests of a template that did not start executing yet
+func (c *Consensus) UnexecutedForTemplate(templateId string) []*ConsensusRequest {
+	c.pendingMux.RLock()
+	defer c.pendingMux.RUnlock()
+	list := make([]*ConsensusRequest, 0)
+	for _, cr := range c.Pending {
+		if cr.TemplateId == templateId && !cr.Executed && !cr.IsFinal() {
+			list = append(list, cr)
+		}
+	}
+	return list
 }
+
+// Template as it was when requested, nil if that version is gone
 func (c *ConsensusRequest) Template() *Template {
-	server.templateStore.templateMux.RLock()
-	template := server.templateStore.Templates[c.TemplateId]
-	server.templateStore.templateMux.RUnlock()
-	return template
+	return server.templateVersionStore.Resolve(c.TemplateId, c.TemplateVersion)
 }
 
 // Start template execution
 func (c *ConsensusRequest) start() bool {
 	template := c.Template()
-	if template == nil {
-		log.Printf("Template %s not found for request %s", c.TemplateId, c.Id)
-		return false
-	}
 
 	// Lock
 	c.executeMux.Lock()
@@ -89,7 +151,63 @@ func (c *ConsensusRequest) start() bool {
 		// Already executed
 		return false
 	}
+	if c.IsFinal() {
+		// Cancelled or expired
+		return false
+	}
+
+	// Never fall back to a version that was not approved
+	if template == nil {
+		log.Printf("Version %d of template %s not found for request %s", c.TemplateVersion, c.TemplateId, c.Id)
+		c.failStart(fmt.Errorf("The approved version %d of the template is not available", c.TemplateVersion))
+		return false
+	}
+
+	// Disabled templates hold back execution until they are enabled again
+	if err := checkTemplateEnabled(c.TemplateId); err != nil {
+		if c.FailWhenHeld {
+			c.failStart(err)
+			return false
+		}
+		if c.QueuedReason != err.Error() {
+			audit.Log(nil, "Consensus", fmt.Sprintf("Request %s held: %s", c.Id, err))
+		}
+		c.QueuedReason = err.Error()
+		return false
+	}
+
+	// Tag expressions resolve to the clients of this moment, those are the ones maintenance windows apply to
+	clientIds := c.ClientIds
+	if len(c.TargetExpression) > 0 {
+		resolved, err := c.resolveTargets(template)
+		if err != nil {
+			c.failStart(err)
+			return false
+		}
+		clientIds = resolved
+	}
+
+	// Maintenance windows, a rollback repairs a failed change so it is never held back
+	if !c.MaintenanceOverride && len(c.RollbackOfRequestId) == 0 {
+		if window, err := server.maintenanceWindowStore.Check(clientIds, time.Now()); err != nil {
+			if window.Action == MAINTENANCE_ACTION_FAIL || c.FailWhenHeld {
+				c.failStart(err)
+				return false
+			}
+			if c.QueuedReason != err.Error() {
+				audit.Log(nil, "Consensus", fmt.Sprintf("Request %s queued: %s", c.Id, err))
+			}
+			c.QueuedReason = err.Error()
+			return false
+		}
+	}
+	c.QueuedReason = ""
+	if len(c.TargetExpression) > 0 {
+		c.commitTargets(clientIds)
+	}
+
 	c.Executed = true
+	c.setState(CONSENSUS_STATE_RUNNING, nil, "")
 
 	// Currently we only support one execution strategy
 	strategy := c.Template().GetExecutionStrategy()
@@ -101,15 +219,113 @@ func (c *ConsensusRequest) start() bool {
 	// Start time
 	c.StartTime = time.Now().Unix()
 
-	// Execute
+	// Execute, completion time is registered by the execution coordinator
 	strategy.Execute(c)
 
-	// Completed
-	c.CompleteTime = time.Now().Unix()
+	return true
+}
+
+// Fail without executing anything, the execute lock must be held
+func (c *ConsensusRequest) failStart(err error) {
+	audit.Log(nil, "Consensus", fmt.Sprintf("Request %s failed: %s", c.Id, err))
+	c.Executed = true
+	c.StartTime = time.Now().Unix()
+	c.CompleteTime = c.StartTime
+	c.HaltReason = err.Error()
+	c.QueuedReason = ""
+	c.setState(CONSENSUS_STATE_FAILED, nil, err.Error())
+	c.executeCallbacks()
+}
+
+// Tell the waiting callers the request reached its final state, only the first call has effect
+func (c *ConsensusRequest) executeCallbacks() {
+	c.callbacksOnce.Do(func() {
+		for _, cb := range c.Callbacks {
+			go cb(c)
+		}
+	})
+}
 
+// Grant the standing approval to the schedule of this request
+func (c *ConsensusRequest) approveSchedule() bool {
+	c.executeMux.Lock()
+	defer c.executeMux.Unlock()
+	if c.Executed {
+		return false
+	}
+	if !server.scheduleStore.Approve(c.ApprovesScheduleId, c) {
+		return false
+	}
+	c.Executed = true
+	c.StartTime = time.Now().Unix()
+	c.CompleteTime = c.StartTime
+	c.setState(CONSENSUS_STATE_SUCCEEDED, nil, fmt.Sprintf("Standing approval of schedule %s", c.ApprovesScheduleId))
 	return true
 }
 
+// Dispatch the rollback template of the request to the hosts that ran the change, under the original approval
+func (c *ConsensusRequest) rollback() *ConsensusRequest {
+	cr := c.newRollbackRequest()
+	if cr == nil {
+		return nil
+	}
+	c.RollbackRequestId = cr.Id
+	audit.Log(nil, "Consensus", fmt.Sprintf("Rollback %s of %s on %v", cr.Id, c.Id, cr.ClientIds))
+
+	server.consensus.pendingMux.Lock()
+	server.consensus.Pending[cr.Id] = cr
+	server.consensus.pendingMux.Unlock()
+
+	// Start without a new consensus round
+	cr.start()
+	server.consensus.save()
+	return cr
+}
+
+// Approved rollback request, nil if there is nothing to roll back
+func (c *ConsensusRequest) newRollbackRequest() *ConsensusRequest {
+	// Never roll back a rollback
+	if len(c.RollbackOfRequestId) > 0 || len(c.RollbackRequestId) > 0 {
+		return nil
+	}
+
+	// Rollback configured?
+	template := c.Template()
+	if template == nil || len(template.RollbackTemplateId) < 1 {
+		return nil
+	}
+	if server.templateStore.Get(template.RollbackTemplateId) == nil {
+		log.Printf("Rollback template %s not found for request %s", template.RollbackTemplateId, c.Id)
+		return nil
+	}
+
+	// Hosts that started execution
+	clientIds := make([]string, 0)
+	for _, cmd := range server.GetRequestCmds(c.Id) {
+		if cmd.Started > 0 {
+			clientIds = append(clientIds, cmd.ClientId)
+		}
+	}
+	if len(clientIds) == 0 {
+		return nil
+	}
+
+	// Create request with the approvals of the original
+	cr := newConsensusRequest()
+	cr.TemplateId = template.RollbackTemplateId
+	cr.TemplateVersion = server.templateStore.Get(template.RollbackTemplateId).Version
+	cr.ClientIds = clientIds
+	cr.RequestUserId = c.RequestUserId
+	cr.Reason = fmt.Sprintf("Rollback of %s: %s", c.Id, c.Reason)
+	cr.RollbackOfRequestId = c.Id
+	for userId := range c.ApproveUserIds {
+		cr.ApproveUserIds[userId] = true
+		cr.ApproveTimes[userId] = c.ApproveTimes[userId]
+	}
+	cr.setState(CONSENSUS_STATE_APPROVED, nil, fmt.Sprintf("Rollback of %s under its approvals", c.Id))
+	return cr
+}
+
 // Check whether this request is good to dispatch
 func (c *ConsensusRequest) check() bool {
 	// Can we start?
@@ -118,9 +334,12 @@ func (c *ConsensusRequest) check() bool {
 		log.Printf("Template %s not found for request %s", c.TemplateId, c.Id)
 		return false
 	}
+	if c.IsFinal() {
+		return false
+	}
 
 	// Did we meet the auth?
-	minAuth := template.Acl.MinAuth
+	minAuth := c.requiredAuth(template)
 	voteCount := 1 // Initial vote by the requester
 	for _ = range c.ApproveUserIds {
 		voteCount++
@@ -131,6 +350,20 @@ func (c *ConsensusRequest) check() bool {
 		return false
 	}
 
+	// Quorum of groups
+	if unmet := c.UnmetQuorumRules(template); len(unmet) > 0 {
+		log.Printf("Quorum rules %v are not yet met for request %s", unmet, c.Id)
+		return false
+	}
+	if c.IsPending() {
+		c.setState(CONSENSUS_STATE_APPROVED, nil, fmt.Sprintf("%d of %d votes", voteCount, minAuth))
+	}
+
+	// Approval of a schedule, nothing to execute now
+	if len(c.ApprovesScheduleId) > 0 {
+		return c.approveSchedule()
+	}
+
 	// Start
 	return c.start()
 }
@@ -142,10 +375,23 @@ func (c *ConsensusRequest) Approve(user *User) bool {
 	if c.RequestUserId == user.Id {
 		return false
 	}
+	if !c.IsPending() {
+		return false
+	}
+	if !c.CanVote(user) {
+		return false
+	}
 	if c.ApproveUserIds[user.Id] {
 		return false
 	}
 	c.ApproveUserIds[user.Id] = true
+	if c.ApproveTimes == nil {
+		c.ApproveTimes = make(map[string]int64)
+	}
+	c.ApproveTimes[user.Id] = time.Now().Unix()
+
+	// Changed their mind
+	delete(c.Rejections, user.Id)
 
 	audit.Log(user, "Consensus", fmt.Sprintf("Approve %s", c.Id))
 
@@ -154,17 +400,120 @@ func (c *ConsensusRequest) Approve(user *User) bool {
 	return true
 }
 
+// Retry requests held back by maintenance windows or disabled templates
+func (c *Consensus) StartQueued() {
+	queued := make([]*ConsensusRequest, 0)
+	c.pendingMux.RLock()
+	for _, cr := range c.Pending {
+		if len(cr.QueuedReason) > 0 && !cr.Executed {
+			queued = append(queued, cr)
+		}
+	}
+	c.pendingMux.RUnlock()
+	if len(queued) == 0 {
+		return
+	}
+
+	for _, cr := range queued {
+		cr.start()
+	}
+	c.save()
+}
+
+// Execute regardless of maintenance windows
+func (c *ConsensusRequest) Override(user *User) bool {
+	if c.Executed {
+		return false
+	}
+	c.MaintenanceOverride = true
+	c.OverrideUserId = user.Id
+	audit.Log(user, "Consensus", fmt.Sprintf("OVERRIDE of maintenance windows for %s", c.Id))
+
+	// Start right away if it was only waiting for a window
+	if len(c.QueuedReason) > 0 {
+		c.start()
+	}
+	return true
+}
+
+// Is the user eligible to approve or reject?
+func (c *ConsensusRequest) CanVote(user *User) bool {
+	if !user.HasRole("approver") {
+		return false
+	}
+	template := c.Template()
+	if template == nil || template.Acl == nil {
+		return false
+	}
+	return template.Acl.CanApprove(user)
+}
+
+type ConsensusRejection struct {
+	Reason string
+	Time   int64 // Unix TS of the rejection
+}
+
+// Vote against the request, enough rejections or a single veto end it
+func (c *ConsensusRequest) Reject(user *User, reason string) bool {
+	if c.RequestUserId == user.Id {
+		return false
+	}
+	if !c.IsPending() {
+		return false
+	}
+	if !c.CanVote(user) {
+		return false
+	}
+	if c.Rejections == nil {
+		c.Rejections = make(map[string]*ConsensusRejection)
+	}
+	if c.Rejections[user.Id] != nil {
+		return false
+	}
+	c.Rejections[user.Id] = &ConsensusRejection{
+		Reason: reason,
+		Time:   time.Now().Unix(),
+	}
+
+	// Changed their mind
+	delete(c.ApproveUserIds, user.Id)
+	delete(c.ApproveTimes, user.Id)
+
+	audit.Log(user, "Consensus", fmt.Sprintf("Reject %s, reason: %s", c.Id, reason))
+	c.addHistory(user, fmt.Sprintf("Rejected: %s", reason))
+	server.notifier.Notify([]string{c.RequestUserId}, "Request rejected", fmt.Sprintf("%s rejected your request %s: %s", user.Username, c.Id, reason))
+
+	// Enough to end it?
+	template := c.Template()
+	if template == nil || template.Acl == nil {
+		return true
+	}
+	if vetoed, required := template.Acl.IsRejected(user, len(c.Rejections)); vetoed {
+		c.executeMux.Lock()
+		if !c.Executed && c.IsPending() {
+			msg := fmt.Sprintf("%d of %d rejections", len(c.Rejections), required)
+			if user.HasAnyRole(template.Acl.VetoRoles) {
+				msg = fmt.Sprintf("Veto by %s", user.Username)
+			}
+			c.setState(CONSENSUS_STATE_REJECTED, user, msg)
+			c.executeCallbacks()
+			server.notifier.Notify([]string{c.RequestUserId}, "Request rejected", fmt.Sprintf("Your request %s will not be executed: %s", c.Id, msg))
+		}
+		c.executeMux.Unlock()
+	}
+	return true
+}
+
 func (c *Consensus) save() {
 	// Lock
 	c.pendingMux.Lock()
 	defer c.pendingMux.Unlock()
 
-	// Cleanup older than 2 weeks
-	maxAge := time.Now().Unix() - (14 * 86400)
+	// Cleanup finished requests after the retention period
+	now := time.Now().Unix()
 	newPending := make(map[string]*ConsensusRequest)
 	for k, pending := range c.Pending {
-		// Skip if too old
-		if pending.CreateTime < maxAge {
+		if !pending.isRetained(now, conf.ConsensusRetentionDays) {
 			continue
 		}
 		newPending[k] = pending
@@ -200,23 +549,46 @@ func (c *Consensus) load() {
 			log.Printf("Invalid consensus storage file (%s) due to: %s", c.ConfFile, je)
 			return
 		}
+		for _, cr := range v {
+			cr.migrateState()
+		}
 		c.Pending = v
 	}
 }
 
-func (c *Consensus) AddRequest(templateId string, clientIds []string, user *User, reason string) *ConsensusRequest {
+func (c *Consensus) AddRequest(templateId string, clientIds []string, user *User, reason string) (*ConsensusRequest, error) {
 	// Double check permissions
 	if !user.HasRole("requester") {
 		log.Printf("User %s (%s) does not have requester permissions", user.Username, user.Id)
-		return nil
+		return nil, errors.New("User does not have requester permissions")
+	}
+
+	// Allowed for this template? System users act on an authorization given up front
+	template := server.templateStore.Get(templateId)
+	if template == nil {
+		return nil, errors.New("Template not found")
+	}
+	if !user.IsSystem() && template.Acl != nil && !template.Acl.CanRequest(user) {
+		log.Printf("User %s (%s) is not allowed to request template %s", user.Username, user.Id, templateId)
+		return nil, errors.New("User is not allowed to request this template")
+	}
+	if err := template.DisabledError(); err != nil {
+		return nil, err
+	}
+	targetLimitExceeded, targetsE := checkTemplateTargets(template, clientIds)
+	if targetsE != nil {
+		return nil, targetsE
 	}
 
 	// Create request
 	cr := newConsensusRequest()
 	cr.TemplateId = templateId
+	cr.TemplateVersion = template.Version
 	cr.ClientIds = clientIds
+	cr.TargetLimitExceeded = targetLimitExceeded
 	cr.RequestUserId = user.Id
 	cr.Reason = reason
+	cr.setState(CONSENSUS_STATE_PENDING, user, reason)
 
 	audit.Log(user, "Consensus", fmt.Sprintf("Request %s, reason: %s", cr.Id, cr.Reason))
 
@@ -224,7 +596,7 @@ func (c *Consensus) AddRequest(templateId string, clientIds []string, user *User
 	c.Pending[cr.Id] = cr
 	c.pendingMux.Unlock()
 
-	return cr
+	return cr, nil
 }
 
 func newConsensus() *Consensus {
@@ -240,6 +612,10 @@ func newConsensusRequest() *ConsensusRequest {
 	return &ConsensusRequest{
 		Id:             id.String(),
 		ApproveUserIds: make(map[string]bool),
+		ApproveTimes:   make(map[string]int64),
+		Rejections:     make(map[string]*ConsensusRejection),
+		StateHistory:   make([]*ConsensusStateTransition, 0),
+		Comments:       make([]*ConsensusComment, 0),
 		CreateTime:     time.Now().Unix(),
 		Callbacks:      make([]func(*ConsensusRequest), 0),
 	}
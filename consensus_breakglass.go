@@ -0,0 +1,305 @@
+package main
+
+// Break-glass, emergency execution without waiting for approvals that has to be reviewed afterwards
+// @author Robin Verlangen
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	BREAK_GLASS_ROLE                     = "breakglass"
+	BREAK_GLASS_MIN_JUSTIFICATION_LENGTH = 20
+	DEFAULT_BREAK_GLASS_REVIEW_DAYS      = 3
+)
+
+type ConsensusBreakGlass struct {
+	UserId          string
+	Justification   string
+	Time            int64                                 // Unix TS of the emergency execution
+	ReviewDeadline  int64                                 // Unix TS the reviews have to be done by
+	RequiredReviews uint                                  // Sign-offs needed, same as the approvals the template would have needed
+	Reviews         map[string]*ConsensusBreakGlassReview // Sign-offs by user id
+	ReviewTime      int64                                 // Unix TS the review was completed, 0 while outstanding
+	OverdueNotified bool
+}
+
+type ConsensusBreakGlassReview struct {
+	Comment string
+	Time    int64
+}
+
+// Did enough approvers sign off?
+func (b *ConsensusBreakGlass) IsReviewed() bool {
+	return b.ReviewTime > 0
+}
+
+// Is the review outstanding past its deadline?
+func (b *ConsensusBreakGlass) IsOverdue(now int64) bool {
+	return !b.IsReviewed() && now > b.ReviewDeadline
+}
+
+// Sign-offs required for a template, the requester counts as the first vote like for regular requests
+func breakGlassRequiredReviews(template *Template) uint {
+	if template == nil || template.Acl == nil || template.Acl.MinAuth < 2 {
+		return 1
+	}
+	return template.Acl.MinAuth - 1
+}
+
+// Is a review outstanding?
+func (c *ConsensusRequest) NeedsBreakGlassReview() bool {
+	return c.BreakGlass != nil && !c.BreakGlass.IsReviewed()
+}
+
+// Execute right away, skipping approvals and maintenance windows
+func (c *ConsensusRequest) breakGlass(user *User, justification string) bool {
+	now := time.Now()
+	requiredReviews := breakGlassRequiredReviews(c.Template())
+	if template := c.Template(); template != nil && c.requiredAuth(template) > requiredReviews+1 {
+		requiredReviews = c.requiredAuth(template) - 1 // Over the target limit
+	}
+	reviewDays := conf.BreakGlassReviewDays
+	if reviewDays < 1 {
+		reviewDays = DEFAULT_BREAK_GLASS_REVIEW_DAYS
+	}
+	c.BreakGlass = &ConsensusBreakGlass{
+		UserId:          user.Id,
+		Justification:   justification,
+		Time:            now.Unix(),
+		ReviewDeadline:  now.Unix() + int64(reviewDays)*86400,
+		RequiredReviews: requiredReviews,
+		Reviews:         make(map[string]*ConsensusBreakGlassReview),
+	}
+	c.MaintenanceOverride = true
+	c.OverrideUserId = user.Id
+	c.setState(CONSENSUS_STATE_APPROVED, user, fmt.Sprintf("BREAK GLASS: %s", justification))
+	audit.Log(user, "Consensus", fmt.Sprintf("BREAK GLASS execution of %s, justification: %s", c.Id, justification))
+
+	// Loud, everybody who could have approved and every admin
+	title := c.TemplateId
+	if template := c.Template(); template != nil {
+		title = template.Title
+	}
+	msg := fmt.Sprintf("%s used break-glass to execute %s on %d client(s) without approval. Justification: %s\nReview request %s before %s.", user.Username, title, len(c.ClientIds), justification, c.Id, time.Unix(c.BreakGlass.ReviewDeadline, 0).Format(time.RFC1123))
+	server.notifier.Notify(appendUniqueIds(c.approverIds(), server.userStore.IdsWithRole("admin")), "BREAK GLASS execution", msg)
+
+	return c.start()
+}
+
+// Sign off on an emergency execution
+func (c *ConsensusRequest) ReviewBreakGlass(user *User, comment string) error {
+	if c.BreakGlass == nil {
+		return errors.New("Request was not a break-glass execution")
+	}
+	if c.BreakGlass.UserId == user.Id || c.RequestUserId == user.Id {
+		return errors.New("Break-glass can not be reviewed by the user that used it")
+	}
+	if !c.CanVote(user) {
+		return errors.New("User is not allowed to review this request")
+	}
+	c.stateMux.Lock()
+	if c.BreakGlass.Reviews == nil {
+		c.BreakGlass.Reviews = make(map[string]*ConsensusBreakGlassReview)
+	}
+	if c.BreakGlass.Reviews[user.Id] != nil {
+		c.stateMux.Unlock()
+		return errors.New("Already reviewed")
+	}
+	c.BreakGlass.Reviews[user.Id] = &ConsensusBreakGlassReview{
+		Comment: comment,
+		Time:    time.Now().Unix(),
+	}
+	completed := !c.BreakGlass.IsReviewed() && uint(len(c.BreakGlass.Reviews)) >= c.BreakGlass.RequiredReviews
+	if completed {
+		c.BreakGlass.ReviewTime = time.Now().Unix()
+	}
+	c.stateMux.Unlock()
+
+	audit.Log(user, "Consensus", fmt.Sprintf("Reviewed break-glass %s: %s", c.Id, comment))
+	c.addHistory(user, fmt.Sprintf("Break-glass reviewed: %s", comment))
+	if completed {
+		c.addHistory(nil, "Break-glass review completed")
+		server.notifier.Notify([]string{c.BreakGlass.UserId}, "Break-glass reviewed", fmt.Sprintf("Your break-glass execution %s has been reviewed", c.Id))
+	}
+	return nil
+}
+
+// Warn admins once about reviews past their deadline
+func (c *Consensus) CheckBreakGlassReviews(now int64) {
+	overdue := make([]*ConsensusRequest, 0)
+	c.pendingMux.RLock()
+	for _, cr := range c.Pending {
+		// Reviews change the break-glass under the state lock
+		cr.stateMux.Lock()
+		if cr.BreakGlass != nil && cr.BreakGlass.IsOverdue(now) && !cr.BreakGlass.OverdueNotified {
+			cr.BreakGlass.OverdueNotified = true
+			overdue = append(overdue, cr)
+		}
+		cr.stateMux.Unlock()
+	}
+	c.pendingMux.RUnlock()
+	if len(overdue) == 0 {
+		return
+	}
+
+	for _, cr := range overdue {
+		audit.Log(nil, "Consensus", fmt.Sprintf("Break-glass review of %s is overdue", cr.Id))
+		server.notifier.Notify(appendUniqueIds(cr.approverIds(), server.userStore.IdsWithRole("admin")), "OVERDUE break-glass review", fmt.Sprintf("The break-glass execution %s has not been reviewed before its deadline. Justification: %s", cr.Id, cr.BreakGlass.Justification))
+	}
+	c.save()
+}
+
+// Merge id lists without duplicates
+func appendUniqueIds(ids []string, more []string) []string {
+	seen := make(map[string]bool)
+	res := make([]string, 0)
+	for _, list := range [][]string{ids, more} {
+		for _, id := range list {
+			if !seen[id] {
+				seen[id] = true
+				res = append(res, id)
+			}
+		}
+	}
+	return res
+}
+
+// Emergency execution
+func PostConsensusBreakGlass(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostConsensusBreakGlass")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	user := getUser(r)
+	if !user.HasRole(BREAK_GLASS_ROLE) {
+		jr.Error("User not allowed to PostConsensusBreakGlass")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Always a fresh second factor, a session alone is never enough
+	if res, _ := user.ValidateTotp(r.PostFormValue("totp")); res == false {
+		audit.Log(user, "Consensus", "Break-glass attempt with invalid two factor token")
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	justification := strings.TrimSpace(r.PostFormValue("justification"))
+	if len(justification) < BREAK_GLASS_MIN_JUSTIFICATION_LENGTH {
+		jr.Error(fmt.Sprintf("Please provide a justification of at least %d characters", BREAK_GLASS_MIN_JUSTIFICATION_LENGTH))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	templateId := strings.TrimSpace(r.PostFormValue("template"))
+	clientIds := splitCommaList(r.PostFormValue("clients"))
+	if len(clientIds) == 0 {
+		jr.Error("Please provide at least one client")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	cr, err := server.consensus.AddRequest(templateId, clientIds, user, justification)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	started := cr.breakGlass(user, justification)
+	server.consensus.save()
+
+	if !started && len(cr.HaltReason) > 0 {
+		jr.Error(cr.HaltReason)
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	jr.Set("id", cr.Id)
+	jr.Set("review_deadline", cr.BreakGlass.ReviewDeadline)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Break-glass executions waiting for a review by the user
+func GetConsensusBreakGlassReviews(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetConsensusBreakGlassReviews")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+
+	reviews := make([]*ConsensusRequest, 0)
+	server.consensus.pendingMux.RLock()
+	for _, cr := range server.consensus.Pending {
+		if !cr.NeedsBreakGlassReview() || cr.BreakGlass.UserId == user.Id || cr.BreakGlass.Reviews[user.Id] != nil {
+			continue
+		}
+		if !cr.CanVote(user) {
+			continue
+		}
+		reviews = append(reviews, cr)
+	}
+	server.consensus.pendingMux.RUnlock()
+
+	jr.Set("requests", reviews)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Sign off on a break-glass execution
+func PostConsensusBreakGlassReview(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostConsensusBreakGlassReview")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	user := getUser(r)
+	if !user.HasRole("approver") {
+		jr.Error("User not allowed to PostConsensusBreakGlassReview")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if !checkStepUp(user, r, STEP_UP_CONSENSUS_APPROVE) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	cr := server.consensus.Get(strings.TrimSpace(r.PostFormValue("id")))
+	if cr == nil {
+		jr.Error("Request not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	comment := strings.TrimSpace(r.PostFormValue("comment"))
+	if len(comment) < 4 {
+		jr.Error("Please provide a review comment")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if err := cr.ReviewBreakGlass(user, comment); err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.consensus.save()
+
+	jr.Set("reviewed", cr.BreakGlass.IsReviewed())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBreakGlassRequiredReviews(t *testing.T) {
+	assert.Equal(t, uint(1), breakGlassRequiredReviews(nil))
+	template := newTemplate("title", "description", "echo", true, []string{}, []string{}, 1, 10, nil)
+	assert.Equal(t, uint(1), breakGlassRequiredReviews(template))
+	template.Acl.MinAuth = 3
+	assert.Equal(t, uint(2), breakGlassRequiredReviews(template))
+}
+
+func TestBreakGlassReviewState(t *testing.T) {
+	b := &ConsensusBreakGlass{ReviewDeadline: 1000}
+	assert.False(t, b.IsOverdue(1000))
+	assert.True(t, b.IsOverdue(1001))
+	b.ReviewTime = 900
+	assert.True(t, b.IsReviewed())
+	assert.False(t, b.IsOverdue(1001))
+}
+
+func TestBreakGlassRetention(t *testing.T) {
+	now := int64(100 * 86400)
+	cr := newConsensusRequest()
+	cr.State = CONSENSUS_STATE_SUCCEEDED
+	cr.StateHistory = []*ConsensusStateTransition{{State: CONSENSUS_STATE_SUCCEEDED, Time: 0}}
+	assert.False(t, cr.isRetained(now, 14))
+
+	// Kept until reviewed
+	cr.BreakGlass = &ConsensusBreakGlass{ReviewDeadline: 86400}
+	assert.True(t, cr.isRetained(now, 14))
+	cr.BreakGlass.ReviewTime = 86400
+	assert.False(t, cr.isRetained(now, 14))
+}
+
+func TestAppendUniqueIds(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, appendUniqueIds([]string{"a", "b"}, []string{"b", "c", "a"}))
+}
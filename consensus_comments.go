@@ -0,0 +1,232 @@
+package main
+
+// Discussion on a consensus request between the requester and approvers
+// @author Robin Verlangen
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	CONSENSUS_COMMENT_EDIT_WINDOW = 900  // Seconds after creation a comment can be edited by its author
+	CONSENSUS_COMMENT_MAX_LENGTH  = 4000 // Characters
+)
+
+var commentMentionRegexp = regexp.MustCompile(`(^|\s)@([[:alnum:]._-]+)`)
+
+type ConsensusComment struct {
+	Id         string
+	UserId     string
+	Text       string
+	CreateTime int64 // Unix TS of creation
+	EditTime   int64 // Unix TS of the last edit, 0 if never edited
+}
+
+// May the author still change it?
+func (c *ConsensusComment) IsEditable(now int64) bool {
+	return now-c.CreateTime <= CONSENSUS_COMMENT_EDIT_WINDOW
+}
+
+// Add a comment and notify the mentioned users
+func (c *ConsensusRequest) AddComment(user *User, text string) (*ConsensusComment, error) {
+	text = strings.TrimSpace(text)
+	if err := validateCommentText(text); err != nil {
+		return nil, err
+	}
+	comment := &ConsensusComment{
+		Id:         uuidStr(),
+		UserId:     user.Id,
+		Text:       text,
+		CreateTime: time.Now().Unix(),
+	}
+	c.commentMux.Lock()
+	c.Comments = append(c.Comments, comment)
+	c.commentMux.Unlock()
+
+	audit.Log(user, "Consensus", fmt.Sprintf("Comment %s on %s: %s", comment.Id, c.Id, text))
+	c.notifyMentions(user, text, "")
+	return comment, nil
+}
+
+// Edit a comment, only by its author within the edit window
+func (c *ConsensusRequest) EditComment(user *User, commentId string, text string) (*ConsensusComment, error) {
+	text = strings.TrimSpace(text)
+	if err := validateCommentText(text); err != nil {
+		return nil, err
+	}
+
+	c.commentMux.Lock()
+	var comment *ConsensusComment
+	for _, elm := range c.Comments {
+		if elm.Id == commentId {
+			comment = elm
+			break
+		}
+	}
+	if comment == nil {
+		c.commentMux.Unlock()
+		return nil, errors.New("Comment not found")
+	}
+	if comment.UserId != user.Id {
+		c.commentMux.Unlock()
+		return nil, errors.New("Only the author can edit a comment")
+	}
+	now := time.Now().Unix()
+	if !comment.IsEditable(now) {
+		c.commentMux.Unlock()
+		return nil, errors.New("Comment can no longer be edited")
+	}
+	previous := comment.Text
+	comment.Text = text
+	comment.EditTime = now
+	c.commentMux.Unlock()
+
+	audit.Log(user, "Consensus", fmt.Sprintf("Edit comment %s on %s: %s", comment.Id, c.Id, text))
+	c.notifyMentions(user, text, previous)
+	return comment, nil
+}
+
+// Copy of the comments
+func (c *ConsensusRequest) GetComments() []*ConsensusComment {
+	c.commentMux.RLock()
+	defer c.commentMux.RUnlock()
+	comments := make([]*ConsensusComment, len(c.Comments))
+	copy(comments, c.Comments)
+	return comments
+}
+
+// May the user take part in the discussion?
+func (c *ConsensusRequest) CanComment(user *User) bool {
+	return c.RequestUserId == user.Id || user.HasRole("admin") || c.CanVote(user)
+}
+
+func (c *ConsensusRequest) notifyMentions(author *User, text string, previous string) {
+	userIds := c.mentionedUserIds(author, text, previous)
+	server.notifier.Notify(userIds, "Mentioned in a request", fmt.Sprintf("%s mentioned you on request %s: %s", author.Username, c.Id, text))
+}
+
+// Users to notify of a comment, only those that can see the request and were not mentioned before the edit
+func (c *ConsensusRequest) mentionedUserIds(author *User, text string, previous string) []string {
+	notified := make(map[string]bool)
+	for _, username := range parseMentions(previous) {
+		notified[username] = true
+	}
+	userIds := make([]string, 0)
+	for _, username := range parseMentions(text) {
+		if notified[username] {
+			continue
+		}
+		usr := server.userStore.ByName(username)
+		if usr == nil || usr.Id == author.Id || !c.CanComment(usr) {
+			continue
+		}
+		userIds = append(userIds, usr.Id)
+	}
+	return userIds
+}
+
+// Unique usernames mentioned with @username
+func parseMentions(text string) []string {
+	usernames := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, match := range commentMentionRegexp.FindAllStringSubmatch(text, -1) {
+		username := strings.TrimRight(match[2], ".")
+		if len(username) == 0 || seen[username] {
+			continue
+		}
+		seen[username] = true
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+func validateCommentText(text string) error {
+	if len(text) < 1 {
+		return errors.New("Comment can not be empty")
+	}
+	if len(text) > CONSENSUS_COMMENT_MAX_LENGTH {
+		return fmt.Errorf("Comment can not be longer than %d characters", CONSENSUS_COMMENT_MAX_LENGTH)
+	}
+	return nil
+}
+
+// Request of the url that the user may comment on
+func getCommentableRequest(jr *jresp.JsonResp, r *http.Request, ps httprouter.Params) (*User, *ConsensusRequest) {
+	if !authUser(r) {
+		jr.Error("Not authorized")
+		return nil, nil
+	}
+	user := getUser(r)
+	cr := server.consensus.Get(ps.ByName("id"))
+	if cr == nil {
+		jr.Error("Request not found")
+		return nil, nil
+	}
+	if !cr.CanComment(user) {
+		jr.Error("Not allowed")
+		return nil, nil
+	}
+	return user, cr
+}
+
+// List comments
+func GetConsensusComments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	_, cr := getCommentableRequest(jr, r, ps)
+	if cr == nil {
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("comments", cr.GetComments())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Add comment
+func PostConsensusComment(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user, cr := getCommentableRequest(jr, r, ps)
+	if cr == nil {
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	comment, err := cr.AddComment(user, r.PostFormValue("text"))
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.consensus.save()
+
+	jr.Set("comment", comment)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Edit comment
+func PutConsensusComment(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user, cr := getCommentableRequest(jr, r, ps)
+	if cr == nil {
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	comment, err := cr.EditComment(user, ps.ByName("commentid"), r.PostFormValue("text"))
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.consensus.save()
+
+	jr.Set("comment", comment)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
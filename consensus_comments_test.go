@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	assert.Equal(t, []string{"alice", "bob.smith"}, parseMentions("@alice can you check this with @bob.smith? Thanks @alice."))
+	assert.Equal(t, []string{"ops-lead"}, parseMentions("Ping @ops-lead."))
+	assert.Len(t, parseMentions("mail me at alice@example.com"), 0)
+	assert.Len(t, parseMentions("nobody @ all"), 0)
+}
+
+func TestConsensusCommentEditWindow(t *testing.T) {
+	comment := &ConsensusComment{CreateTime: 1000}
+	assert.True(t, comment.IsEditable(1000))
+	assert.True(t, comment.IsEditable(1000+CONSENSUS_COMMENT_EDIT_WINDOW))
+	assert.False(t, comment.IsEditable(1001+CONSENSUS_COMMENT_EDIT_WINDOW))
+}
+
+func TestValidateCommentText(t *testing.T) {
+	assert.Nil(t, validateCommentText("looks good"))
+	assert.NotNil(t, validateCommentText(""))
+	assert.NotNil(t, validateCommentText(strings.Repeat("a", CONSENSUS_COMMENT_MAX_LENGTH+1)))
+}
+
+func TestMentionedUserIds(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	requester := &User{Id: "u1", Username: "requester", Roles: map[string]bool{"requester": true}}
+	server = &Server{
+		templateStore:        &TemplateStore{Templates: map[string]*Template{"t1": {Id: "t1", Title: "Deploy"}}},
+		templateVersionStore: &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)},
+		userStore: &UserStore{Users: []*User{
+			requester,
+			{Id: "u2", Username: "alice", Roles: map[string]bool{"admin": true}},
+			{Id: "u3", Username: "bob", Roles: map[string]bool{"admin": true}},
+			{Id: "u4", Username: "outsider", Roles: map[string]bool{"requester": true}},
+		}},
+	}
+	cr := newConsensusRequest()
+	cr.TemplateId = "t1"
+	cr.RequestUserId = requester.Id
+
+	// Those that can not see the request and the author are left out
+	assert.Equal(t, []string{"u2"}, cr.mentionedUserIds(requester, "@alice @outsider @requester please check", ""))
+
+	// Edits only notify the new mentions
+	assert.Equal(t, []string{"u3"}, cr.mentionedUserIds(requester, "@alice and @bob please check", "@alice please check"))
+	assert.Len(t, cr.mentionedUserIds(requester, "@alice please check again", "@alice please check"), 0)
+}
@@ -0,0 +1,176 @@
+package main
+
+// History of all consensus requests, including executed, cancelled and expired ones within the retention period
+// @author Robin Verlangen
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"github.com/unilama/indispenso/data_table"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CONSENSUS_HISTORY_DATE_FORMAT = "2006-01-02"
+
+type ConsensusHistoryFilter struct {
+	TemplateId    string
+	RequestUserId string
+	ApproveUserId string
+	ClientId      string
+	State         string
+	From          int64 // Unix TS, created at or after
+	To            int64 // Unix TS, created before
+}
+
+// Does the request pass all filters that are set?
+func (f *ConsensusHistoryFilter) Matches(cr *ConsensusRequest) bool {
+	if len(f.TemplateId) > 0 && cr.TemplateId != f.TemplateId {
+		return false
+	}
+	if len(f.RequestUserId) > 0 && cr.RequestUserId != f.RequestUserId {
+		return false
+	}
+	if len(f.ApproveUserId) > 0 && !cr.ApproveUserIds[f.ApproveUserId] {
+		return false
+	}
+	if len(f.State) > 0 && cr.State != f.State {
+		return false
+	}
+	if f.From > 0 && cr.CreateTime < f.From {
+		return false
+	}
+	if f.To > 0 && cr.CreateTime >= f.To {
+		return false
+	}
+	if len(f.ClientId) > 0 {
+		found := false
+		for _, clientId := range cr.ClientIds {
+			if clientId == f.ClientId {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Date (inclusive) or unix timestamp, the end of a range given as a date covers that whole day
+func parseHistoryTime(s string, endOfDay bool) (int64, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.ParseInLocation(CONSENSUS_HISTORY_DATE_FORMAT, s, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid date %s, use %s or a unix timestamp", s, CONSENSUS_HISTORY_DATE_FORMAT)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t.Unix(), nil
+}
+
+// Filter from the form, users are referenced by name
+func parseConsensusHistoryFilter(r *http.Request) (*ConsensusHistoryFilter, error) {
+	f := &ConsensusHistoryFilter{
+		TemplateId: strings.TrimSpace(r.FormValue("template")),
+		ClientId:   strings.TrimSpace(r.FormValue("client")),
+		State:      strings.TrimSpace(r.FormValue("state")),
+	}
+	var err error
+	if f.From, err = parseHistoryTime(r.FormValue("from"), false); err != nil {
+		return nil, err
+	}
+	if f.To, err = parseHistoryTime(r.FormValue("to"), true); err != nil {
+		return nil, err
+	}
+	if username := strings.TrimSpace(r.FormValue("requester")); len(username) > 0 {
+		f.RequestUserId = historyUserId(username)
+	}
+	if username := strings.TrimSpace(r.FormValue("approver")); len(username) > 0 {
+		f.ApproveUserId = historyUserId(username)
+	}
+	return f, nil
+}
+
+// Unknown users filter out everything
+func historyUserId(username string) string {
+	if usr := server.userStore.ByName(username); usr != nil {
+		return usr.Id
+	}
+	return fmt.Sprintf("unknown:%s", username)
+}
+
+func ConsensusHistoryQuery(tableStore *data_table.DefaultStore, filter *ConsensusHistoryFilter) *data_table.DefaultStore {
+	server.consensus.pendingMux.RLock()
+	defer server.consensus.pendingMux.RUnlock()
+	for _, cr := range server.consensus.Pending {
+		if !filter.Matches(cr) {
+			continue
+		}
+		row := make(map[string]interface{})
+		row["id"] = cr.Id
+		row["created"] = time.Unix(cr.CreateTime, 0).Format("2006-01-02 15:04:05")
+		row["state"] = cr.State
+		row["reason"] = cr.Reason
+		row["clients"] = strings.Join(cr.ClientIds, ", ")
+
+		if template := server.templateStore.Get(cr.TemplateId); template != nil {
+			row["template"] = template.Title
+		} else {
+			row["template"] = "-"
+		}
+		if usr := server.userStore.ById(cr.RequestUserId); usr != nil {
+			row["requester"] = usr.Username
+		} else {
+			row["requester"] = "-"
+		}
+		approvers := make([]string, 0)
+		for userId := range cr.ApproveUserIds {
+			if usr := server.userStore.ById(userId); usr != nil {
+				approvers = append(approvers, usr.Username)
+			}
+		}
+		sort.Strings(approvers)
+		row["approvers"] = strings.Join(approvers, ", ")
+		row["link"] = fmt.Sprintf("report?id=%s", cr.Id)
+
+		rowObj := tableStore.CreateRow(row)
+		if cr.BreakGlass != nil {
+			rowObj.RowClass = "history-breakglass"
+		}
+		tableStore.AddRow(rowObj)
+	}
+	return tableStore
+}
+
+// Search through all requests
+func PostConsensusHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !authUser(r) {
+		jr := jresp.NewJsonResp()
+		jr.Error("User not authorized for PostConsensusHistory")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	filter, err := parseConsensusHistoryFilter(r)
+	if err != nil {
+		jr := jresp.NewJsonResp()
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	data_table.DefaultStoreHandler(func(tableStore *data_table.DefaultStore) *data_table.DefaultStore {
+		return ConsensusHistoryQuery(tableStore, filter)
+	})(w, r, ps)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConsensusHistoryFilter(t *testing.T) {
+	cr := newConsensusRequest()
+	cr.TemplateId = "t1"
+	cr.RequestUserId = "u1"
+	cr.ApproveUserIds["u2"] = true
+	cr.ClientIds = []string{"web1", "web2"}
+	cr.State = CONSENSUS_STATE_SUCCEEDED
+	cr.CreateTime = 1000
+
+	assert.True(t, (&ConsensusHistoryFilter{}).Matches(cr))
+	assert.True(t, (&ConsensusHistoryFilter{TemplateId: "t1", RequestUserId: "u1", ApproveUserId: "u2", ClientId: "web2", State: CONSENSUS_STATE_SUCCEEDED, From: 1000, To: 1001}).Matches(cr))
+	assert.False(t, (&ConsensusHistoryFilter{TemplateId: "t2"}).Matches(cr))
+	assert.False(t, (&ConsensusHistoryFilter{RequestUserId: "u2"}).Matches(cr))
+	assert.False(t, (&ConsensusHistoryFilter{ApproveUserId: "u1"}).Matches(cr))
+	assert.False(t, (&ConsensusHistoryFilter{ClientId: "db1"}).Matches(cr))
+	assert.False(t, (&ConsensusHistoryFilter{State: CONSENSUS_STATE_FAILED}).Matches(cr))
+	assert.False(t, (&ConsensusHistoryFilter{From: 1001}).Matches(cr))
+	assert.False(t, (&ConsensusHistoryFilter{To: 1000}).Matches(cr))
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	ts, err := parseHistoryTime("", false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), ts)
+
+	ts, _ = parseHistoryTime("1500000000", true)
+	assert.Equal(t, int64(1500000000), ts)
+
+	day := time.Date(2017, 3, 14, 0, 0, 0, 0, time.Local)
+	ts, _ = parseHistoryTime("2017-03-14", false)
+	assert.Equal(t, day.Unix(), ts)
+	ts, _ = parseHistoryTime("2017-03-14", true)
+	assert.Equal(t, day.AddDate(0, 0, 1).Unix(), ts)
+
+	_, err = parseHistoryTime("last tuesday", false)
+	assert.NotNil(t, err)
+}
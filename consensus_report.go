@@ -0,0 +1,475 @@
+package main
+
+// Report of everything that happened for a single consensus request, exportable as JSON and CSV
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	REPORT_VERDICT_PENDING = "pending" // Not yet started
+	REPORT_VERDICT_RUNNING = "running" // Commands are still being executed
+	REPORT_VERDICT_SUCCESS = "success" // All hosts finished and passed validation
+	REPORT_VERDICT_FAILED  = "failed"  // One or more hosts failed
+)
+
+type ConsensusRequestReport struct {
+	Id               string
+	TemplateId       string
+	TemplateTitle    string
+	TemplateVersion  int
+	TargetExpression string // Tag expression the hosts were resolved from, if any
+	RequestUserId    string
+	RequestUsername  string
+	Reason           string
+	CreateTime       int64
+	StartTime        int64
+	CompleteTime     int64
+	Approvals        []*ConsensusReportApproval
+	Rejections       []*ConsensusReportRejection
+	Comments         []*ConsensusReportComment
+	Revisions        []*ConsensusRevision
+	Batches          []*ConsensusReportBatch
+	Hosts            []*ConsensusReportHost
+	Skipped          []*ConsensusReportHost // Hosts left out on purpose with the reason, they do not count for the verdict
+	Verdict          string
+	State            string
+	StateHistory     []*ConsensusStateTransition
+
+	HaltReason          string                  // Why execution stopped before all hosts were done
+	BreakGlass          *ConsensusBreakGlass    // Emergency execution without approval and its review
+	ProbeResults        []*HealthProbeResult    // Health probes between batches
+	RollbackOfRequestId string                  // Set if this request is the rollback of another one
+	Rollback            *ConsensusRequestReport // Report of the rollback triggered by a failure of this request
+}
+
+type ConsensusReportApproval struct {
+	UserId   string
+	Username string
+	Time     int64 // Unix TS of the approval, 0 if unknown
+}
+
+type ConsensusReportRejection struct {
+	UserId   string
+	Username string
+	Time     int64
+	Reason   string
+}
+
+type ConsensusReportComment struct {
+	UserId     string
+	Username   string
+	Text       string
+	CreateTime int64
+	EditTime   int64
+}
+
+type ConsensusReportBatch struct {
+	Iteration int
+	StartTime int64
+	EndTime   int64 // 0 while one of the hosts is still running
+	ClientIds []string
+}
+
+type ConsensusReportHost struct {
+	ClientId     string
+	CmdId        string
+	Iteration    int
+	State        string
+	ExitCode     int
+	DispatchTime int64
+	StartTime    int64
+	EndTime      int64
+	Duration     int64 // Seconds
+	Validation   []*ExecutionValidationResult
+	Reason       string // Why the host was skipped
+}
+
+// Assemble the report of a request from its dispatched commands
+func newConsensusRequestReport(cr *ConsensusRequest, template *Template, cmds []*Cmd) *ConsensusRequestReport {
+	cr.executeMux.RLock()
+	defer cr.executeMux.RUnlock()
+	cr.stateMux.Lock()
+	defer cr.stateMux.Unlock()
+
+	r := &ConsensusRequestReport{
+		Id:                  cr.Id,
+		TemplateId:          cr.TemplateId,
+		TemplateVersion:     cr.TemplateVersion,
+		TargetExpression:    cr.TargetExpression,
+		RequestUserId:       cr.RequestUserId,
+		Reason:              cr.Reason,
+		CreateTime:          cr.CreateTime,
+		StartTime:           cr.StartTime,
+		CompleteTime:        cr.CompleteTime,
+		HaltReason:          cr.HaltReason,
+		ProbeResults:        cr.ProbeResults,
+		RollbackOfRequestId: cr.RollbackOfRequestId,
+		State:               cr.State,
+		StateHistory:        cr.StateHistory,
+		Revisions:           cr.Revisions,
+		Approvals:           make([]*ConsensusReportApproval, 0),
+		Rejections:          make([]*ConsensusReportRejection, 0),
+		Comments:            make([]*ConsensusReportComment, 0),
+		Batches:             make([]*ConsensusReportBatch, 0),
+		Hosts:               make([]*ConsensusReportHost, 0),
+		Skipped:             make([]*ConsensusReportHost, 0),
+	}
+	if template != nil {
+		r.TemplateTitle = template.Title
+	}
+
+	// Reviews keep coming in after the report is built
+	if cr.BreakGlass != nil {
+		breakGlass := *cr.BreakGlass
+		breakGlass.Reviews = make(map[string]*ConsensusBreakGlassReview)
+		for userId, review := range cr.BreakGlass.Reviews {
+			breakGlass.Reviews[userId] = review
+		}
+		r.BreakGlass = &breakGlass
+	}
+
+	// Approvals in order of time
+	for userId := range cr.ApproveUserIds {
+		r.Approvals = append(r.Approvals, &ConsensusReportApproval{
+			UserId: userId,
+			Time:   cr.ApproveTimes[userId],
+		})
+	}
+	sort.Sort(consensusReportApprovalsByTime(r.Approvals))
+	for userId, rejection := range cr.Rejections {
+		r.Rejections = append(r.Rejections, &ConsensusReportRejection{
+			UserId: userId,
+			Time:   rejection.Time,
+			Reason: rejection.Reason,
+		})
+	}
+	sort.Sort(consensusReportRejectionsByTime(r.Rejections))
+	for _, comment := range cr.GetComments() {
+		r.Comments = append(r.Comments, &ConsensusReportComment{
+			UserId:     comment.UserId,
+			Text:       comment.Text,
+			CreateTime: comment.CreateTime,
+			EditTime:   comment.EditTime,
+		})
+	}
+
+	// Hosts, as stored on completion since the dispatched commands do not survive a restart
+	hosts := cr.HostResults
+	if hosts == nil {
+		hosts = reportHosts(cmds)
+	}
+	dispatched := make(map[string]bool)
+	for _, host := range hosts {
+		r.Hosts = append(r.Hosts, host)
+		dispatched[host.ClientId] = true
+	}
+
+	// Requested hosts that never received a command
+	for _, clientId := range cr.ClientIds {
+		if dispatched[clientId] {
+			continue
+		}
+		if reason, ok := cr.SkippedClients[clientId]; ok {
+			r.Skipped = append(r.Skipped, &ConsensusReportHost{
+				ClientId: clientId,
+				State:    "skipped",
+				Reason:   reason,
+			})
+			continue
+		}
+		state := "pending"
+		if len(cr.ApprovesScheduleId) > 0 {
+			state = "scheduled" // Approval of a schedule never dispatches itself
+		} else if cr.Executed {
+			state = "not_dispatched"
+		}
+		r.Hosts = append(r.Hosts, &ConsensusReportHost{
+			ClientId: clientId,
+			State:    state,
+		})
+	}
+	sort.Sort(consensusReportHostsByIteration(r.Hosts))
+	sort.Sort(consensusReportHostsByIteration(r.Skipped))
+
+	// Batches
+	batches := make(map[int]*ConsensusReportBatch)
+	for _, host := range hosts {
+		batch := batches[host.Iteration]
+		if batch == nil {
+			batch = &ConsensusReportBatch{
+				Iteration: host.Iteration,
+				ClientIds: make([]string, 0),
+			}
+			batches[host.Iteration] = batch
+			r.Batches = append(r.Batches, batch)
+		}
+		batch.ClientIds = append(batch.ClientIds, host.ClientId)
+		if batch.StartTime == 0 || (host.DispatchTime > 0 && host.DispatchTime < batch.StartTime) {
+			batch.StartTime = host.DispatchTime
+		}
+	}
+	for _, batch := range r.Batches {
+		var end int64 = 0
+		for _, host := range hosts {
+			if host.Iteration != batch.Iteration {
+				continue
+			}
+			if !(&Cmd{State: host.State}).IsFinal() {
+				end = 0
+				break
+			}
+			if host.EndTime > end {
+				end = host.EndTime
+			}
+		}
+		batch.EndTime = end
+	}
+	sort.Sort(consensusReportBatchesByIteration(r.Batches))
+
+	r.Verdict = r.computeVerdict(cr.Executed)
+	if !cr.Executed && cr.IsFinal() {
+		// Cancelled, expired or rejected before execution
+		r.Verdict = cr.State
+	}
+	return r
+}
+
+// Outcome per dispatched command
+func reportHosts(cmds []*Cmd) []*ConsensusReportHost {
+	hosts := make([]*ConsensusReportHost, 0)
+	for _, cmd := range cmds {
+		host := &ConsensusReportHost{
+			ClientId:     cmd.ClientId,
+			CmdId:        cmd.Id,
+			Iteration:    cmd.ExecutionIterationId,
+			State:        cmd.State,
+			ExitCode:     cmd.ExitCode,
+			DispatchTime: cmd.Dispatched,
+			StartTime:    cmd.Started,
+			EndTime:      cmd.Completed,
+			Validation:   cmd.ValidationResults,
+		}
+		if host.StartTime == 0 {
+			host.StartTime = cmd.Dispatched
+		}
+		if host.EndTime > 0 && host.StartTime > 0 {
+			host.Duration = host.EndTime - host.StartTime
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Sort(consensusReportHostsByIteration(hosts))
+	return hosts
+}
+
+// Keep the outcome per host with the request, the commands themselves only live in memory
+func (c *ConsensusRequest) recordHostResults(cmds []*Cmd) {
+	hosts := reportHosts(cmds)
+	c.executeMux.Lock()
+	c.HostResults = hosts
+	c.executeMux.Unlock()
+}
+
+// Full report of a request including its rollback
+func (c *ConsensusRequest) Report() *ConsensusRequestReport {
+	report := newConsensusRequestReport(c, c.Template(), server.GetRequestCmds(c.Id))
+	report.resolveUsernames(server.userStore)
+	if len(c.RollbackRequestId) > 0 {
+		if rollback := server.consensus.Get(c.RollbackRequestId); rollback != nil {
+			report.Rollback = rollback.Report()
+		}
+	}
+	return report
+}
+
+// Overall outcome of the request
+func (r *ConsensusRequestReport) computeVerdict(executed bool) string {
+	if !executed {
+		return REPORT_VERDICT_PENDING
+	}
+	running := false
+	for _, host := range r.Hosts {
+		switch host.State {
+		case "finished", "scheduled":
+			continue
+		case "failed", "failed_validation", "invalid_signature", "not_dispatched":
+			return REPORT_VERDICT_FAILED
+		default:
+			running = true
+		}
+	}
+	if running {
+		return REPORT_VERDICT_RUNNING
+	}
+	return REPORT_VERDICT_SUCCESS
+}
+
+// Fill in user names for display
+func (r *ConsensusRequestReport) resolveUsernames(s *UserStore) {
+	if usr := s.ById(r.RequestUserId); usr != nil {
+		r.RequestUsername = usr.Username
+	}
+	for _, approval := range r.Approvals {
+		if usr := s.ById(approval.UserId); usr != nil {
+			approval.Username = usr.Username
+		}
+	}
+	for _, rejection := range r.Rejections {
+		if usr := s.ById(rejection.UserId); usr != nil {
+			rejection.Username = usr.Username
+		}
+	}
+	for _, comment := range r.Comments {
+		if usr := s.ById(comment.UserId); usr != nil {
+			comment.Username = usr.Username
+		}
+	}
+}
+
+// One line per host
+func (r *ConsensusRequestReport) ToCsv() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.Write([]string{"request", "template", "verdict", "client", "cmd", "iteration", "state", "exit_code", "start", "end", "duration", "validation", "reason"})
+	r.writeCsvRows(w)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *ConsensusRequestReport) writeCsvRows(w *csv.Writer) {
+	hosts := make([]*ConsensusReportHost, 0, len(r.Hosts)+len(r.Skipped))
+	hosts = append(hosts, r.Hosts...)
+	hosts = append(hosts, r.Skipped...)
+	for _, host := range hosts {
+		w.Write([]string{
+			r.Id,
+			r.TemplateTitle,
+			r.Verdict,
+			host.ClientId,
+			host.CmdId,
+			fmt.Sprintf("%d", host.Iteration),
+			host.State,
+			fmt.Sprintf("%d", host.ExitCode),
+			formatReportTime(host.StartTime),
+			formatReportTime(host.EndTime),
+			fmt.Sprintf("%d", host.Duration),
+			formatReportValidation(host.Validation),
+			host.Reason,
+		})
+	}
+	if r.Rollback != nil {
+		r.Rollback.writeCsvRows(w)
+	}
+}
+
+func formatReportTime(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+	return time.Unix(ts, 0).Format("2006-01-02 15:04:05")
+}
+
+func formatReportValidation(results []*ExecutionValidationResult) string {
+	failed := make([]string, 0)
+	for _, result := range results {
+		if !result.Passed {
+			failed = append(failed, result.Text)
+		}
+	}
+	if len(failed) == 0 {
+		if len(results) == 0 {
+			return ""
+		}
+		return "passed"
+	}
+	return fmt.Sprintf("failed: %s", strings.Join(failed, "; "))
+}
+
+type consensusReportApprovalsByTime []*ConsensusReportApproval
+
+func (a consensusReportApprovalsByTime) Len() int           { return len(a) }
+func (a consensusReportApprovalsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a consensusReportApprovalsByTime) Less(i, j int) bool { return a[i].Time < a[j].Time }
+
+type consensusReportRejectionsByTime []*ConsensusReportRejection
+
+func (a consensusReportRejectionsByTime) Len() int           { return len(a) }
+func (a consensusReportRejectionsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a consensusReportRejectionsByTime) Less(i, j int) bool { return a[i].Time < a[j].Time }
+
+type consensusReportHostsByIteration []*ConsensusReportHost
+
+func (a consensusReportHostsByIteration) Len() int      { return len(a) }
+func (a consensusReportHostsByIteration) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a consensusReportHostsByIteration) Less(i, j int) bool {
+	if a[i].Iteration != a[j].Iteration {
+		return a[i].Iteration < a[j].Iteration
+	}
+	return a[i].ClientId < a[j].ClientId
+}
+
+type consensusReportBatchesByIteration []*ConsensusReportBatch
+
+func (a consensusReportBatchesByIteration) Len() int      { return len(a) }
+func (a consensusReportBatchesByIteration) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a consensusReportBatchesByIteration) Less(i, j int) bool {
+	return a[i].Iteration < a[j].Iteration
+}
+
+// Get the report of a request
+func GetConsensusRequestReport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetConsensusRequestReport")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Request
+	cr := server.consensus.Get(ps.ByName("id"))
+	if cr == nil {
+		jr.Error("Request not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Comments, rejections and revisions are only for those taking part
+	if !cr.CanComment(getUser(r)) {
+		jr.Error("Not allowed")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Build
+	report := cr.Report()
+
+	// CSV export
+	if r.URL.Query().Get("format") == "csv" {
+		b, err := report.ToCsv()
+		if err != nil {
+			jr.Error(fmt.Sprintf("Failed creating csv: %s", err))
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"request-%s.csv\"", cr.Id))
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+		w.Write(b)
+		return
+	}
+
+	jr.Set("report", report)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
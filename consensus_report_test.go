@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func newReportTestCmd(clientId string, iteration int, state string, dispatched int64, completed int64) *Cmd {
+	cmd := newCmd("echo test", 10)
+	cmd.ClientId = clientId
+	cmd.ExecutionIterationId = iteration
+	cmd.State = state
+	cmd.Dispatched = dispatched
+	cmd.Started = dispatched
+	cmd.Completed = completed
+	return cmd
+}
+
+func TestConsensusReportPending(t *testing.T) {
+	cr := newConsensusRequest()
+	cr.ClientIds = []string{"a", "b"}
+
+	report := newConsensusRequestReport(cr, nil, []*Cmd{})
+	assert.Equal(t, REPORT_VERDICT_PENDING, report.Verdict)
+	assert.Len(t, report.Hosts, 2)
+	assert.Equal(t, "pending", report.Hosts[0].State)
+	assert.Len(t, report.Batches, 0)
+}
+
+func TestConsensusReportBatches(t *testing.T) {
+	cr := newConsensusRequest()
+	cr.ClientIds = []string{"a", "b", "c"}
+	cr.Executed = true
+	cr.ApproveUserIds["second"] = true
+	cr.ApproveUserIds["first"] = true
+	cr.ApproveTimes["second"] = 200
+	cr.ApproveTimes["first"] = 100
+
+	cmds := []*Cmd{
+		newReportTestCmd("a", 1, "finished", 1000, 1010),
+		newReportTestCmd("b", 2, "finished", 1020, 1050),
+		newReportTestCmd("c", 2, "finished", 1021, 1040),
+	}
+	report := newConsensusRequestReport(cr, nil, cmds)
+	assert.Equal(t, REPORT_VERDICT_SUCCESS, report.Verdict)
+
+	assert.Equal(t, "first", report.Approvals[0].UserId)
+	assert.Equal(t, "second", report.Approvals[1].UserId)
+
+	assert.Len(t, report.Batches, 2)
+	assert.Equal(t, 1, report.Batches[0].Iteration)
+	assert.Equal(t, int64(1000), report.Batches[0].StartTime)
+	assert.Equal(t, int64(1010), report.Batches[0].EndTime)
+	assert.Equal(t, int64(1020), report.Batches[1].StartTime)
+	assert.Equal(t, int64(1050), report.Batches[1].EndTime)
+
+	assert.Equal(t, int64(10), report.Hosts[0].Duration)
+}
+
+func TestConsensusReportVerdict(t *testing.T) {
+	cr := newConsensusRequest()
+	cr.ClientIds = []string{"a", "b"}
+	cr.Executed = true
+
+	running := newConsensusRequestReport(cr, nil, []*Cmd{
+		newReportTestCmd("a", 1, "finished", 1000, 1010),
+		newReportTestCmd("b", 1, "started_execution", 1000, 0),
+	})
+	assert.Equal(t, REPORT_VERDICT_RUNNING, running.Verdict)
+	assert.Equal(t, int64(0), running.Batches[0].EndTime)
+
+	failed := newConsensusRequestReport(cr, nil, []*Cmd{
+		newReportTestCmd("a", 1, "finished", 1000, 1010),
+		newReportTestCmd("b", 1, "failed_validation", 1000, 1010),
+	})
+	assert.Equal(t, REPORT_VERDICT_FAILED, failed.Verdict)
+
+	missing := newConsensusRequestReport(cr, nil, []*Cmd{
+		newReportTestCmd("a", 1, "finished", 1000, 1010),
+	})
+	assert.Equal(t, REPORT_VERDICT_FAILED, missing.Verdict)
+	assert.Equal(t, "not_dispatched", missing.Hosts[0].State)
+}
+
+func TestConsensusReportSkipped(t *testing.T) {
+	cr := newConsensusRequest()
+	cr.ClientIds = []string{"a", "b"}
+	cr.Executed = true
+	cr.SkippedClients = map[string]string{"b": "Client is missing tag web"}
+
+	report := newConsensusRequestReport(cr, nil, []*Cmd{
+		newReportTestCmd("a", 1, "finished", 1000, 1010),
+	})
+	// Left out on purpose, every host that ran succeeded
+	assert.Equal(t, REPORT_VERDICT_SUCCESS, report.Verdict)
+	assert.Len(t, report.Hosts, 1)
+	assert.Len(t, report.Skipped, 1)
+	skipped := report.Skipped[0]
+	assert.Equal(t, "b", skipped.ClientId)
+	assert.Equal(t, "skipped", skipped.State)
+	assert.Equal(t, "Client is missing tag web", skipped.Reason)
+
+	b, err := report.ToCsv()
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), ",skipped,")
+	assert.Contains(t, string(b), "Client is missing tag web")
+}
+
+func TestConsensusReportCsv(t *testing.T) {
+	cr := newConsensusRequest()
+	cr.ClientIds = []string{"a"}
+	cr.Executed = true
+
+	cmd := newReportTestCmd("a", 1, "failed_validation", 1000, 1010)
+	cmd.ExitCode = 3
+	cmd.ValidationResults = []*ExecutionValidationResult{&ExecutionValidationResult{Text: "OK", Passed: false}}
+
+	b, err := newConsensusRequestReport(cr, nil, []*Cmd{cmd}).ToCsv()
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "request,template,verdict,client"))
+	assert.Contains(t, lines[1], ",a,")
+	assert.Contains(t, lines[1], ",3,")
+	assert.Contains(t, lines[1], "failed: OK")
+}
+
+func TestConsensusReportStoredHostResults(t *testing.T) {
+	cr := newConsensusRequest()
+	cr.ClientIds = []string{"a", "b"}
+	cr.Executed = true
+	cr.recordHostResults([]*Cmd{
+		newReportTestCmd("b", 2, "finished", 1020, 1050),
+		newReportTestCmd("a", 1, "finished", 1000, 1010),
+	})
+
+	// Commands are gone after a restart, the stored results remain
+	report := newConsensusRequestReport(cr, nil, []*Cmd{})
+	assert.Equal(t, REPORT_VERDICT_SUCCESS, report.Verdict)
+	assert.Len(t, report.Hosts, 2)
+	assert.Equal(t, "a", report.Hosts[0].ClientId)
+	assert.Equal(t, "finished", report.Hosts[1].State)
+	assert.Len(t, report.Batches, 2)
+	assert.Equal(t, int64(1020), report.Batches[1].StartTime)
+	assert.Equal(t, int64(1050), report.Batches[1].EndTime)
+}
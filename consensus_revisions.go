@@ -0,0 +1,247 @@
+package main
+
+// Amending pending requests, every revision is kept so approvers can see what changed
+// @author Robin Verlangen
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ConsensusRevision struct {
+	Revision         int
+	TemplateId       string
+	ClientIds        []string
+	Reason           string
+	UserId           string   // Author of the revision
+	Time             int64    // Unix TS of the revision
+	Changes          []string // Human readable differences with the previous revision
+	ApprovalsCleared bool     // Votes on the previous revision were dropped
+}
+
+// Differences between two revisions and whether approvals remain valid, only narrowing the targets keeps them
+func compareRevisions(prev *ConsensusRevision, next *ConsensusRevision) ([]string, bool) {
+	changes := make([]string, 0)
+	keepApprovals := true
+	if prev.TemplateId != next.TemplateId {
+		changes = append(changes, fmt.Sprintf("Template changed from %s to %s", prev.TemplateId, next.TemplateId))
+		keepApprovals = false
+	}
+	if prev.Reason != next.Reason {
+		changes = append(changes, fmt.Sprintf("Reason changed from \"%s\" to \"%s\"", prev.Reason, next.Reason))
+		keepApprovals = false
+	}
+
+	prevClients := make(map[string]bool)
+	for _, clientId := range prev.ClientIds {
+		prevClients[clientId] = true
+	}
+	nextClients := make(map[string]bool)
+	added := make([]string, 0)
+	for _, clientId := range next.ClientIds {
+		nextClients[clientId] = true
+		if !prevClients[clientId] {
+			added = append(added, clientId)
+		}
+	}
+	removed := make([]string, 0)
+	for _, clientId := range prev.ClientIds {
+		if !nextClients[clientId] {
+			removed = append(removed, clientId)
+		}
+	}
+	if len(added) > 0 {
+		changes = append(changes, fmt.Sprintf("Added clients %s", strings.Join(added, ", ")))
+		keepApprovals = false
+	}
+	if len(removed) > 0 {
+		changes = append(changes, fmt.Sprintf("Removed clients %s", strings.Join(removed, ", ")))
+	}
+	return changes, keepApprovals
+}
+
+// Snapshot of what is currently requested
+func (c *ConsensusRequest) currentRevision() *ConsensusRevision {
+	if len(c.Revisions) > 0 {
+		return c.Revisions[len(c.Revisions)-1]
+	}
+	return &ConsensusRevision{
+		Revision:   1,
+		TemplateId: c.TemplateId,
+		ClientIds:  c.ClientIds,
+		Reason:     c.Reason,
+		UserId:     c.RequestUserId,
+		Time:       c.CreateTime,
+		Changes:    make([]string, 0),
+	}
+}
+
+// Change a pending request, returns whether the approvals were cleared
+func (c *ConsensusRequest) Amend(user *User, templateId string, clientIds []string, reason string) (bool, error) {
+	if c.RequestUserId != user.Id {
+		return false, errors.New("Only the requester can amend a request")
+	}
+	if len(clientIds) == 0 {
+		return false, errors.New("Please provide at least one client")
+	}
+	if len(c.TargetExpression) > 0 {
+		return false, errors.New("Requests that target a tag expression can not be amended, cancel and request again")
+	}
+
+	// The approval of these is bound to what they were created for
+	if len(c.ApprovesScheduleId) > 0 {
+		return false, errors.New("Standing approvals of a schedule can not be amended, change the schedule instead")
+	}
+	if c.BreakGlass != nil {
+		return false, errors.New("Break-glass requests can not be amended")
+	}
+	if len(c.RollbackOfRequestId) > 0 {
+		return false, errors.New("Rollback requests can not be amended")
+	}
+
+	current := server.templateStore.Get(templateId)
+	if current == nil {
+		return false, errors.New("Template not found")
+	}
+	if err := current.DisabledError(); err != nil {
+		return false, err
+	}
+	templateVersion := c.TemplateVersion
+	if templateId != c.TemplateId {
+		if current.Acl != nil && !current.Acl.CanRequest(user) {
+			return false, errors.New("User is not allowed to request this template")
+		}
+		templateVersion = current.Version
+	}
+	template := server.templateVersionStore.Resolve(templateId, templateVersion)
+	if template == nil {
+		return false, errors.New("Template not found")
+	}
+	targetLimitExceeded, targetsE := checkTemplateTargets(template, clientIds)
+	if targetsE != nil {
+		return false, targetsE
+	}
+
+	c.executeMux.Lock()
+	if c.Executed || !c.IsPending() {
+		c.executeMux.Unlock()
+		return false, errors.New("Only pending requests can be amended")
+	}
+	prev := c.currentRevision()
+	next := &ConsensusRevision{
+		Revision:   prev.Revision + 1,
+		TemplateId: templateId,
+		ClientIds:  clientIds,
+		Reason:     reason,
+		UserId:     user.Id,
+		Time:       time.Now().Unix(),
+	}
+	changes, keepApprovals := compareRevisions(prev, next)
+	if len(changes) == 0 {
+		c.executeMux.Unlock()
+		return false, errors.New("Nothing changed")
+	}
+	next.Changes = changes
+	next.ApprovalsCleared = !keepApprovals && (len(c.ApproveUserIds) > 0 || len(c.Rejections) > 0)
+
+	if len(c.Revisions) == 0 {
+		c.Revisions = append(c.Revisions, prev)
+	}
+	c.Revisions = append(c.Revisions, next)
+	c.TemplateId = templateId
+	c.TemplateVersion = templateVersion
+	c.ClientIds = clientIds
+	c.TargetLimitExceeded = targetLimitExceeded
+	c.Reason = reason
+	if !keepApprovals {
+		c.ApproveUserIds = make(map[string]bool)
+		c.ApproveTimes = make(map[string]int64)
+		c.Rejections = make(map[string]*ConsensusRejection)
+	}
+	c.addHistory(user, fmt.Sprintf("Amended to revision %d: %s", next.Revision, strings.Join(changes, "; ")))
+	c.executeMux.Unlock()
+
+	audit.Log(user, "Consensus", fmt.Sprintf("Amend %s to revision %d: %s", c.Id, next.Revision, strings.Join(changes, "; ")))
+
+	// Approvers have to look again
+	if !keepApprovals {
+		server.notifier.Notify(c.approverIds(), "Request amended", fmt.Sprintf("%s amended request %s, please review it again: %s", user.Username, c.Id, strings.Join(changes, "; ")))
+	}
+	return next.ApprovalsCleared, nil
+}
+
+// Users that are eligible to vote on the request
+func (c *ConsensusRequest) approverIds() []string {
+	ids := make([]string, 0)
+	for _, userId := range server.userStore.IdsWithRole("approver") {
+		if userId == c.RequestUserId {
+			continue
+		}
+		if usr := server.userStore.ById(userId); usr != nil && c.CanVote(usr) {
+			ids = append(ids, userId)
+		}
+	}
+	return ids
+}
+
+// Amend execution request
+func PutConsensusRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PutConsensusRequest")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	user := getUser(r)
+	if !user.HasRole("requester") {
+		jr.Error("User not allowed to PutConsensusRequest")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Same two factor requirement as for the original request
+	if res, _ := user.ValidateTotp(r.PostFormValue("totp")); res == false {
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	id := strings.TrimSpace(r.PostFormValue("id"))
+	cr := server.consensus.Get(id)
+	if cr == nil {
+		jr.Error("Request not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Reason
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if len(reason) < 4 {
+		jr.Error("Please provide a valid reason")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	templateId := strings.TrimSpace(r.PostFormValue("template"))
+	clientIds := splitCommaList(r.PostFormValue("clients"))
+
+	cleared, err := cr.Amend(user, templateId, clientIds, reason)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	cr.check() // Narrowing may have been all that was needed
+	server.consensus.save()
+
+	jr.Set("approvals_cleared", cleared)
+	jr.Set("revision", cr.currentRevision())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
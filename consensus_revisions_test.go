@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompareRevisions(t *testing.T) {
+	prev := &ConsensusRevision{TemplateId: "t1", ClientIds: []string{"a", "b", "c"}, Reason: "deploy"}
+
+	// Narrowing keeps approvals
+	changes, keep := compareRevisions(prev, &ConsensusRevision{TemplateId: "t1", ClientIds: []string{"a", "c"}, Reason: "deploy"})
+	assert.True(t, keep)
+	assert.Equal(t, []string{"Removed clients b"}, changes)
+
+	// Widening clears them
+	changes, keep = compareRevisions(prev, &ConsensusRevision{TemplateId: "t1", ClientIds: []string{"a", "d"}, Reason: "deploy"})
+	assert.False(t, keep)
+	assert.Equal(t, []string{"Added clients d", "Removed clients b, c"}, changes)
+
+	// Different template or reason clears them
+	_, keep = compareRevisions(prev, &ConsensusRevision{TemplateId: "t2", ClientIds: []string{"a"}, Reason: "deploy"})
+	assert.False(t, keep)
+	_, keep = compareRevisions(prev, &ConsensusRevision{TemplateId: "t1", ClientIds: []string{"a"}, Reason: "redeploy"})
+	assert.False(t, keep)
+
+	// Nothing changed
+	changes, keep = compareRevisions(prev, &ConsensusRevision{TemplateId: "t1", ClientIds: []string{"c", "b", "a"}, Reason: "deploy"})
+	assert.True(t, keep)
+	assert.Len(t, changes, 0)
+}
+
+func TestConsensusCurrentRevision(t *testing.T) {
+	cr := newConsensusRequest()
+	cr.TemplateId = "t1"
+	cr.ClientIds = []string{"a"}
+	rev := cr.currentRevision()
+	assert.Equal(t, 1, rev.Revision)
+	assert.Equal(t, "t1", rev.TemplateId)
+}
+
+func TestAmendRejectsBoundRequests(t *testing.T) {
+	user := &User{Id: "u1"}
+	amend := func(cr *ConsensusRequest) error {
+		cr.RequestUserId = user.Id
+		_, err := cr.Amend(user, "t1", []string{"a"}, "deploy")
+		return err
+	}
+
+	cr := newConsensusRequest()
+	cr.ApprovesScheduleId = "s1"
+	assert.Contains(t, amend(cr).Error(), "Standing approvals")
+
+	cr = newConsensusRequest()
+	cr.BreakGlass = &ConsensusBreakGlass{UserId: user.Id}
+	assert.Contains(t, amend(cr).Error(), "Break-glass")
+
+	cr = newConsensusRequest()
+	cr.RollbackOfRequestId = "r1"
+	assert.Contains(t, amend(cr).Error(), "Rollback")
+}
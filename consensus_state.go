@@ -0,0 +1,163 @@
+package main
+
+// Lifecycle of a consensus request, every transition is kept with its time and actor
+// @author Robin Verlangen
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	CONSENSUS_STATE_PENDING   = "pending"   // Waiting for approvals
+	CONSENSUS_STATE_APPROVED  = "approved"  // Approvals met, waiting to start (e.g. for a maintenance window)
+	CONSENSUS_STATE_RUNNING   = "running"   // Commands are being executed
+	CONSENSUS_STATE_SUCCEEDED = "succeeded" // All hosts finished
+	CONSENSUS_STATE_FAILED    = "failed"    // Execution failed or was blocked
+	CONSENSUS_STATE_CANCELLED = "cancelled" // Cancelled by the requester or an admin
+	CONSENSUS_STATE_EXPIRED   = "expired"   // Not approved before the deadline
+	CONSENSUS_STATE_REJECTED  = "rejected"  // Rejected by enough approvers or vetoed
+
+	DEFAULT_CONSENSUS_RETENTION_DAYS = 14
+)
+
+type ConsensusStateTransition struct {
+	State   string
+	Time    int64  // Unix TS of the transition
+	UserId  string // Actor, empty for the system
+	Message string
+}
+
+// Move to a new state
+func (c *ConsensusRequest) setState(state string, user *User, msg string) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	t := &ConsensusStateTransition{
+		State:   state,
+		Time:    time.Now().Unix(),
+		Message: msg,
+	}
+	if user != nil {
+		t.UserId = user.Id
+	}
+	c.State = state
+	c.StateHistory = append(c.StateHistory, t)
+}
+
+// Record an event in the history without changing the state
+func (c *ConsensusRequest) addHistory(user *User, msg string) {
+	c.setState(c.State, user, msg)
+}
+
+// Is the request in a state it will never leave?
+func (c *ConsensusRequest) IsFinal() bool {
+	switch c.State {
+	case CONSENSUS_STATE_SUCCEEDED, CONSENSUS_STATE_FAILED, CONSENSUS_STATE_CANCELLED, CONSENSUS_STATE_EXPIRED, CONSENSUS_STATE_REJECTED:
+		return true
+	}
+	return false
+}
+
+// Does it still wait for approvals?
+func (c *ConsensusRequest) IsPending() bool {
+	return c.State == CONSENSUS_STATE_PENDING || len(c.State) == 0
+}
+
+// Unix TS of the last transition
+func (c *ConsensusRequest) StateTime() int64 {
+	if len(c.StateHistory) > 0 {
+		return c.StateHistory[len(c.StateHistory)-1].Time
+	}
+	return c.CreateTime
+}
+
+// Unix TS after which an unapproved request expires, 0 if it never does
+func (c *ConsensusRequest) ApprovalDeadline(template *Template, defaultDays int) int64 {
+	hours := defaultDays * 24
+	if template != nil && template.Acl != nil && template.Acl.ApprovalDeadline > 0 {
+		hours = template.Acl.ApprovalDeadline
+	}
+	if hours < 1 {
+		return 0
+	}
+	return c.CreateTime + int64(hours)*3600
+}
+
+// Finished requests are kept for the retention period
+func (c *ConsensusRequest) isRetained(now int64, retentionDays int) bool {
+	if !c.IsFinal() || c.NeedsBreakGlassReview() {
+		return true
+	}
+	if retentionDays < 1 {
+		retentionDays = DEFAULT_CONSENSUS_RETENTION_DAYS
+	}
+	return c.StateTime() >= now-int64(retentionDays)*86400
+}
+
+// Requests stored before the lifecycle only know whether they were executed
+func (c *ConsensusRequest) migrateState() {
+	if len(c.State) > 0 {
+		return
+	}
+	t := &ConsensusStateTransition{
+		Time:    c.CreateTime,
+		Message: "Migrated",
+	}
+	switch {
+	case !c.Executed:
+		t.State = CONSENSUS_STATE_PENDING
+	case len(c.HaltReason) > 0:
+		t.State = CONSENSUS_STATE_FAILED
+	default:
+		t.State = CONSENSUS_STATE_SUCCEEDED
+	}
+	if c.Executed && c.CompleteTime > 0 {
+		t.Time = c.CompleteTime
+	}
+	c.State = t.State
+	c.StateHistory = append(c.StateHistory, t)
+}
+
+// No longer wait for approvals and tell the requester
+func (c *ConsensusRequest) Expire() bool {
+	c.executeMux.Lock()
+	if c.Executed || !c.IsPending() {
+		c.executeMux.Unlock()
+		return false
+	}
+	c.setState(CONSENSUS_STATE_EXPIRED, nil, "Not approved before the deadline")
+	c.executeMux.Unlock()
+	c.executeCallbacks()
+
+	audit.Log(nil, "Consensus", fmt.Sprintf("Expired %s", c.Id))
+	title := c.TemplateId
+	if template := c.Template(); template != nil {
+		title = template.Title
+	}
+	server.notifier.Notify([]string{c.RequestUserId}, "Request expired", fmt.Sprintf("Your request %s to execute %s expired before it received enough approvals. Reason: %s", c.Id, title, c.Reason))
+	return true
+}
+
+// Expire all requests past their approval deadline
+func (c *Consensus) ExpirePending(now int64) {
+	expired := make([]*ConsensusRequest, 0)
+	c.pendingMux.RLock()
+	for _, cr := range c.Pending {
+		if cr.Executed || !cr.IsPending() {
+			continue
+		}
+		deadline := cr.ApprovalDeadline(cr.Template(), conf.ConsensusPendingExpiryDays)
+		if deadline > 0 && now >= deadline {
+			expired = append(expired, cr)
+		}
+	}
+	c.pendingMux.RUnlock()
+	if len(expired) == 0 {
+		return
+	}
+
+	for _, cr := range expired {
+		cr.Expire()
+	}
+	c.save()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConsensusStateTransitions(t *testing.T) {
+	cr := newConsensusRequest()
+	assert.True(t, cr.IsPending())
+
+	user := newUser()
+	cr.setState(CONSENSUS_STATE_PENDING, user, "reason")
+	cr.setState(CONSENSUS_STATE_APPROVED, nil, "")
+	cr.setState(CONSENSUS_STATE_RUNNING, nil, "")
+	assert.False(t, cr.IsFinal())
+	cr.setState(CONSENSUS_STATE_SUCCEEDED, nil, "")
+	assert.True(t, cr.IsFinal())
+	assert.False(t, cr.IsPending())
+
+	assert.Len(t, cr.StateHistory, 4)
+	assert.Equal(t, user.Id, cr.StateHistory[0].UserId)
+	assert.Equal(t, "", cr.StateHistory[1].UserId)
+	assert.Equal(t, CONSENSUS_STATE_SUCCEEDED, cr.State)
+}
+
+func TestConsensusApprovalDeadline(t *testing.T) {
+	cr := newConsensusRequest()
+	cr.CreateTime = 1000
+
+	assert.Equal(t, int64(1000+2*86400), cr.ApprovalDeadline(nil, 2))
+	assert.Equal(t, int64(0), cr.ApprovalDeadline(nil, 0))
+
+	template := newTemplate("title", "description", "echo", true, []string{}, []string{}, 2, 10, nil)
+	template.Acl.ApprovalDeadline = 4
+	assert.Equal(t, int64(1000+4*3600), cr.ApprovalDeadline(template, 2))
+}
+
+func TestConsensusRetention(t *testing.T) {
+	now := int64(100 * 86400)
+
+	// Pending requests are never dropped
+	cr := newConsensusRequest()
+	cr.CreateTime = 0
+	assert.True(t, cr.isRetained(now, 7))
+
+	cr.setState(CONSENSUS_STATE_SUCCEEDED, nil, "")
+	cr.StateHistory[0].Time = now - 8*86400
+	assert.False(t, cr.isRetained(now, 7))
+	assert.True(t, cr.isRetained(now, 30))
+}
+
+func TestConsensusMigrateState(t *testing.T) {
+	pending := newConsensusRequest()
+	pending.migrateState()
+	assert.Equal(t, CONSENSUS_STATE_PENDING, pending.State)
+
+	succeeded := newConsensusRequest()
+	succeeded.Executed = true
+	succeeded.CompleteTime = 2000
+	succeeded.migrateState()
+	assert.Equal(t, CONSENSUS_STATE_SUCCEEDED, succeeded.State)
+	assert.Equal(t, int64(2000), succeeded.StateTime())
+
+	failed := newConsensusRequest()
+	failed.Executed = true
+	failed.HaltReason = "Cmd failed"
+	failed.migrateState()
+	assert.Equal(t, CONSENSUS_STATE_FAILED, failed.State)
+
+	// Only once
+	failed.migrateState()
+	assert.Len(t, failed.StateHistory, 1)
+}
+
+func TestTemplateAclRejection(t *testing.T) {
+	acl := newTemplateAcl()
+	user := newUser()
+
+	// A single rejection by default
+	rejected, required := acl.IsRejected(user, 1)
+	assert.True(t, rejected)
+	assert.Equal(t, uint(1), required)
+
+	acl.MinReject = 2
+	rejected, _ = acl.IsRejected(user, 1)
+	assert.False(t, rejected)
+	rejected, _ = acl.IsRejected(user, 2)
+	assert.True(t, rejected)
+
+	// Veto
+	acl.VetoRoles = []string{"security"}
+	user.AddRole("security")
+	rejected, _ = acl.IsRejected(user, 1)
+	assert.True(t, rejected)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newRollbackTestServer(withRollbackTemplate bool) *Server {
+	templates := map[string]*Template{
+		"change": {Id: "change", Title: "Change", Command: "deploy", RollbackTemplateId: "undo"},
+	}
+	if withRollbackTemplate {
+		templates["undo"] = &Template{Id: "undo", Title: "Undo", Command: "undeploy"}
+	}
+	started := &Cmd{Id: "c1", ClientId: "a", ConsensusRequestId: "req", Started: 1000, State: "failed"}
+	notStarted := &Cmd{Id: "c2", ClientId: "b", ConsensusRequestId: "req", State: "pending"}
+	other := &Cmd{Id: "c3", ClientId: "c", ConsensusRequestId: "other", Started: 1000, State: "finished"}
+	return &Server{
+		templateStore:        &TemplateStore{Templates: templates},
+		templateVersionStore: &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)},
+		clients: map[string]*RegisteredClient{
+			"a": {ClientId: "a", DispatchedCmds: map[string]*Cmd{"c1": started}},
+			"b": {ClientId: "b", DispatchedCmds: map[string]*Cmd{"c2": notStarted}},
+			"c": {ClientId: "c", DispatchedCmds: map[string]*Cmd{"c3": other}},
+		},
+	}
+}
+
+func newRollbackTestRequest() *ConsensusRequest {
+	cr := newConsensusRequest()
+	cr.Id = "req"
+	cr.TemplateId = "change"
+	cr.ClientIds = []string{"a", "b"}
+	cr.RequestUserId = "requester"
+	cr.Reason = "Deploy release"
+	cr.ApproveUserIds["approver"] = true
+	cr.ApproveTimes["approver"] = 500
+	return cr
+}
+
+func TestRollbackRequest(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = newRollbackTestServer(true)
+
+	rollback := newRollbackTestRequest().newRollbackRequest()
+	assert.NotNil(t, rollback)
+	assert.Equal(t, "undo", rollback.TemplateId)
+	assert.Equal(t, "req", rollback.RollbackOfRequestId)
+	assert.Equal(t, "requester", rollback.RequestUserId)
+
+	// Only the hosts that started the change
+	assert.Equal(t, []string{"a"}, rollback.ClientIds)
+
+	// Under the approvals of the original
+	assert.True(t, rollback.ApproveUserIds["approver"])
+	assert.Equal(t, int64(500), rollback.ApproveTimes["approver"])
+	assert.Equal(t, CONSENSUS_STATE_APPROVED, rollback.State)
+}
+
+func TestRollbackRequestNotPossible(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = newRollbackTestServer(true)
+
+	// Never a rollback of a rollback
+	rollback := newRollbackTestRequest().newRollbackRequest()
+	rollback.Id = "req"
+	server.templateStore.Templates["undo"].RollbackTemplateId = "change"
+	assert.Nil(t, rollback.newRollbackRequest())
+
+	// Only rolled back once
+	cr := newRollbackTestRequest()
+	cr.RollbackRequestId = "earlier"
+	assert.Nil(t, cr.newRollbackRequest())
+
+	// Rollback template removed
+	server = newRollbackTestServer(false)
+	assert.Nil(t, newRollbackTestRequest().newRollbackRequest())
+}
+
+func waitForCallback(done chan *ConsensusRequest, timeout time.Duration) *ConsensusRequest {
+	select {
+	case cr := <-done:
+		return cr
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestCallbacksOnHalt(t *testing.T) {
+	prevServer, prevConf := server, conf
+	defer func() { server, conf = prevServer, prevConf }()
+	conf = &Conf{}
+	dir, _ := ioutil.TempDir("", "indispenso")
+	defer os.RemoveAll(dir)
+
+	cr := newConsensusRequest()
+	cr.TemplateId = "deploy"
+	cr.ClientIds = []string{"a", "b"}
+	cr.Executed = true
+	cr.setState(CONSENSUS_STATE_RUNNING, nil, "")
+	done := make(chan *ConsensusRequest, 2)
+	cr.Callbacks = append(cr.Callbacks, func(cr *ConsensusRequest) {
+		done <- cr
+	})
+
+	server = &Server{
+		templateStore:        &TemplateStore{Templates: map[string]*Template{"deploy": {Id: "deploy", Title: "Deploy", Command: "deploy"}}},
+		templateVersionStore: &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)},
+		consensus:            &Consensus{Pending: map[string]*ConsensusRequest{cr.Id: cr}, ConfFile: filepath.Join(dir, "consensus.json")},
+		clients: map[string]*RegisteredClient{
+			"a": {ClientId: "a", DispatchedCmds: map[string]*Cmd{
+				"c1": {Id: "c1", ClientId: "a", ConsensusRequestId: cr.Id, ExecutionIterationId: 1, State: "failed"},
+			}},
+			"b": {ClientId: "b", DispatchedCmds: make(map[string]*Cmd), Cmds: make(map[string]*Cmd)},
+		},
+	}
+
+	// The first batch failed, the second is never started
+	ece := newExecutionCoordinatorEntry()
+	ece.Id = cr.Id
+	ece.strategy = &ExecutionStrategy{Strategy: RollingExecutionStrategy}
+	ece.iteration = 1
+	ece.cmds = []*PendingClientCmd{{Client: server.clients["b"], Cmd: &Cmd{Id: "c2", ClientId: "b", ConsensusRequestId: cr.Id}}}
+	ece.Halt("Command c1 failed")
+
+	res := waitForCallback(done, 5*time.Second)
+	assert.NotNil(t, res)
+	assert.Equal(t, CONSENSUS_STATE_FAILED, cr.State)
+	assert.True(t, cr.CompleteTime > 0)
+
+	// Only once
+	cr.executeCallbacks()
+	assert.Nil(t, waitForCallback(done, 100*time.Millisecond))
+}
+
+func TestCallbacksOnFailedStart(t *testing.T) {
+	cr := newConsensusRequest()
+	done := make(chan *ConsensusRequest, 1)
+	cr.Callbacks = append(cr.Callbacks, func(cr *ConsensusRequest) {
+		done <- cr
+	})
+	cr.failStart(errors.New("Template not found"))
+	assert.NotNil(t, waitForCallback(done, 5*time.Second))
+	assert.Equal(t, CONSENSUS_STATE_FAILED, cr.State)
+}
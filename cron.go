@@ -0,0 +1,161 @@
+package main
+
+// Minimal cron expression support: minute hour day-of-month month day-of-week
+// Fields accept *, lists (1,2), ranges (1-5) and steps (*/15, 1-30/5)
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CronSchedule struct {
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	domStar  bool // Day of month not restricted
+	dowStar  bool // Day of week not restricted
+	location *time.Location
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse an expression, times are evaluated in the given location
+func parseCron(expr string, location *time.Location) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if shortcut, ok := cronShortcuts[expr]; ok {
+		expr = shortcut
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Cron expression must have 5 fields, got %d", len(fields))
+	}
+	if location == nil {
+		location = time.Local
+	}
+
+	c := &CronSchedule{
+		domStar:  fields[2] == "*",
+		dowStar:  fields[4] == "*",
+		location: location,
+	}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("Invalid minute: %s", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("Invalid hour: %s", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("Invalid day of month: %s", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("Invalid month: %s", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("Invalid day of week: %s", err)
+	}
+
+	// Sunday is both 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// Bit set of the allowed values of a field
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		// Step
+		step := 1
+		if pos := strings.Index(part, "/"); pos >= 0 {
+			s, err := strconv.Atoi(part[pos+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("invalid step in %s", part)
+			}
+			step = s
+			part = part[:pos]
+		}
+
+		// Range
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %s", bounds[0])
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %s", bounds[1])
+				}
+			} else if step > 1 {
+				// 5/10 means from 5 up to the max
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%s out of range %d-%d", part, min, max)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// Does the minute of this time match?
+func (c *CronSchedule) Matches(t time.Time) bool {
+	t = t.In(c.location)
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	return c.matchesDay(t)
+}
+
+// First matching minute after the given time, zero time if there is none within five years
+func (c *CronSchedule) Next(after time.Time) time.Time {
+	t := after.In(c.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		// Skip whole days that can not match
+		if c.month&(1<<uint(t.Month())) == 0 || !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+			continue
+		}
+		// Skip whole hours that can not match
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.location)
+			continue
+		}
+		if c.Matches(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// Like cron, if both day fields are restricted either one may match
+func (c *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if !c.domStar && !c.dowStar {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
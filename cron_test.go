@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCronParseInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		_, err := parseCron(expr, time.UTC)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	c, err := parseCron("*/15 2-4 * * 1-5", time.UTC)
+	assert.NoError(t, err)
+
+	// Monday
+	assert.True(t, c.Matches(time.Date(2016, 2, 1, 2, 0, 0, 0, time.UTC)))
+	assert.True(t, c.Matches(time.Date(2016, 2, 1, 4, 45, 30, 0, time.UTC)))
+	assert.False(t, c.Matches(time.Date(2016, 2, 1, 4, 46, 0, 0, time.UTC)))
+	assert.False(t, c.Matches(time.Date(2016, 2, 1, 5, 0, 0, 0, time.UTC)))
+
+	// Sunday
+	assert.False(t, c.Matches(time.Date(2016, 1, 31, 2, 0, 0, 0, time.UTC)))
+}
+
+func TestCronSundayAsSeven(t *testing.T) {
+	c, err := parseCron("0 0 * * 7", time.UTC)
+	assert.NoError(t, err)
+	assert.True(t, c.Matches(time.Date(2016, 1, 31, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestCronDayOfMonthOrWeek(t *testing.T) {
+	// The 13th or any friday
+	c, err := parseCron("0 0 13 * 5", time.UTC)
+	assert.NoError(t, err)
+	assert.True(t, c.Matches(time.Date(2016, 1, 13, 0, 0, 0, 0, time.UTC)))
+	assert.True(t, c.Matches(time.Date(2016, 1, 15, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, c.Matches(time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestCronNext(t *testing.T) {
+	c, err := parseCron("@daily", time.UTC)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC), c.Next(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	c, err = parseCron("30 3 29 2 *", time.UTC)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2016, 2, 29, 3, 30, 0, 0, time.UTC), c.Next(time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestCronTimeZone(t *testing.T) {
+	loc := time.FixedZone("IST", 5*3600+1800)
+	c, err := parseCron("0 11 * * *", loc)
+	assert.NoError(t, err)
+
+	next := c.Next(time.Date(2016, 1, 1, 5, 0, 0, 0, time.UTC)) // 10:30 local
+	assert.Equal(t, time.Date(2016, 1, 1, 5, 30, 0, 0, time.UTC), next.UTC())
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"math"
 	"sync"
+	"time"
 )
 
 // This will coordinate the execution of strategies
@@ -17,7 +19,11 @@ type ExecutionCoordinatorEntry struct {
 	Id        string // Consensus request id
 	cmds      []*PendingClientCmd
 	strategy  *ExecutionStrategy
-	iteration int // starts at 0, first started iteration will update this to 1
+	iteration int  // starts at 0, first started iteration will update this to 1
+	halted    bool // a command failed, no new work will be started
+	completed bool // all work is done and completion has been handled
+	probing   bool // a health probe is running for the last batch
+	probed    int  // last iteration that passed the health probe
 	mux       sync.RWMutex
 }
 
@@ -29,9 +35,41 @@ type PendingClientCmd struct {
 // Execute the callbacks if the entire list of commands is
 func (ece *ExecutionCoordinatorEntry) ExecuteCallbacks() {
 	cr := server.consensus.Get(ece.Id)
-	for _, cb := range cr.Callbacks {
-		go cb(cr)
+	if cr == nil {
+		return
 	}
+	cr.CompleteTime = time.Now().Unix()
+	cr.executeCallbacks()
+}
+
+// Register the outcome once all work is done
+func (ece *ExecutionCoordinatorEntry) complete(halted bool) {
+	cr := server.consensus.Get(ece.Id)
+	if cr == nil {
+		return
+	}
+	cr.recordHostResults(server.GetRequestCmds(cr.Id))
+	if halted {
+		if cr.State != CONSENSUS_STATE_CANCELLED {
+			cr.setState(CONSENSUS_STATE_FAILED, nil, cr.HaltReason)
+
+			// Undo the change where configured
+			cr.rollback()
+		}
+		ece.ExecuteCallbacks()
+		server.consensus.save()
+		return
+	}
+
+	if newConsensusRequestReport(cr, nil, server.GetRequestCmds(cr.Id)).Verdict == REPORT_VERDICT_FAILED {
+		cr.setState(CONSENSUS_STATE_FAILED, nil, "Not all hosts finished")
+	} else {
+		cr.setState(CONSENSUS_STATE_SUCCEEDED, nil, "")
+	}
+
+	// All is done, execute the callbacks
+	ece.ExecuteCallbacks()
+	server.consensus.save()
 }
 
 // Called after a command has finished, see if there is more work to start
@@ -51,6 +89,7 @@ func (ece *ExecutionCoordinatorEntry) Next() {
 	}
 
 	// Iterate
+	batchClientIds := make([]string, 0)
 	server.clientsMux.RLock()
 outer:
 	for _, client := range server.clients {
@@ -61,10 +100,11 @@ outer:
 				if conf.Debug {
 					log.Printf("%s was started in the previous iteration %v", cmd.Id, cmd)
 				}
-				if cmd.State != "finished" {
+				if !cmd.IsFinal() {
 					allFinished = false
 					break outer
 				}
+				batchClientIds = append(batchClientIds, cmd.ClientId)
 			}
 		}
 	}
@@ -72,9 +112,9 @@ outer:
 
 	// Done? Do we have any work left?
 	if len(ece.cmds) == 0 {
-		if allFinished {
-			// All is done, execute the callbacks
-			ece.ExecuteCallbacks()
+		if allFinished && !ece.completed {
+			ece.completed = true
+			go ece.complete(ece.halted)
 		}
 		if conf.Debug {
 			log.Printf("No additional work to start for consensus request %s", ece.Id)
@@ -90,6 +130,21 @@ outer:
 		return
 	}
 
+	// Is the service healthy after the previous batch?
+	if ece.iteration > 0 && ece.probed < ece.iteration {
+		cr := server.consensus.Get(ece.Id)
+		if cr != nil {
+			template := cr.Template()
+			if template != nil && template.HealthProbe != nil {
+				if !ece.probing {
+					ece.probing = true
+					go ece.probe(cr, template.HealthProbe, ece.iteration, batchClientIds)
+				}
+				return
+			}
+		}
+	}
+
 	// How many will we start?
 	var cmdsToStart = 0
 	switch ece.strategy.Strategy {
@@ -126,6 +181,10 @@ outer:
 		panic("Not yet supported")
 	}
 
+	// Increment iteration counter, commands of this batch are tagged with the new value
+	ece.iteration++
+	iteration := ece.iteration
+
 	// Start command(s)
 	if conf.Debug {
 		log.Printf("Starting %d cmds for consensus request %s", cmdsToStart, ece.Id)
@@ -139,16 +198,60 @@ outer:
 			log.Printf("Starting cmd %s for consensus request %s", cmd.Cmd.Id, ece.Id)
 
 			c := *cmd.Cmd
-			c.ExecutionIterationId = ece.iteration
+			c.ExecutionIterationId = iteration
 			cmd.Client.Submit(&c)
 		}(cmd)
 
 		// Remove element
 		ece.cmds = ece.cmds[:len(ece.cmds)-1]
 	}
+}
 
-	// Increment iteration counter
-	ece.iteration++
+// Probe the hosts of the finished batch before continuing
+func (ece *ExecutionCoordinatorEntry) probe(cr *ConsensusRequest, probe *HealthProbe, iteration int, clientIds []string) {
+	cmds, err := probe.Check(cr, clientIds)
+
+	// Keep track of the outcome
+	result := &HealthProbeResult{
+		Iteration: iteration,
+		Time:      time.Now().Unix(),
+		Passed:    err == nil,
+		Hosts:     reportHosts(cmds),
+	}
+	if err != nil {
+		result.Message = err.Error()
+	}
+	cr.ProbeResults = append(cr.ProbeResults, result)
+
+	ece.mux.Lock()
+	ece.probing = false
+	if err == nil {
+		ece.probed = iteration
+	}
+	ece.mux.Unlock()
+
+	if err != nil {
+		ece.Halt(fmt.Sprintf("Health probe failed after batch %d: %s", iteration, err))
+		return
+	}
+	ece.Next()
+}
+
+// Stop starting new work, e.g. after a command failed
+func (ece *ExecutionCoordinatorEntry) Halt(reason string) {
+	ece.mux.Lock()
+	if !ece.halted {
+		log.Printf("Halting consensus request %s: %s", ece.Id, reason)
+		ece.halted = true
+		ece.cmds = make([]*PendingClientCmd, 0)
+		if cr := server.consensus.Get(ece.Id); cr != nil {
+			cr.HaltReason = reason
+		}
+	}
+	ece.mux.Unlock()
+
+	// Handle completion once the running commands are done
+	ece.Next()
 }
 
 func (e *ExecutionCoordinator) Get(consensusRequestId string) *ExecutionCoordinatorEntry {
@@ -3,6 +3,11 @@ package main
 // @author Robin Verlangen
 // The execution stratey of a command
 
+import (
+	"errors"
+	"fmt"
+)
+
 type ExecutionStrategyType int
 
 type ExecutionStrategy struct {
@@ -18,18 +23,22 @@ func (e *ExecutionStrategy) Execute(c *ConsensusRequest) bool {
 	var clientCmds []*PendingClientCmd = make([]*PendingClientCmd, 0)
 
 	// Assemble commands
+	c.SkippedClients = make(map[string]string)
 	for _, clientId := range c.ClientIds {
-		// Get client
+		// Get client, tags may have changed since the request
 		client := server.GetClient(clientId)
-		if client == nil {
-			log.Printf("Client %s not found for request %s", clientId, c.Id)
+		if reason := clientTargetError(client, template.Acl); len(reason) > 0 {
+			log.Printf("Skipping client %s for request %s: %s", clientId, c.Id, reason)
+			audit.Log(nil, "Consensus", fmt.Sprintf("Skipped client %s for request %s: %s", clientId, c.Id, reason))
+			c.SkippedClients[clientId] = reason
 			continue
 		}
 
 		// Create command instance
 		cmd := newCmd(template.Command, template.Timeout)
 		cmd.ConsensusRequestId = c.Id
-		cmd.TemplateId = c.Template().Id
+		cmd.TemplateId = template.Id
+		cmd.TemplateVersion = template.Version
 		cmd.ClientId = client.ClientId
 		cmd.RequestUserId = c.RequestUserId
 		cmd.Sign(client)
@@ -42,6 +51,13 @@ func (e *ExecutionStrategy) Execute(c *ConsensusRequest) bool {
 		clientCmds = append(clientCmds, clientCmd)
 	}
 
+	if len(c.SkippedClients) > 0 {
+		c.addHistory(nil, fmt.Sprintf("Skipped %d of %d clients", len(c.SkippedClients), len(c.ClientIds)))
+	}
+	if len(clientCmds) == 0 {
+		c.HaltReason = "None of the clients can be executed on"
+	}
+
 	// Register with execution coordinator
 	server.executionCoordinator.Add(c.Id, e, clientCmds)
 
@@ -58,6 +74,29 @@ const (
 	ExponentialRollingExecutionStrategy                              // 3
 )
 
+// Names as used in the template form and definitions
+var executionStrategyNames = map[ExecutionStrategyType]string{
+	SimpleExecutionStrategy:             "simple",
+	OneTestExecutionStrategy:            "one-test",
+	RollingExecutionStrategy:            "rolling",
+	ExponentialRollingExecutionStrategy: "exponential-rolling",
+}
+
+// Strategy by its name in the template form
+func parseExecutionStrategy(s string) (*ExecutionStrategy, error) {
+	for strategy, name := range executionStrategyNames {
+		if name == s {
+			return newExecutionStrategy(strategy), nil
+		}
+	}
+	return nil, errors.New("Strategy not found")
+}
+
+// Name of the strategy
+func (e *ExecutionStrategy) Name() string {
+	return executionStrategyNames[e.Strategy]
+}
+
 func newExecutionStrategy(strategy ExecutionStrategyType) *ExecutionStrategy {
 	return &ExecutionStrategy{
 		Strategy: strategy,
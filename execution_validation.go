@@ -1,39 +1,263 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/nu7hatch/gouuid"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 // Validates the execution of a process
 
+const (
+	VALIDATION_CONTAINS   = "contains"   // Substring of a line
+	VALIDATION_REGEX      = "regex"      // Regular expression on a line
+	VALIDATION_EXIT_CODE  = "exit_code"  // Exit code in a range, e.g. 0 or 0..2
+	VALIDATION_LINE_COUNT = "line_count" // Number of lines in a range, e.g. 1.. or ..100
+	VALIDATION_JSON_PATH  = "json_path"  // Value at a path in the output parsed as JSON, e.g. status.code
+
+	OUTPUT_STREAM_STDOUT = 1
+	OUTPUT_STREAM_STDERR = 2
+	OUTPUT_STREAM_BOTH   = 3
+)
+
 type ExecutionValidation struct {
 	Id           string // Unique id
+	Type         string // One of the VALIDATION_ types, empty for contains
 	Fatal        bool   // If matched, should we abort the (sequence of) operation(s)?
 	MustContain  bool   // Should this be in there?
-	OutputStream int    // 1 = standard output, 2 error output
-	Text         string // Text to match
+	OutputStream int    // 1 = standard output, 2 error output, 3 both
+	Text         string // Text to match, the pattern, range or path depending on the type
+	Value        string // Expected value at a json path, empty if it only has to exist
 }
 
-// Must contain XYZ
-func newExecutionValidation(txt string, fatal bool, mustContain bool, outputStream int) *ExecutionValidation {
-	// Validate stream
-	if outputStream != 1 && outputStream != 2 {
-		return nil
-	}
+// Outcome of a validation rule on a command
+type ExecutionValidationResult struct {
+	RuleId string // Validation rule id
+	Type   string // Type of the rule
+	Text   string // Text of the rule at time of validation
+	Fatal  bool   // Was the rule fatal?
+	Passed bool   // Did the command pass the rule?
+}
 
-	// Must have text
-	if len(txt) < 1 {
-		return nil
+func newExecutionValidationResult(rule *ExecutionValidation, passed bool) *ExecutionValidationResult {
+	return &ExecutionValidationResult{
+		RuleId: rule.Id,
+		Type:   rule.GetType(),
+		Text:   rule.Text,
+		Fatal:  rule.Fatal,
+		Passed: passed,
 	}
+}
 
+// New validation rule, checked before it is returned
+func newExecutionValidation(ruleType string, txt string, value string, fatal bool, mustContain bool, outputStream int) (*ExecutionValidation, error) {
 	// Id
 	id, _ := uuid.NewV4()
 
-	return &ExecutionValidation{
+	v := &ExecutionValidation{
 		Id:           id.String(),
-		Fatal:        true,
-		MustContain:  true,
+		Type:         ruleType,
+		Fatal:        fatal,
+		MustContain:  mustContain,
 		Text:         txt,
-		OutputStream: 1,
+		Value:        value,
+		OutputStream: outputStream,
+	}
+	if valid, err := v.IsValid(); !valid {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Rules from before types existed are substring matches
+func (v *ExecutionValidation) GetType() string {
+	if len(v.Type) == 0 {
+		return VALIDATION_CONTAINS
+	}
+	return v.Type
+}
+
+func (v *ExecutionValidation) IsValid() (bool, error) {
+	if v.OutputStream < OUTPUT_STREAM_STDOUT || v.OutputStream > OUTPUT_STREAM_BOTH {
+		return false, errors.New("Invalid output stream")
+	}
+	if len(strings.TrimSpace(v.Text)) < 1 {
+		return false, errors.New("Text can not be empty")
+	}
+	switch v.GetType() {
+	case VALIDATION_CONTAINS:
+	case VALIDATION_REGEX:
+		if _, err := regexp.Compile(v.Text); err != nil {
+			return false, fmt.Errorf("Invalid regular expression: %s", err)
+		}
+	case VALIDATION_EXIT_CODE, VALIDATION_LINE_COUNT:
+		if _, _, err := parseValidationRange(v.Text); err != nil {
+			return false, err
+		}
+	case VALIDATION_JSON_PATH:
+		if _, err := parseJsonPath(v.Text); err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("Unknown validation type %s", v.Type)
+	}
+	return true, nil
+}
+
+// Does the output match the rule? Whether that passes depends on MustContain
+func (v *ExecutionValidation) Matches(stdout []string, stderr []string, exitCode int) bool {
+	var lines []string
+	switch v.OutputStream {
+	case OUTPUT_STREAM_STDERR:
+		lines = stderr
+	case OUTPUT_STREAM_BOTH:
+		lines = append(append(make([]string, 0, len(stdout)+len(stderr)), stdout...), stderr...)
+	default:
+		lines = stdout
+	}
+
+	switch v.GetType() {
+	case VALIDATION_CONTAINS:
+		for _, line := range lines {
+			if strings.Contains(line, v.Text) {
+				return true
+			}
+		}
+	case VALIDATION_REGEX:
+		re, err := regexp.Compile(v.Text)
+		if err != nil {
+			return false
+		}
+		for _, line := range lines {
+			if re.MatchString(line) {
+				return true
+			}
+		}
+	case VALIDATION_EXIT_CODE:
+		min, max, err := parseValidationRange(v.Text)
+		return err == nil && int64(exitCode) >= min && int64(exitCode) <= max
+	case VALIDATION_LINE_COUNT:
+		min, max, err := parseValidationRange(v.Text)
+		count := int64(len(outputLines(lines)))
+		return err == nil && count >= min && count <= max
+	case VALIDATION_JSON_PATH:
+		return matchJsonPath(strings.Join(lines, "\n"), v.Text, v.Value)
+	}
+	return false
+}
+
+// Lines with content, the output ends with an empty line
+func outputLines(lines []string) []string {
+	res := make([]string, 0)
+	for _, line := range lines {
+		if len(strings.TrimSpace(line)) > 0 {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+// Inclusive range, either a single number or min..max where both ends are optional
+func parseValidationRange(s string) (int64, int64, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "..") {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid range %s, use a number or min..max", s)
+		}
+		return n, n, nil
+	}
+	parts := strings.SplitN(s, "..", 2)
+	min := int64(math.MinInt64)
+	max := int64(math.MaxInt64)
+	var err error
+	if len(strings.TrimSpace(parts[0])) > 0 {
+		if min, err = strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Invalid range %s, use a number or min..max", s)
+		}
+	}
+	if len(strings.TrimSpace(parts[1])) > 0 {
+		if max, err = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Invalid range %s, use a number or min..max", s)
+		}
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("Invalid range %s, min is larger than max", s)
+	}
+	return min, max, nil
+}
+
+// Path of keys and array indices, e.g. $.items[0].name or items.0.name
+func parseJsonPath(path string) ([]string, error) {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.Replace(strings.Replace(path, "[", ".", -1), "]", "", -1)
+	if len(path) == 0 {
+		return nil, errors.New("Json path can not be empty")
+	}
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("Invalid json path %s", path)
+		}
+	}
+	return keys, nil
+}
+
+// Does the path exist in the document, with the expected value if one is given?
+func matchJsonPath(doc string, path string, expected string) bool {
+	keys, err := parseJsonPath(path)
+	if err != nil {
+		return false
+	}
+	var v interface{}
+	if je := json.Unmarshal([]byte(doc), &v); je != nil {
+		return false
+	}
+	for _, key := range keys {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			elm, ok := node[key]
+			if !ok {
+				return false
+			}
+			v = elm
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return false
+			}
+			v = node[i]
+		default:
+			return false
+		}
+	}
+	if len(expected) == 0 {
+		return true
+	}
+
+	// Strings compare as is, anything else in its JSON form
+	if s, ok := v.(string); ok {
+		return s == expected
+	}
+	b, _ := json.Marshal(v)
+	return string(b) == expected
+}
+
+// Stream from the form, by name or number
+func parseOutputStream(s string) (int, error) {
+	switch strings.TrimSpace(s) {
+	case "", "stdout", "1":
+		return OUTPUT_STREAM_STDOUT, nil
+	case "stderr", "2":
+		return OUTPUT_STREAM_STDERR, nil
+	case "both", "3":
+		return OUTPUT_STREAM_BOTH, nil
 	}
+	return 0, fmt.Errorf("Invalid output stream %s, use stdout, stderr or both", s)
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestValidation(ruleType string, txt string, value string, mustContain bool, stream int) *ExecutionValidation {
+	v, _ := newExecutionValidation(ruleType, txt, value, true, mustContain, stream)
+	return v
+}
+
+func TestNewExecutionValidation(t *testing.T) {
+	v, err := newExecutionValidation("", "OK", "", false, true, OUTPUT_STREAM_STDERR)
+	assert.Nil(t, err)
+	assert.False(t, v.Fatal)
+	assert.True(t, v.MustContain)
+	assert.Equal(t, OUTPUT_STREAM_STDERR, v.OutputStream)
+	assert.Equal(t, VALIDATION_CONTAINS, v.GetType())
+
+	_, err = newExecutionValidation("", " ", "", true, true, OUTPUT_STREAM_STDOUT)
+	assert.NotNil(t, err)
+	_, err = newExecutionValidation("", "OK", "", true, true, 4)
+	assert.NotNil(t, err)
+	_, err = newExecutionValidation("glob", "OK", "", true, true, OUTPUT_STREAM_STDOUT)
+	assert.NotNil(t, err)
+	_, err = newExecutionValidation(VALIDATION_REGEX, "([a-z]", "", true, true, OUTPUT_STREAM_STDOUT)
+	assert.NotNil(t, err)
+	_, err = newExecutionValidation(VALIDATION_EXIT_CODE, "2..1", "", true, true, OUTPUT_STREAM_STDOUT)
+	assert.NotNil(t, err)
+	_, err = newExecutionValidation(VALIDATION_JSON_PATH, "$.", "", true, true, OUTPUT_STREAM_STDOUT)
+	assert.NotNil(t, err)
+}
+
+func TestParseValidationRange(t *testing.T) {
+	min, max, err := parseValidationRange("0")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), min)
+	assert.Equal(t, int64(0), max)
+
+	min, max, err = parseValidationRange("-1..2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-1), min)
+	assert.Equal(t, int64(2), max)
+
+	min, _, err = parseValidationRange("..100")
+	assert.Nil(t, err)
+	assert.True(t, min < 0)
+	_, max, err = parseValidationRange("1..")
+	assert.Nil(t, err)
+	assert.True(t, max > 100)
+
+	_, _, err = parseValidationRange("one")
+	assert.NotNil(t, err)
+}
+
+func TestParseOutputStream(t *testing.T) {
+	stream, err := parseOutputStream("")
+	assert.Nil(t, err)
+	assert.Equal(t, OUTPUT_STREAM_STDOUT, stream)
+	stream, _ = parseOutputStream("stderr")
+	assert.Equal(t, OUTPUT_STREAM_STDERR, stream)
+	stream, _ = parseOutputStream("3")
+	assert.Equal(t, OUTPUT_STREAM_BOTH, stream)
+	_, err = parseOutputStream("stdin")
+	assert.NotNil(t, err)
+}
+
+func TestValidateContains(t *testing.T) {
+	c := &Cmd{BufOutput: []string{"Starting", "Done OK"}, BufOutputErr: []string{"warning: disk almost full"}}
+
+	assert.False(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation("", "OK", "", true, OUTPUT_STREAM_STDOUT)}))
+	assert.True(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation("", "OK", "", true, OUTPUT_STREAM_STDERR)}))
+	assert.False(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation("", "warning", "", true, OUTPUT_STREAM_BOTH)}))
+	assert.True(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation("", "warning", "", false, OUTPUT_STREAM_STDERR)}))
+
+	// Rules from before types and streams were configurable
+	legacy := &ExecutionValidation{Id: "legacy", Fatal: true, MustContain: true, OutputStream: 1, Text: "Done"}
+	assert.False(t, c.evaluateValidation([]*ExecutionValidation{legacy}))
+}
+
+func TestValidateRegex(t *testing.T) {
+	c := &Cmd{BufOutput: []string{"Processed 42 items"}, BufOutputErr: []string{"ERROR 500"}}
+	assert.False(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_REGEX, `^Processed \d+ items$`, "", true, OUTPUT_STREAM_STDOUT)}))
+	assert.True(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_REGEX, `ERROR \d{3}`, "", false, OUTPUT_STREAM_BOTH)}))
+}
+
+func TestValidateExitCode(t *testing.T) {
+	c := &Cmd{ExitCode: 1}
+	assert.False(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_EXIT_CODE, "0..1", "", true, OUTPUT_STREAM_STDOUT)}))
+	assert.True(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_EXIT_CODE, "0", "", true, OUTPUT_STREAM_STDOUT)}))
+	assert.True(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_EXIT_CODE, "1", "", false, OUTPUT_STREAM_STDOUT)}))
+}
+
+func TestValidateLineCount(t *testing.T) {
+	c := &Cmd{BufOutput: []string{"a", "b", "c", ""}, BufOutputErr: []string{""}}
+	assert.False(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_LINE_COUNT, "3", "", true, OUTPUT_STREAM_STDOUT)}))
+	assert.False(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_LINE_COUNT, "..0", "", true, OUTPUT_STREAM_STDERR)}))
+	assert.True(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_LINE_COUNT, "4..", "", true, OUTPUT_STREAM_BOTH)}))
+}
+
+func TestValidateJsonPath(t *testing.T) {
+	c := &Cmd{BufOutput: []string{`{"status": "ok",`, `"items": [{"name": "web1", "healthy": true, "load": 3}]}`}, BufOutputErr: []string{"not json"}}
+	rules := []*ExecutionValidation{
+		newTestValidation(VALIDATION_JSON_PATH, "status", "ok", true, OUTPUT_STREAM_STDOUT),
+		newTestValidation(VALIDATION_JSON_PATH, "$.items[0].name", "web1", true, OUTPUT_STREAM_STDOUT),
+		newTestValidation(VALIDATION_JSON_PATH, "items.0.healthy", "true", true, OUTPUT_STREAM_STDOUT),
+		newTestValidation(VALIDATION_JSON_PATH, "items.0.load", "3", true, OUTPUT_STREAM_STDOUT),
+		newTestValidation(VALIDATION_JSON_PATH, "items.0", "", true, OUTPUT_STREAM_STDOUT),
+		newTestValidation(VALIDATION_JSON_PATH, "items.1", "", false, OUTPUT_STREAM_STDOUT),
+		newTestValidation(VALIDATION_JSON_PATH, "error", "", false, OUTPUT_STREAM_STDOUT),
+	}
+	assert.False(t, c.evaluateValidation(rules))
+	assert.Len(t, c.ValidationResults, len(rules))
+
+	assert.True(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_JSON_PATH, "status", "failed", true, OUTPUT_STREAM_STDOUT)}))
+	assert.True(t, c.evaluateValidation([]*ExecutionValidation{newTestValidation(VALIDATION_JSON_PATH, "status", "", true, OUTPUT_STREAM_STDERR)}))
+}
+
+func TestValidateFatal(t *testing.T) {
+	c := &Cmd{BufOutput: []string{"Done"}}
+	warn, _ := newExecutionValidation("", "OK", "", false, true, OUTPUT_STREAM_STDOUT)
+	fail, _ := newExecutionValidation("", "Error", "", true, false, OUTPUT_STREAM_STDOUT)
+	done, _ := newExecutionValidation("", "Done", "", true, false, OUTPUT_STREAM_STDOUT)
+	last, _ := newExecutionValidation("", "Done", "", true, true, OUTPUT_STREAM_STDOUT)
+
+	// Non fatal failures are reported but do not fail the command
+	assert.False(t, c.evaluateValidation([]*ExecutionValidation{warn, fail}))
+	assert.Len(t, c.ValidationResults, 2)
+	assert.False(t, c.ValidationResults[0].Passed)
+	assert.True(t, c.ValidationResults[1].Passed)
+
+	// The first fatal failure stops the validation
+	assert.True(t, c.evaluateValidation([]*ExecutionValidation{done, last}))
+	assert.Len(t, c.ValidationResults, 1)
+}
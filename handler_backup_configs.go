@@ -30,6 +30,13 @@ func GetBackupConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 		return
 	}
 
+	// Recent second factor proof
+	if !checkStepUp(usr, r, STEP_UP_BACKUP) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
 	// Create a buffer to write our archive to.
 	buf := new(bytes.Buffer)
 
@@ -43,7 +50,10 @@ func GetBackupConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	}{
 		{conf.HomeFile("users.json")},
 		{conf.HomeFile("templates.conf")},
+		{conf.HomeFile("template_versions.json")},
 		{conf.HomeFile("httpchecks.json")},
+		{conf.HomeFile("schedules.json")},
+		{conf.HomeFile("maintenance_windows.json")},
 		{conf.GetSslCertFile()},
 		{conf.GetSslPrivateKeyFile()},
 		{conf.ConfFile()},
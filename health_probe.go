@@ -0,0 +1,239 @@
+package main
+
+// Health probes that gate the start of the next batch of a rolling execution
+// @author Robin Verlangen
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	HEALTH_PROBE_HTTP     = "http"     // GET an url and validate status and body
+	HEALTH_PROBE_TCP      = "tcp"      // Connect to an address
+	HEALTH_PROBE_TEMPLATE = "template" // Run a read-only template on the changed hosts
+
+	HEALTH_PROBE_CLIENT_PLACEHOLDER = "{client}" // Replaced by the id of each changed host in urls and addresses
+	DEFAULT_HEALTH_PROBE_TIMEOUT    = 60         // In seconds
+	DEFAULT_HEALTH_PROBE_INTERVAL   = 5          // In seconds
+)
+
+type HealthProbe struct {
+	Type           string // http, tcp or template
+	Uri            string // Url to GET for http probes
+	ExpectedStatus int    // Expected status code for http probes, 0 means 200
+	ExpectedBody   string // Text the body must contain for http probes
+	Address        string // Host:port to connect to for tcp probes
+	TemplateId     string // Template executed on the changed hosts for template probes
+	Timeout        int    // Seconds within which the probe must pass
+	Interval       int    // Seconds between attempts
+}
+
+// Result of probing after a batch
+type HealthProbeResult struct {
+	Iteration int                    // Batch after which the probe ran
+	Time      int64                  // Unix TS of completion
+	Passed    bool                   // Did the probe pass within the timeout?
+	Message   string                 // Error of the last attempt
+	Hosts     []*ConsensusReportHost // Commands of every attempt of template probes
+}
+
+// Validate the setup of a probe
+func (p *HealthProbe) IsValid() (bool, error) {
+	switch p.Type {
+	case HEALTH_PROBE_HTTP:
+		if len(p.Uri) < 1 {
+			return false, errors.New("Fill in a probe url")
+		}
+	case HEALTH_PROBE_TCP:
+		if len(p.Address) < 1 {
+			return false, errors.New("Fill in a probe address")
+		}
+	case HEALTH_PROBE_TEMPLATE:
+		if len(p.TemplateId) < 1 {
+			return false, errors.New("Select a probe template")
+		}
+	default:
+		return false, errors.New("Probe type not found")
+	}
+	if p.Timeout < 0 || p.Interval < 0 {
+		return false, errors.New("Probe timeout and interval can not be negative")
+	}
+	return true, nil
+}
+
+// Probe the hosts until it passes or the timeout expires, returns the commands dispatched by template probes
+func (p *HealthProbe) Check(cr *ConsensusRequest, clientIds []string) ([]*Cmd, error) {
+	timeout := p.Timeout
+	if timeout < 1 {
+		timeout = DEFAULT_HEALTH_PROBE_TIMEOUT
+	}
+	interval := p.Interval
+	if interval < 1 {
+		interval = DEFAULT_HEALTH_PROBE_INTERVAL
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+	cmds := make([]*Cmd, 0)
+	for {
+		attemptCmds, err := p.attempt(cr, clientIds, deadline)
+		cmds = append(cmds, attemptCmds...)
+		if err == nil {
+			return cmds, nil
+		}
+		if conf.Debug {
+			log.Printf("Health probe for request %s failed: %s", cr.Id, err)
+		}
+		if time.Now().Add(time.Duration(interval) * time.Second).After(deadline) {
+			return cmds, err
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// Single attempt on all hosts
+func (p *HealthProbe) attempt(cr *ConsensusRequest, clientIds []string, deadline time.Time) ([]*Cmd, error) {
+	switch p.Type {
+	case HEALTH_PROBE_HTTP:
+		for _, uri := range p.expand(p.Uri, clientIds) {
+			if err := p.attemptHttp(uri); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case HEALTH_PROBE_TCP:
+		for _, address := range p.expand(p.Address, clientIds) {
+			conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			conn.Close()
+		}
+		return nil, nil
+	case HEALTH_PROBE_TEMPLATE:
+		return p.attemptTemplate(cr, clientIds, deadline)
+	}
+	return nil, errors.New("Probe type not found")
+}
+
+// Replace the client placeholder, one target per host
+func (p *HealthProbe) expand(target string, clientIds []string) []string {
+	if !strings.Contains(target, HEALTH_PROBE_CLIENT_PLACEHOLDER) {
+		return []string{target}
+	}
+	targets := make([]string, 0)
+	for _, clientId := range clientIds {
+		targets = append(targets, strings.Replace(target, HEALTH_PROBE_CLIENT_PLACEHOLDER, clientId, -1))
+	}
+	return targets
+}
+
+func (p *HealthProbe) attemptHttp(uri string) error {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		}, // Services are often probed on internal addresses with self signed certificates
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   10 * time.Second,
+	}
+	resp, err := client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	expectedStatus := p.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("%s returned status %d, expected %d", uri, resp.StatusCode, expectedStatus)
+	}
+
+	if len(p.ExpectedBody) > 0 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), p.ExpectedBody) {
+			return fmt.Errorf("%s body does not contain %s", uri, p.ExpectedBody)
+		}
+	}
+	return nil
+}
+
+// Clients the probe template may run on, it runs under the approval of the request so it must be read-only
+func (p *HealthProbe) probeClients(clientIds []string) (*Template, []*RegisteredClient, error) {
+	template := server.templateStore.Get(p.TemplateId)
+	if template == nil {
+		return nil, nil, errors.New("Probe template not found")
+	}
+	if !template.ReadOnly {
+		return nil, nil, fmt.Errorf("Probe template %s is not marked read-only", template.Title)
+	}
+	if err := template.DisabledError(); err != nil {
+		return nil, nil, err
+	}
+	clients := make([]*RegisteredClient, 0)
+	for _, clientId := range clientIds {
+		client := server.GetClient(clientId)
+		if reason := clientTargetError(client, template.Acl); len(reason) > 0 {
+			return nil, nil, fmt.Errorf("Probe can not run on %s: %s", clientId, reason)
+		}
+		clients = append(clients, client)
+	}
+	return template, clients, nil
+}
+
+// Execute the probe template on the hosts and wait for all to pass validation
+func (p *HealthProbe) attemptTemplate(cr *ConsensusRequest, clientIds []string, deadline time.Time) ([]*Cmd, error) {
+	template, clients, err := p.probeClients(clientIds)
+	if err != nil {
+		return nil, err
+	}
+
+	// Dispatch, the commands are not part of the request so they do not interfere with its batches
+	cmds := make([]*Cmd, 0)
+	for _, client := range clients {
+		cmd := newCmd(template.Command, template.Timeout)
+		cmd.TemplateId = template.Id
+		cmd.TemplateVersion = template.Version
+		cmd.ClientId = client.ClientId
+		cmd.RequestUserId = cr.RequestUserId
+		cmd.Sign(client)
+		audit.Log(nil, "Consensus", fmt.Sprintf("Health probe %s of request %s on client %s with id %s", template.Id, cr.Id, client.ClientId, cmd.Id))
+		client.Submit(cmd)
+		cmds = append(cmds, cmd)
+	}
+
+	// Wait for results
+	for _, cmd := range cmds {
+		for !cmd.IsFinal() {
+			if time.Now().After(deadline) {
+				return cmds, fmt.Errorf("Probe on %s did not finish in time", cmd.ClientId)
+			}
+			time.Sleep(1 * time.Second)
+		}
+		if cmd.IsFailed() {
+			return cmds, fmt.Errorf("Probe on %s ended with state %s", cmd.ClientId, cmd.State)
+		}
+	}
+	return cmds, nil
+}
+
+func newHealthProbe(probeType string) *HealthProbe {
+	return &HealthProbe{
+		Type:     probeType,
+		Timeout:  DEFAULT_HEALTH_PROBE_TIMEOUT,
+		Interval: DEFAULT_HEALTH_PROBE_INTERVAL,
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthProbeValidation(t *testing.T) {
+	probe := newHealthProbe("invalid")
+	valid, err := probe.IsValid()
+	assert.False(t, valid)
+	assert.Error(t, err)
+
+	probe = newHealthProbe(HEALTH_PROBE_HTTP)
+	valid, _ = probe.IsValid()
+	assert.False(t, valid)
+	probe.Uri = "http://localhost/health"
+	valid, err = probe.IsValid()
+	assert.True(t, valid)
+	assert.NoError(t, err)
+
+	probe = newHealthProbe(HEALTH_PROBE_TCP)
+	valid, _ = probe.IsValid()
+	assert.False(t, valid)
+	probe.Address = "localhost:80"
+	valid, _ = probe.IsValid()
+	assert.True(t, valid)
+}
+
+func TestHealthProbeExpandClients(t *testing.T) {
+	probe := newHealthProbe(HEALTH_PROBE_HTTP)
+	assert.Equal(t, []string{"http://lb/health"}, probe.expand("http://lb/health", []string{"a", "b"}))
+	assert.Equal(t, []string{"http://a/health", "http://b/health"}, probe.expand("http://{client}/health", []string{"a", "b"}))
+}
+
+func TestHealthProbeHttp(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, "status: ok")
+	}))
+	defer ts.Close()
+
+	probe := newHealthProbe(HEALTH_PROBE_HTTP)
+	probe.ExpectedBody = "ok"
+	assert.NoError(t, probe.attemptHttp(ts.URL+"/up"))
+	assert.Error(t, probe.attemptHttp(ts.URL+"/down"))
+
+	probe.ExpectedStatus = http.StatusServiceUnavailable
+	assert.NoError(t, probe.attemptHttp(ts.URL+"/down"))
+
+	probe.ExpectedStatus = 0
+	probe.ExpectedBody = "healthy"
+	assert.Error(t, probe.attemptHttp(ts.URL+"/up"))
+}
+
+func TestHealthProbeTemplateClients(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	check := newTemplate("Check", "Read-only check", "uptime", true, []string{}, []string{"db"}, 1, 10, nil)
+	server = &Server{
+		templateStore: &TemplateStore{Templates: map[string]*Template{check.Id: check}},
+		clients: map[string]*RegisteredClient{
+			"web1": {ClientId: "web1", Tags: []string{"web"}},
+			"db1":  {ClientId: "db1", Tags: []string{"db"}},
+		},
+	}
+	probe := newHealthProbe(HEALTH_PROBE_TEMPLATE)
+	probe.TemplateId = check.Id
+
+	// Only templates marked read-only run without their own approval
+	_, _, err := probe.probeClients([]string{"web1"})
+	assert.Error(t, err)
+	check.ReadOnly = true
+	_, clients, err := probe.probeClients([]string{"web1"})
+	assert.NoError(t, err)
+	assert.Len(t, clients, 1)
+
+	// The template ACL applies
+	_, _, err = probe.probeClients([]string{"web1", "db1"})
+	assert.Error(t, err)
+	_, _, err = probe.probeClients([]string{"web2"})
+	assert.Error(t, err)
+
+	// Disabled templates do not run
+	check.Enabled = false
+	_, _, err = probe.probeClients([]string{"web1"})
+	assert.Error(t, err)
+}
+
+func TestHealthProbeFailureHaltsNextBatch(t *testing.T) {
+	prevServer, prevConf := server, conf
+	defer func() { server, conf = prevServer, prevConf }()
+	conf = &Conf{}
+	dir, _ := ioutil.TempDir("", "indispenso")
+	defer os.RemoveAll(dir)
+
+	probe := newHealthProbe(HEALTH_PROBE_TCP)
+	probe.Address = "127.0.0.1:1"
+	probe.Timeout = 1
+	probe.Interval = 1
+	template := &Template{Id: "deploy", Title: "Deploy", Command: "deploy", Enabled: true, HealthProbe: probe}
+
+	cr := newConsensusRequest()
+	cr.TemplateId = template.Id
+	cr.ClientIds = []string{"a", "b"}
+	cr.Executed = true
+	cr.setState(CONSENSUS_STATE_RUNNING, nil, "")
+
+	consensusFile := filepath.Join(dir, "consensus.json")
+	server = &Server{
+		templateStore:        &TemplateStore{Templates: map[string]*Template{template.Id: template}},
+		templateVersionStore: &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)},
+		consensus:            &Consensus{Pending: map[string]*ConsensusRequest{cr.Id: cr}, ConfFile: consensusFile},
+		clients: map[string]*RegisteredClient{
+			"a": {ClientId: "a", DispatchedCmds: map[string]*Cmd{
+				"c1": {Id: "c1", ClientId: "a", ConsensusRequestId: cr.Id, ExecutionIterationId: 1, State: "finished"},
+			}},
+			"b": {ClientId: "b", DispatchedCmds: make(map[string]*Cmd), Cmds: make(map[string]*Cmd)},
+		},
+	}
+
+	// First batch is done, the second waits for the probe
+	ece := newExecutionCoordinatorEntry()
+	ece.Id = cr.Id
+	ece.strategy = &ExecutionStrategy{Strategy: RollingExecutionStrategy}
+	ece.iteration = 1
+	ece.cmds = []*PendingClientCmd{{Client: server.clients["b"], Cmd: &Cmd{Id: "c2", ClientId: "b", ConsensusRequestId: cr.Id}}}
+	ece.Next()
+
+	// Completion is saved once the halt is handled
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(consensusFile); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	ece.mux.RLock()
+	assert.True(t, ece.halted)
+	assert.Equal(t, 1, ece.iteration)
+	assert.Len(t, ece.cmds, 0)
+	ece.mux.RUnlock()
+	assert.Len(t, server.clients["b"].DispatchedCmds, 0)
+	assert.Len(t, cr.ProbeResults, 1)
+	assert.False(t, cr.ProbeResults[0].Passed)
+	assert.Contains(t, cr.HaltReason, "Health probe failed after batch 1")
+	assert.Equal(t, CONSENSUS_STATE_FAILED, cr.State)
+}
@@ -56,9 +56,10 @@ func GetHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	}
 
 	// Execute the config
-	cr := server.consensus.AddRequest(c.TemplateId, c.ClientIds, server.httpCheckStore.SystemUser, "")
-	if cr == nil {
-		jr.Error("Unable to start check")
+	cr, err := server.consensus.AddRequest(c.TemplateId, c.ClientIds, server.httpCheckStore.SystemUser, "")
+	if err != nil {
+		log.Printf("Unable to start check %s: %s", c.Id, err)
+		jr.Error(fmt.Sprintf("Unable to start check: %s", err))
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
@@ -70,6 +71,9 @@ func GetHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	}
 	cr.Callbacks = append(cr.Callbacks, cb)
 
+	// Nobody waits for a request that is queued behind a maintenance window
+	cr.FailWhenHeld = true
+
 	// Trigger execution
 	cr.check()
 
@@ -85,6 +89,17 @@ func GetHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	// Cleanup
 	cr.Delete()
 
+	// Failed, halted, cancelled or never started
+	if cr.State != CONSENSUS_STATE_SUCCEEDED {
+		msg := cr.State
+		if len(cr.HaltReason) > 0 {
+			msg = fmt.Sprintf("%s: %s", cr.State, cr.HaltReason)
+		}
+		jr.Error(fmt.Sprintf("Check failed, request %s", msg))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
 	// Print results
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
@@ -234,6 +249,11 @@ func PostHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
+	if err := template.DisabledError(); err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
 	// Client IDs
 	clientIds := strings.Split(strings.TrimSpace(r.PostFormValue("clients")), ",")
@@ -273,8 +293,7 @@ func (s *HttpCheckStore) load() {
 
 // New store
 func newHttpCheckStore() *HttpCheckStore {
-	systemUser := newUser()
-	systemUser.AddRole("requester")
+	systemUser := newSystemUser("httpcheck")
 	s := &HttpCheckStore{
 		ConfFile:   conf.HomeFile("httpchecks.json"),
 		Checks:     make(map[string]*HttpCheckConfiguration),
@@ -0,0 +1,402 @@
+package main
+
+// Maintenance windows and change freezes that control when requests are allowed to execute
+// @author Robin Verlangen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MAINTENANCE_WINDOW_ALLOW = "allow" // Execution is only allowed while the window is open
+	MAINTENANCE_WINDOW_DENY  = "deny"  // Execution is blocked while the window is open, e.g. a change freeze
+
+	MAINTENANCE_ACTION_QUEUE = "queue" // Blocked requests wait until they are allowed to run
+	MAINTENANCE_ACTION_FAIL  = "fail"  // Blocked requests fail immediately
+)
+
+// Maintenance windows
+type MaintenanceWindowStore struct {
+	Windows  map[string]*MaintenanceWindow
+	ConfFile string
+	mux      sync.RWMutex
+}
+
+// A window is either one-off (start and end) or recurring (cron expression and duration)
+type MaintenanceWindow struct {
+	Id           string
+	Title        string
+	Type         string   // allow or deny
+	Action       string   // queue or fail, what happens to requests blocked by this window
+	Tags         []string // Clients the window applies to, empty for all
+	Start        int64    // Unix TS of the start of a one-off window
+	End          int64    // Unix TS of the end of a one-off window
+	Cron         string   // Start of a recurring window
+	Duration     int      // Minutes a recurring window stays open
+	TimeZone     string   // Location the cron expression is evaluated in, empty for the server time zone
+	CreateUserId string
+	CreateTime   int64
+}
+
+// Get item
+func (s *MaintenanceWindowStore) Get(id string) *MaintenanceWindow {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Windows[id]
+}
+
+// Add item
+func (s *MaintenanceWindowStore) Add(e *MaintenanceWindow) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.Windows[e.Id] = e
+}
+
+// Remove item
+func (s *MaintenanceWindowStore) Remove(id string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.Windows, id)
+}
+
+// Window that blocks execution on these clients right now, if any
+func (s *MaintenanceWindowStore) Check(clientIds []string, now time.Time) (*MaintenanceWindow, error) {
+	clientTags := make(map[string][]string)
+	for _, clientId := range clientIds {
+		clientTags[clientId] = nil
+		if client := server.GetClient(clientId); client != nil {
+			client.mux.RLock()
+			clientTags[clientId] = client.Tags
+			client.mux.RUnlock()
+		}
+	}
+
+	s.mux.RLock()
+	windows := make([]*MaintenanceWindow, 0)
+	for _, window := range s.Windows {
+		windows = append(windows, window)
+	}
+	s.mux.RUnlock()
+
+	return blockingMaintenanceWindow(windows, clientTags, now)
+}
+
+// Deny windows that are open block, allow windows block while none of them is open
+func blockingMaintenanceWindow(windows []*MaintenanceWindow, clientTags map[string][]string, now time.Time) (*MaintenanceWindow, error) {
+	sort.Sort(maintenanceWindowsById(windows))
+	clientIds := make([]string, 0)
+	for clientId := range clientTags {
+		clientIds = append(clientIds, clientId)
+	}
+	sort.Strings(clientIds)
+
+	for _, clientId := range clientIds {
+		open := false
+		var closed *MaintenanceWindow
+		for _, window := range windows {
+			if window.IsExpired(now) || !window.AppliesTo(clientTags[clientId]) {
+				continue
+			}
+			active := window.IsActive(now)
+			switch window.Type {
+			case MAINTENANCE_WINDOW_DENY:
+				if active {
+					return window, fmt.Errorf("Change freeze '%s' is active on %s until %s", window.Title, clientId, window.ActiveUntil(now).Format("2006-01-02 15:04 MST"))
+				}
+			case MAINTENANCE_WINDOW_ALLOW:
+				if active {
+					open = true
+				} else if closed == nil {
+					closed = window
+				}
+			}
+		}
+		if !open && closed != nil {
+			msg := fmt.Sprintf("%s is outside maintenance window '%s'", clientId, closed.Title)
+			if next := closed.NextStart(now); !next.IsZero() {
+				msg = fmt.Sprintf("%s, it opens at %s", msg, next.Format("2006-01-02 15:04 MST"))
+			}
+			return closed, errors.New(msg)
+		}
+	}
+	return nil, nil
+}
+
+// Does the window apply to a client with these tags?
+func (w *MaintenanceWindow) AppliesTo(tags []string) bool {
+	if len(w.Tags) == 0 {
+		return true
+	}
+	for _, tag := range w.Tags {
+		for _, clientTag := range tags {
+			if tag == clientTag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (w *MaintenanceWindow) IsRecurring() bool {
+	return len(w.Cron) > 0
+}
+
+// One-off window that ended, it never opens again
+func (w *MaintenanceWindow) IsExpired(now time.Time) bool {
+	return !w.IsRecurring() && now.Unix() >= w.End
+}
+
+// Is the window open at this time?
+func (w *MaintenanceWindow) IsActive(now time.Time) bool {
+	return !w.ActiveUntil(now).IsZero()
+}
+
+// End of the window if it is open at this time, zero time otherwise
+func (w *MaintenanceWindow) ActiveUntil(now time.Time) time.Time {
+	if !w.IsRecurring() {
+		if now.Unix() >= w.Start && now.Unix() < w.End {
+			return time.Unix(w.End, 0)
+		}
+		return time.Time{}
+	}
+
+	c, err := w.CronSchedule()
+	if err != nil {
+		return time.Time{}
+	}
+
+	// Most recent start within the duration
+	duration := time.Duration(w.Duration) * time.Minute
+	start := c.Next(now.Add(-duration))
+	if start.IsZero() || start.After(now) {
+		return time.Time{}
+	}
+	for {
+		next := c.Next(start)
+		if next.IsZero() || next.After(now) {
+			break
+		}
+		start = next
+	}
+	if !start.Add(duration).After(now) {
+		return time.Time{}
+	}
+	return start.Add(duration)
+}
+
+// Next time the window opens, zero time if it never does
+func (w *MaintenanceWindow) NextStart(now time.Time) time.Time {
+	if !w.IsRecurring() {
+		if now.Unix() < w.Start {
+			return time.Unix(w.Start, 0)
+		}
+		return time.Time{}
+	}
+	c, err := w.CronSchedule()
+	if err != nil {
+		return time.Time{}
+	}
+	return c.Next(now)
+}
+
+// Parsed cron expression in the time zone of the window
+func (w *MaintenanceWindow) CronSchedule() (*CronSchedule, error) {
+	location := time.Local
+	if len(w.TimeZone) > 0 {
+		var err error
+		location, err = time.LoadLocation(w.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown time zone %s", w.TimeZone)
+		}
+	}
+	return parseCron(w.Cron, location)
+}
+
+// Validate
+func (w *MaintenanceWindow) IsValid() (bool, error) {
+	if len(w.Title) < 1 {
+		return false, errors.New("Fill in a title")
+	}
+	if w.Type != MAINTENANCE_WINDOW_ALLOW && w.Type != MAINTENANCE_WINDOW_DENY {
+		return false, errors.New("Type must be allow or deny")
+	}
+	if w.Action != MAINTENANCE_ACTION_QUEUE && w.Action != MAINTENANCE_ACTION_FAIL {
+		return false, errors.New("Action must be queue or fail")
+	}
+	if w.IsRecurring() {
+		if _, err := w.CronSchedule(); err != nil {
+			return false, err
+		}
+		if w.Duration < 1 {
+			return false, errors.New("Duration of a recurring window must be at least one minute")
+		}
+	} else if w.End <= w.Start {
+		return false, errors.New("End must be after start")
+	}
+	return true, nil
+}
+
+// Save to disk
+func (s *MaintenanceWindowStore) save() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, je := json.Marshal(s.Windows)
+	if je != nil {
+		log.Printf("Failed to write maintenance windows: %s", je)
+		return false
+	}
+	err := ioutil.WriteFile(s.ConfFile, bytes, 0644)
+	if err != nil {
+		log.Printf("Failed to write maintenance windows: %s", err)
+		return false
+	}
+	return true
+}
+
+// Load from disk
+func (s *MaintenanceWindowStore) load() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, err := ioutil.ReadFile(s.ConfFile)
+	if err == nil {
+		var v map[string]*MaintenanceWindow
+		je := json.Unmarshal(bytes, &v)
+		if je != nil {
+			log.Printf("Invalid maintenance_windows.json: %s", je)
+			return
+		}
+		s.Windows = v
+	}
+}
+
+type maintenanceWindowsById []*MaintenanceWindow
+
+func (a maintenanceWindowsById) Len() int           { return len(a) }
+func (a maintenanceWindowsById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a maintenanceWindowsById) Less(i, j int) bool { return a[i].Id < a[j].Id }
+
+// List maintenance windows
+func GetMaintenanceWindows(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.maintenanceWindowStore.mux.RLock()
+	jr.Set("windows", server.maintenanceWindowStore.Windows)
+	server.maintenanceWindowStore.mux.RUnlock()
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Create maintenance window
+func PostMaintenanceWindow(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Must be admin
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Verify two factor, a window can block or allow changes on all hosts
+	if res, _ := user.ValidateTotp(r.PostFormValue("totp")); res == false {
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	window := newMaintenanceWindow()
+	window.Title = strings.TrimSpace(r.PostFormValue("title"))
+	window.Type = strings.TrimSpace(r.PostFormValue("type"))
+	if action := strings.TrimSpace(r.PostFormValue("action")); len(action) > 0 {
+		window.Action = action
+	}
+	window.Tags = splitCommaList(r.PostFormValue("tags"))
+	window.Start, _ = strconv.ParseInt(strings.TrimSpace(r.PostFormValue("start")), 10, 64)
+	window.End, _ = strconv.ParseInt(strings.TrimSpace(r.PostFormValue("end")), 10, 64)
+	window.Cron = strings.TrimSpace(r.PostFormValue("cron"))
+	window.Duration, _ = strconv.Atoi(strings.TrimSpace(r.PostFormValue("duration")))
+	window.TimeZone = strings.TrimSpace(r.PostFormValue("timezone"))
+	window.CreateUserId = user.Id
+	if valid, err := window.IsValid(); !valid {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	audit.Log(user, "Maintenance window", fmt.Sprintf("Created %s window %s '%s' on tags %v", window.Type, window.Id, window.Title, window.Tags))
+	server.maintenanceWindowStore.Add(window)
+	res := server.maintenanceWindowStore.save()
+
+	jr.Set("id", window.Id)
+	jr.Set("saved", res)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Delete maintenance window
+func DeleteMaintenanceWindow(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Must be admin
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	audit.Log(user, "Maintenance window", fmt.Sprintf("Deleted %s", id))
+	server.maintenanceWindowStore.Remove(id)
+
+	res := server.maintenanceWindowStore.save()
+	jr.Set("saved", res)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// New store
+func newMaintenanceWindowStore() *MaintenanceWindowStore {
+	s := &MaintenanceWindowStore{
+		ConfFile: conf.HomeFile("maintenance_windows.json"),
+		Windows:  make(map[string]*MaintenanceWindow),
+	}
+	s.load()
+	return s
+}
+
+// New window
+func newMaintenanceWindow() *MaintenanceWindow {
+	return &MaintenanceWindow{
+		Id:         uuidStr(),
+		Action:     MAINTENANCE_ACTION_QUEUE,
+		Tags:       make([]string, 0),
+		CreateTime: time.Now().Unix(),
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowOneOff(t *testing.T) {
+	window := newMaintenanceWindow()
+	window.Start = 1000
+	window.End = 2000
+
+	assert.False(t, window.IsActive(time.Unix(999, 0)))
+	assert.True(t, window.IsActive(time.Unix(1000, 0)))
+	assert.Equal(t, int64(2000), window.ActiveUntil(time.Unix(1500, 0)).Unix())
+	assert.False(t, window.IsActive(time.Unix(2000, 0)))
+}
+
+func TestMaintenanceWindowRecurring(t *testing.T) {
+	// Nightly from 2:00 until 4:00
+	window := newMaintenanceWindow()
+	window.Cron = "0 2 * * *"
+	window.Duration = 120
+	window.TimeZone = "UTC"
+
+	assert.False(t, window.IsActive(time.Date(2016, 1, 1, 1, 59, 0, 0, time.UTC)))
+	assert.True(t, window.IsActive(time.Date(2016, 1, 1, 2, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2016, 1, 1, 4, 0, 0, 0, time.UTC), window.ActiveUntil(time.Date(2016, 1, 1, 3, 59, 30, 0, time.UTC)).UTC())
+	assert.False(t, window.IsActive(time.Date(2016, 1, 1, 4, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2016, 1, 2, 2, 0, 0, 0, time.UTC), window.NextStart(time.Date(2016, 1, 1, 4, 0, 0, 0, time.UTC)).UTC())
+}
+
+func TestMaintenanceWindowValidation(t *testing.T) {
+	window := newMaintenanceWindow()
+	window.Title = "Freeze"
+	window.Type = MAINTENANCE_WINDOW_DENY
+	valid, _ := window.IsValid()
+	assert.False(t, valid)
+
+	window.Start = 1000
+	window.End = 2000
+	valid, err := window.IsValid()
+	assert.True(t, valid)
+	assert.NoError(t, err)
+
+	window.Cron = "0 2 * * *"
+	valid, _ = window.IsValid()
+	assert.False(t, valid)
+}
+
+func TestMaintenanceWindowBlocking(t *testing.T) {
+	now := time.Unix(1500, 0)
+
+	freeze := newMaintenanceWindow()
+	freeze.Type = MAINTENANCE_WINDOW_DENY
+	freeze.Tags = []string{"production"}
+	freeze.Start = 1000
+	freeze.End = 2000
+
+	nightly := newMaintenanceWindow()
+	nightly.Type = MAINTENANCE_WINDOW_ALLOW
+	nightly.Tags = []string{"database"}
+	nightly.Start = 3000
+	nightly.End = 4000
+
+	windows := []*MaintenanceWindow{freeze, nightly}
+
+	// Not tagged
+	window, err := blockingMaintenanceWindow(windows, map[string][]string{"a": []string{"staging"}}, now)
+	assert.Nil(t, window)
+	assert.NoError(t, err)
+
+	// Frozen
+	window, err = blockingMaintenanceWindow(windows, map[string][]string{"a": []string{"staging"}, "b": []string{"production"}}, now)
+	assert.Equal(t, freeze, window)
+	assert.Error(t, err)
+
+	// Outside of the allowed window
+	window, err = blockingMaintenanceWindow(windows, map[string][]string{"c": []string{"database"}}, now)
+	assert.Equal(t, nightly, window)
+	assert.Error(t, err)
+
+	window, _ = blockingMaintenanceWindow(windows, map[string][]string{"c": []string{"database"}}, time.Unix(3500, 0))
+	assert.Nil(t, window)
+
+	// Both ended and never open again
+	assert.True(t, nightly.IsExpired(time.Unix(4000, 0)))
+	window, err = blockingMaintenanceWindow(windows, map[string][]string{"b": []string{"production"}, "c": []string{"database"}}, time.Unix(4000, 0))
+	assert.Nil(t, window)
+	assert.NoError(t, err)
+}
+
+func TestMaintenanceWindowFailsWhenHeld(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	template := newTemplate("Deploy", "Deploys the site", "deploy", true, []string{}, []string{}, 1, 10, nil)
+	freeze := newMaintenanceWindow()
+	freeze.Type = MAINTENANCE_WINDOW_DENY
+	freeze.End = time.Now().Unix() + 3600
+	server = &Server{
+		templateStore:          &TemplateStore{Templates: map[string]*Template{template.Id: template}},
+		templateVersionStore:   &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)},
+		maintenanceWindowStore: &MaintenanceWindowStore{Windows: map[string]*MaintenanceWindow{freeze.Id: freeze}},
+		clients:                map[string]*RegisteredClient{"web1": {ClientId: "web1"}},
+	}
+
+	// The caller of a HTTP check waits for the outcome, it is not queued
+	cr := newConsensusRequest()
+	cr.TemplateId = template.Id
+	cr.ClientIds = []string{"web1"}
+	cr.FailWhenHeld = true
+	cr.setState(CONSENSUS_STATE_APPROVED, nil, "")
+
+	assert.False(t, cr.start())
+	assert.Equal(t, CONSENSUS_STATE_FAILED, cr.State)
+	assert.Len(t, cr.QueuedReason, 0)
+}
@@ -0,0 +1,98 @@
+package main
+
+// Notifications towards users about requests that need their attention
+// @author Robin Verlangen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+type Notification struct {
+	UserIds []string // Recipients
+	Subject string
+	Message string
+	Time    int64
+}
+
+type Notifier struct {
+}
+
+// Notify users, delivery happens in the background
+func (n *Notifier) Notify(userIds []string, subject string, msg string) {
+	if len(userIds) == 0 {
+		return
+	}
+	notification := &Notification{
+		UserIds: userIds,
+		Subject: subject,
+		Message: msg,
+		Time:    time.Now().Unix(),
+	}
+	audit.Log(nil, "Notify", fmt.Sprintf("%s to %v", subject, userIds))
+
+	if len(conf.NotificationWebhook) > 0 {
+		go n.sendWebhook(notification)
+	}
+	if len(conf.SmtpServer) > 0 {
+		go n.sendMail(notification)
+	}
+}
+
+// Notify all users with a role
+func (n *Notifier) NotifyRole(role string, subject string, msg string) {
+	n.Notify(server.userStore.IdsWithRole(role), subject, msg)
+}
+
+// POST as JSON, e.g. into a chat channel
+func (n *Notifier) sendWebhook(notification *Notification) {
+	b, je := json.Marshal(notification)
+	if je != nil {
+		log.Printf("Failed to create notification: %s", je)
+		return
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Post(conf.NotificationWebhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("Failed to send notification webhook: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Notification webhook returned status %d", resp.StatusCode)
+	}
+}
+
+// E-mail every recipient that has an address
+func (n *Notifier) sendMail(notification *Notification) {
+	to := make([]string, 0)
+	for _, userId := range notification.UserIds {
+		if usr := server.userStore.ById(userId); usr != nil && len(usr.EmailAddress) > 0 {
+			to = append(to, usr.EmailAddress)
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+
+	var auth smtp.Auth
+	if len(conf.SmtpUsername) > 0 {
+		host := strings.Split(conf.SmtpServer, ":")[0]
+		auth = smtp.PlainAuth("", conf.SmtpUsername, conf.SmtpPassword, host)
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [indispenso] %s\r\n\r\n%s\r\n", conf.SmtpFrom, strings.Join(to, ", "), notification.Subject, notification.Message)
+	if err := smtp.SendMail(conf.SmtpServer, auth, conf.SmtpFrom, to, []byte(body)); err != nil {
+		log.Printf("Failed to send notification mail: %s", err)
+	}
+}
+
+func newNotifier() *Notifier {
+	return &Notifier{}
+}
@@ -0,0 +1,156 @@
+package main
+
+// Quorum rules on top of the minimum amount of approvals, evaluated against the groups of the approvers
+// @author Robin Verlangen
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	QUORUM_ANY_GROUP                = "*"                 // Any approver counts
+	QUORUM_EXCLUDE_REQUESTER_GROUPS = "exclude-requester" // Approvers sharing a group with the requester do not count
+)
+
+type QuorumRule struct {
+	Group                  string // Approvers must be in this group, empty for any approver
+	Min                    uint   // Approvals required
+	ExcludeRequesterGroups bool   // Approvers that share a group with the requester do not count
+}
+
+// Can the approver count towards the rule?
+func (q *QuorumRule) Counts(requester *User, approver *User) bool {
+	if len(q.Group) > 0 && !approver.InGroup(q.Group) {
+		return false
+	}
+	if q.ExcludeRequesterGroups && requester != nil && approver.SharesGroup(requester) {
+		return false
+	}
+	return true
+}
+
+// Human readable description
+func (q *QuorumRule) String() string {
+	s := fmt.Sprintf("%d from any group", q.Min)
+	if len(q.Group) > 0 {
+		s = fmt.Sprintf("%d from group %s", q.Min, q.Group)
+	}
+	if q.ExcludeRequesterGroups {
+		s = fmt.Sprintf("%s excluding the groups of the requester", s)
+	}
+	return s
+}
+
+// Rule in the form accepted by parseQuorumRules
+func (q *QuorumRule) Spec() string {
+	group := q.Group
+	if len(group) == 0 {
+		group = QUORUM_ANY_GROUP
+	}
+	if q.ExcludeRequesterGroups {
+		return fmt.Sprintf("%s:%d:%s", group, q.Min, QUORUM_EXCLUDE_REQUESTER_GROUPS)
+	}
+	return fmt.Sprintf("%s:%d", group, q.Min)
+}
+
+// Approvals counted per rule, every approver counts towards one rule only and is moved to
+// another rule when that lets more rules be met, e.g. someone in both ops and security
+func assignQuorumApprovers(rules []*QuorumRule, requester *User, approvers []*User) []uint {
+	// Every approval a rule requires is a slot to fill
+	slotRules := make([]int, 0)
+	for i, rule := range rules {
+		for n := uint(0); n < rule.Min; n++ {
+			slotRules = append(slotRules, i)
+		}
+	}
+	slotApprovers := make([]int, len(slotRules))
+	for slot := range slotApprovers {
+		slotApprovers[slot] = -1
+	}
+
+	// Take a free slot or one whose approver can move to another
+	var assign func(approver int, visited []bool) bool
+	assign = func(approver int, visited []bool) bool {
+		for slot, i := range slotRules {
+			if visited[slot] || !rules[i].Counts(requester, approvers[approver]) {
+				continue
+			}
+			visited[slot] = true
+			if slotApprovers[slot] < 0 || assign(slotApprovers[slot], visited) {
+				slotApprovers[slot] = approver
+				return true
+			}
+		}
+		return false
+	}
+	for approver := range approvers {
+		assign(approver, make([]bool, len(slotRules)))
+	}
+
+	counts := make([]uint, len(rules))
+	for slot, approver := range slotApprovers {
+		if approver >= 0 {
+			counts[slotRules[slot]]++
+		}
+	}
+	return counts
+}
+
+// Descriptions of the rules that are not met yet
+func unmetQuorumRules(rules []*QuorumRule, requester *User, approvers []*User) []string {
+	unmet := make([]string, 0)
+	counts := assignQuorumApprovers(rules, requester, approvers)
+	for i, rule := range rules {
+		count := counts[i]
+		if count < rule.Min {
+			unmet = append(unmet, fmt.Sprintf("%s (%d more)", rule, rule.Min-count))
+		}
+	}
+	return unmet
+}
+
+// Rules of the template that the approvals of the request do not meet yet
+func (c *ConsensusRequest) UnmetQuorumRules(template *Template) []string {
+	if template == nil || template.Acl == nil || len(template.Acl.QuorumRules) == 0 {
+		return make([]string, 0)
+	}
+	approvers := make([]*User, 0)
+	for userId := range c.ApproveUserIds {
+		if usr := server.userStore.ById(userId); usr != nil {
+			approvers = append(approvers, usr)
+		}
+	}
+	return unmetQuorumRules(template.Acl.QuorumRules, server.userStore.ById(c.RequestUserId), approvers)
+}
+
+// Parse comma separated rules in the form group:min[:exclude-requester], use * as group for any approver
+func parseQuorumRules(s string) ([]*QuorumRule, error) {
+	rules := make([]*QuorumRule, 0)
+	for _, elm := range splitCommaList(s) {
+		parts := strings.Split(elm, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("Invalid quorum rule %s, use group:min", elm)
+		}
+		rule := &QuorumRule{
+			Group: strings.TrimSpace(parts[0]),
+		}
+		if rule.Group == QUORUM_ANY_GROUP {
+			rule.Group = ""
+		}
+		min, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 0)
+		if err != nil || min < 1 {
+			return nil, fmt.Errorf("Invalid minimum in quorum rule %s", elm)
+		}
+		rule.Min = uint(min)
+		if len(parts) == 3 {
+			if strings.TrimSpace(parts[2]) != QUORUM_EXCLUDE_REQUESTER_GROUPS {
+				return nil, fmt.Errorf("Unknown option in quorum rule %s", elm)
+			}
+			rule.ExcludeRequesterGroups = true
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newQuorumTestUser(groups ...string) *User {
+	usr := newUser()
+	usr.SetGroups(groups)
+	return usr
+}
+
+func TestParseQuorumRules(t *testing.T) {
+	rules, err := parseQuorumRules("ops:1, security:1,*:2:exclude-requester")
+	assert.NoError(t, err)
+	assert.Len(t, rules, 3)
+	assert.Equal(t, "ops", rules[0].Group)
+	assert.Equal(t, uint(1), rules[1].Min)
+	assert.Equal(t, "", rules[2].Group)
+	assert.True(t, rules[2].ExcludeRequesterGroups)
+
+	rules, err = parseQuorumRules("")
+	assert.NoError(t, err)
+	assert.Len(t, rules, 0)
+
+	for _, invalid := range []string{"ops", "ops:0", "ops:x", "ops:1:other"} {
+		_, err = parseQuorumRules(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestQuorumRulesGroups(t *testing.T) {
+	rules, _ := parseQuorumRules("ops:1,security:1")
+	requester := newQuorumTestUser("dev")
+
+	unmet := unmetQuorumRules(rules, requester, []*User{newQuorumTestUser("ops"), newQuorumTestUser("ops")})
+	assert.Equal(t, []string{"1 from group security (1 more)"}, unmet)
+
+	unmet = unmetQuorumRules(rules, requester, []*User{newQuorumTestUser("ops"), newQuorumTestUser("security")})
+	assert.Len(t, unmet, 0)
+}
+
+func TestQuorumRulesApproverInSeveralGroups(t *testing.T) {
+	rules, _ := parseQuorumRules("ops:1,security:1")
+	requester := newQuorumTestUser("dev")
+	both := newQuorumTestUser("ops", "security")
+
+	// One person is one approval
+	unmet := unmetQuorumRules(rules, requester, []*User{both})
+	assert.Len(t, unmet, 1)
+
+	// Counted for security once another approver covers ops, whatever the order
+	unmet = unmetQuorumRules(rules, requester, []*User{both, newQuorumTestUser("ops")})
+	assert.Len(t, unmet, 0)
+	unmet = unmetQuorumRules(rules, requester, []*User{newQuorumTestUser("security"), both})
+	assert.Len(t, unmet, 0)
+
+	// Any approver rule does not reuse the group approvers either
+	rules, _ = parseQuorumRules("ops:1,*:2")
+	unmet = unmetQuorumRules(rules, requester, []*User{both, newQuorumTestUser("ops")})
+	assert.Equal(t, []string{"2 from any group (1 more)"}, unmet)
+}
+
+func TestQuorumRulesExcludeRequesterGroups(t *testing.T) {
+	rules, _ := parseQuorumRules("*:2:exclude-requester")
+	requester := newQuorumTestUser("interns")
+
+	unmet := unmetQuorumRules(rules, requester, []*User{newQuorumTestUser("interns"), newQuorumTestUser("ops")})
+	assert.Len(t, unmet, 1)
+
+	unmet = unmetQuorumRules(rules, requester, []*User{newQuorumTestUser("ops"), newQuorumTestUser()})
+	assert.Len(t, unmet, 0)
+}
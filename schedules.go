@@ -0,0 +1,470 @@
+package main
+
+// Schedules execute a template periodically based on a cron expression, they are approved once through consensus
+// @author Robin Verlangen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedules
+type ScheduleStore struct {
+	Schedules  map[string]*Schedule
+	ConfFile   string
+	SystemUser *User
+	mux        sync.RWMutex
+}
+
+// A schedule consists of a template, a cron expression and the hosts to run on
+type Schedule struct {
+	Id                 string
+	TemplateId         string
+	Cron               string   // minute hour day-of-month month day-of-week
+	TimeZone           string   // Location the cron expression is evaluated in, empty for the server time zone
+	ClientIds          []string // Fixed hosts, if empty the tags are used to select hosts at every run
+	IncludedTags       []string
+	ExcludedTags       []string
+	RequestUserId      string
+	Reason             string
+	ConsensusRequestId string           // Request granting the standing approval
+	Approved           bool             // Standing approval met
+	TemplateVersion    int              // Version of the template the standing approval covers, every run executes it
+	ApproveUserIds     map[string]bool  // Approvals that are copied onto every run
+	ApproveTimes       map[string]int64 // Unix TS of each approval by user id
+	Revoked            bool
+	RevokeUserId       string
+	RevokeTime         int64
+	CreateTime         int64
+	LastRun            int64  // Unix TS of the last run
+	LastRequestId      string // Request created by the last run
+	LastError          string // Why the last run did not start
+	NextRun            int64  // Unix TS of the next run, 0 if there is none
+}
+
+// Get item
+func (s *ScheduleStore) Get(id string) *Schedule {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Schedules[id]
+}
+
+// Add item
+func (s *ScheduleStore) Add(e *Schedule) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.Schedules[e.Id] = e
+}
+
+// Find by template id
+func (s *ScheduleStore) FindByTemplate(id string) []*Schedule {
+	list := make([]*Schedule, 0)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, elm := range s.Schedules {
+		if elm.TemplateId != id || elm.Revoked {
+			continue
+		}
+		list = append(list, elm)
+	}
+	return list
+}
+
+// Grant the standing approval of a consensus request
+func (s *ScheduleStore) Approve(id string, cr *ConsensusRequest) bool {
+	s.mux.Lock()
+	schedule := s.Schedules[id]
+	if schedule == nil || schedule.Revoked || schedule.Approved {
+		s.mux.Unlock()
+		return false
+	}
+	schedule.Approved = true
+	schedule.TemplateVersion = cr.TemplateVersion
+	for userId := range cr.ApproveUserIds {
+		schedule.ApproveUserIds[userId] = true
+		schedule.ApproveTimes[userId] = cr.ApproveTimes[userId]
+	}
+	schedule.updateNextRun(time.Now())
+	s.mux.Unlock()
+
+	audit.Log(nil, "Schedule", fmt.Sprintf("Approved %s through request %s", id, cr.Id))
+	s.save()
+	return true
+}
+
+// Revoke the standing approval
+func (s *ScheduleStore) Revoke(id string, user *User) bool {
+	s.mux.Lock()
+	schedule := s.Schedules[id]
+	if schedule == nil || schedule.Revoked {
+		s.mux.Unlock()
+		return false
+	}
+	schedule.Revoked = true
+	schedule.RevokeUserId = user.Id
+	schedule.RevokeTime = time.Now().Unix()
+	schedule.NextRun = 0
+	s.mux.Unlock()
+
+	audit.Log(user, "Schedule", fmt.Sprintf("Revoked %s", id))
+
+	// No longer ask for approval
+	if cr := server.consensus.Get(schedule.ConsensusRequestId); cr != nil && !cr.Executed {
+		cr.Cancel(user)
+		server.consensus.save()
+	}
+
+	return s.save()
+}
+
+// Start all schedules that are due
+func (s *ScheduleStore) RunDue(now time.Time) {
+	due := make([]*Schedule, 0)
+	s.mux.RLock()
+	for _, schedule := range s.Schedules {
+		if schedule.IsActive() && schedule.NextRun > 0 && schedule.NextRun <= now.Unix() {
+			due = append(due, schedule)
+		}
+	}
+	s.mux.RUnlock()
+	if len(due) == 0 {
+		return
+	}
+
+	for _, schedule := range due {
+		cr, err := s.run(schedule)
+
+		s.mux.Lock()
+		schedule.LastRun = now.Unix()
+		if err != nil {
+			log.Printf("Schedule %s did not run: %s", schedule.Id, err)
+			schedule.LastError = err.Error()
+		} else {
+			audit.Log(nil, "Schedule", fmt.Sprintf("Run %s as request %s", schedule.Id, cr.Id))
+			schedule.LastRequestId = cr.Id
+			schedule.LastError = ""
+		}
+		schedule.updateNextRun(now)
+		s.mux.Unlock()
+	}
+
+	s.save()
+	server.consensus.save()
+}
+
+// Create and start the request of a single run as the system user
+func (s *ScheduleStore) run(schedule *Schedule) (*ConsensusRequest, error) {
+	// Never overlap with the previous run
+	if last := server.consensus.Get(schedule.LastRequestId); last != nil && last.CompleteTime == 0 && (last.StartTime > 0 || len(last.QueuedReason) > 0) {
+		return nil, fmt.Errorf("Previous run %s has not completed", last.Id)
+	}
+
+	clientIds := schedule.Targets()
+	if len(clientIds) == 0 {
+		return nil, errors.New("No clients to run on")
+	}
+
+	// Only the version that was approved, later changes to the template need a new approval
+	s.mux.RLock()
+	templateVersion := schedule.approvedTemplateVersion()
+	s.mux.RUnlock()
+	if templateVersion < 1 {
+		return nil, errors.New("The approved version of the template is unknown, request a new approval")
+	}
+	if server.templateVersionStore.Resolve(schedule.TemplateId, templateVersion) == nil {
+		return nil, fmt.Errorf("The approved version %d of the template is not available", templateVersion)
+	}
+
+	cr, err := server.consensus.AddRequest(schedule.TemplateId, clientIds, s.SystemUser, fmt.Sprintf("Schedule %s: %s", schedule.Id, schedule.Reason))
+	if err != nil {
+		return nil, err
+	}
+	cr.ScheduleId = schedule.Id
+	cr.TemplateVersion = templateVersion
+
+	// Standing approval
+	s.mux.RLock()
+	for userId := range schedule.ApproveUserIds {
+		cr.ApproveUserIds[userId] = true
+		cr.ApproveTimes[userId] = schedule.ApproveTimes[userId]
+	}
+	s.mux.RUnlock()
+
+	// Requirements of the template may have changed since the approval, requests held back by a maintenance window are kept
+	if !cr.check() && !cr.Executed && len(cr.QueuedReason) == 0 {
+		cr.Delete()
+		return nil, errors.New("Standing approval does not meet the template requirements")
+	}
+	return cr, nil
+}
+
+// Version covered by the standing approval, 0 if unknown
+func (s *Schedule) approvedTemplateVersion() int {
+	if s.TemplateVersion > 0 {
+		return s.TemplateVersion
+	}
+	// Approved before the version was kept on the schedule
+	if cr := server.consensus.Get(s.ConsensusRequestId); cr != nil {
+		return cr.TemplateVersion
+	}
+	return 0
+}
+
+// Approved and not revoked
+func (s *Schedule) IsActive() bool {
+	return s.Approved && !s.Revoked
+}
+
+// Hosts to run on
+func (s *Schedule) Targets() []string {
+	if len(s.ClientIds) > 0 {
+		return s.ClientIds
+	}
+	return server.FindClientIds(s.IncludedTags, s.ExcludedTags)
+}
+
+// Tag selection in the form of a tag expression, empty for fixed hosts
+func (s *Schedule) TagExpression() string {
+	if len(s.ClientIds) > 0 {
+		return ""
+	}
+	parts := make([]string, 0)
+	for _, tag := range s.IncludedTags {
+		parts = append(parts, tag)
+	}
+	for _, tag := range s.ExcludedTags {
+		parts = append(parts, fmt.Sprintf("NOT %s", tag))
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// Parsed cron expression in the time zone of the schedule
+func (s *Schedule) CronSchedule() (*CronSchedule, error) {
+	location := time.Local
+	if len(s.TimeZone) > 0 {
+		var err error
+		location, err = time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown time zone %s", s.TimeZone)
+		}
+	}
+	return parseCron(s.Cron, location)
+}
+
+func (s *Schedule) updateNextRun(now time.Time) {
+	s.NextRun = 0
+	if !s.IsActive() {
+		return
+	}
+	c, err := s.CronSchedule()
+	if err != nil {
+		log.Printf("Schedule %s is invalid: %s", s.Id, err)
+		return
+	}
+	if next := c.Next(now); !next.IsZero() {
+		s.NextRun = next.Unix()
+	}
+}
+
+// Validate
+func (s *Schedule) IsValid() (bool, error) {
+	if server.templateStore.Get(s.TemplateId) == nil {
+		return false, errors.New("Template not found")
+	}
+	if _, err := s.CronSchedule(); err != nil {
+		return false, err
+	}
+	if len(s.ClientIds) == 0 && len(s.IncludedTags) == 0 {
+		return false, errors.New("Select clients or tags to run on")
+	}
+	return true, nil
+}
+
+// Save to disk
+func (s *ScheduleStore) save() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, je := json.Marshal(s.Schedules)
+	if je != nil {
+		log.Printf("Failed to write schedules: %s", je)
+		return false
+	}
+	err := ioutil.WriteFile(s.ConfFile, bytes, 0644)
+	if err != nil {
+		log.Printf("Failed to write schedules: %s", err)
+		return false
+	}
+	return true
+}
+
+// Load from disk
+func (s *ScheduleStore) load() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, err := ioutil.ReadFile(s.ConfFile)
+	if err == nil {
+		var v map[string]*Schedule
+		je := json.Unmarshal(bytes, &v)
+		if je != nil {
+			log.Printf("Invalid schedules.json: %s", je)
+			return
+		}
+		s.Schedules = v
+	}
+}
+
+// List schedules
+func GetSchedules(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.scheduleStore.mux.RLock()
+	jr.Set("schedules", server.scheduleStore.Schedules)
+	server.scheduleStore.mux.RUnlock()
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Create schedule, it will only run after approval through consensus
+func PostSchedule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Are we allow to request execution?
+	user := getUser(r)
+	if !user.HasRole("requester") {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Verify two factor for, so that a hacked account can not request or execute anything without getting access to the 2fa device
+	if res, _ := user.ValidateTotp(r.PostFormValue("totp")); res == false {
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Reason
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if len(reason) < 4 {
+		jr.Error("Please provide a valid reason")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Create
+	schedule := newSchedule()
+	schedule.TemplateId = strings.TrimSpace(r.PostFormValue("template"))
+	schedule.Cron = strings.TrimSpace(r.PostFormValue("cron"))
+	schedule.TimeZone = strings.TrimSpace(r.PostFormValue("timezone"))
+	schedule.ClientIds = splitCommaList(r.PostFormValue("clients"))
+	schedule.IncludedTags = splitCommaList(r.PostFormValue("includedTags"))
+	schedule.ExcludedTags = splitCommaList(r.PostFormValue("excludedTags"))
+	schedule.RequestUserId = user.Id
+	schedule.Reason = reason
+	if valid, err := schedule.IsValid(); !valid {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Request the standing approval, approvers see the tags the hosts are selected by at every run
+	description := fmt.Sprintf("Schedule '%s'", schedule.Cron)
+	expression := schedule.TagExpression()
+	if len(expression) > 0 {
+		description = fmt.Sprintf("%s on %s", description, expression)
+	}
+	cr, err := server.consensus.AddRequest(schedule.TemplateId, schedule.ClientIds, user, fmt.Sprintf("%s: %s", description, reason))
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if e, err := parseTagExpression(expression); len(expression) > 0 && err == nil {
+		cr.TargetExpression = e.String()
+	}
+	cr.ApprovesScheduleId = schedule.Id
+	schedule.ConsensusRequestId = cr.Id
+	audit.Log(user, "Schedule", fmt.Sprintf("Created %s for template %s at '%s'", schedule.Id, schedule.TemplateId, schedule.Cron))
+
+	// Add and save
+	server.scheduleStore.Add(schedule)
+	server.scheduleStore.save()
+	cr.check() // Check whether it is approved straight away
+	server.consensus.save()
+
+	jr.Set("id", schedule.Id)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Revoke schedule
+func DeleteSchedule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Must be admin
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("Not authorized")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	if server.scheduleStore.Get(id) == nil {
+		jr.Error("Schedule not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	res := server.scheduleStore.Revoke(id, user)
+	jr.Set("revoked", res)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// New store
+func newScheduleStore() *ScheduleStore {
+	systemUser := newSystemUser("scheduler")
+	s := &ScheduleStore{
+		ConfFile:   conf.HomeFile("schedules.json"),
+		Schedules:  make(map[string]*Schedule),
+		SystemUser: systemUser,
+	}
+	s.load()
+	return s
+}
+
+// New schedule
+func newSchedule() *Schedule {
+	return &Schedule{
+		Id:             uuidStr(),
+		ClientIds:      make([]string, 0),
+		IncludedTags:   make([]string, 0),
+		ExcludedTags:   make([]string, 0),
+		ApproveUserIds: make(map[string]bool),
+		ApproveTimes:   make(map[string]int64),
+		CreateTime:     time.Now().Unix(),
+	}
+}
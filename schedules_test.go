@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestScheduleNextRun(t *testing.T) {
+	schedule := newSchedule()
+	schedule.Cron = "30 2 * * *"
+	schedule.TimeZone = "UTC"
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Nothing planned without approval
+	schedule.updateNextRun(now)
+	assert.Equal(t, int64(0), schedule.NextRun)
+
+	schedule.Approved = true
+	schedule.updateNextRun(now)
+	assert.Equal(t, time.Date(2016, 1, 2, 2, 30, 0, 0, time.UTC).Unix(), schedule.NextRun)
+
+	schedule.Revoked = true
+	schedule.updateNextRun(now)
+	assert.Equal(t, int64(0), schedule.NextRun)
+}
+
+func TestScheduleInvalidTimeZone(t *testing.T) {
+	schedule := newSchedule()
+	schedule.Cron = "@daily"
+	schedule.TimeZone = "Nowhere/Invalid"
+	_, err := schedule.CronSchedule()
+	assert.Error(t, err)
+}
+
+func TestSplitCommaList(t *testing.T) {
+	assert.Equal(t, []string{}, splitCommaList(""))
+	assert.Equal(t, []string{"a", "b"}, splitCommaList("a, ,b,"))
+}
+
+func TestScheduleTagExpression(t *testing.T) {
+	schedule := newSchedule()
+	schedule.IncludedTags = []string{"web", "prod"}
+	schedule.ExcludedTags = []string{"canary"}
+	assert.Equal(t, "web AND prod AND NOT canary", schedule.TagExpression())
+	e, err := parseTagExpression(schedule.TagExpression())
+	assert.Nil(t, err)
+	assert.True(t, (&RegisteredClient{Tags: []string{"prod", "web"}}).MatchesExpression(e))
+	assert.False(t, (&RegisteredClient{Tags: []string{"prod", "web", "canary"}}).MatchesExpression(e))
+
+	// Fixed hosts
+	schedule.ClientIds = []string{"a"}
+	assert.Equal(t, "", schedule.TagExpression())
+}
+
+func TestScheduleRunsApprovedVersion(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	template := newTemplate("title", "description", "echo 1", true, []string{}, []string{}, 2, 10, nil)
+	template.Version = 2
+	approval := newConsensusRequest()
+	approval.TemplateVersion = 1
+	server = &Server{
+		templateStore:        &TemplateStore{Templates: map[string]*Template{template.Id: template}},
+		templateVersionStore: &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)},
+		consensus:            &Consensus{Pending: map[string]*ConsensusRequest{approval.Id: approval}},
+	}
+	store := &ScheduleStore{Schedules: make(map[string]*Schedule)}
+
+	schedule := newSchedule()
+	schedule.TemplateId = template.Id
+	schedule.ClientIds = []string{"a"}
+
+	// Unknown what was approved
+	_, err := store.run(schedule)
+	assert.Error(t, err)
+
+	// Schedules approved before the version was kept use the version of their approval
+	schedule.ConsensusRequestId = approval.Id
+	assert.Equal(t, 1, schedule.approvedTemplateVersion())
+
+	// The template changed after the approval
+	_, err = store.run(schedule)
+	assert.EqualError(t, err, "The approved version 1 of the template is not available")
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/RobinUS2/golang-jresp"
 	"github.com/julienschmidt/httprouter"
@@ -20,6 +21,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,12 +37,17 @@ type Server struct {
 	Tags    map[string]bool
 	tagsMux sync.RWMutex
 
-	userStore            *UserStore
-	templateStore        *TemplateStore
-	consensus            *Consensus
-	executionCoordinator *ExecutionCoordinator
-	httpCheckStore       *HttpCheckStore
-	authService          *AuthService
+	userStore              *UserStore
+	templateStore          *TemplateStore
+	templateVersionStore   *TemplateVersionStore
+	templateSync           *TemplateSync
+	consensus              *Consensus
+	executionCoordinator   *ExecutionCoordinator
+	httpCheckStore         *HttpCheckStore
+	scheduleStore          *ScheduleStore
+	maintenanceWindowStore *MaintenanceWindowStore
+	authService            *AuthService
+	notifier               *Notifier
 
 	InstanceId string // Unique ID generated at startup of the server, used for re-authentication and client-side refresh after and update/restart
 }
@@ -80,6 +87,37 @@ func (s *Server) GetClient(clientId string) *RegisteredClient {
 	return s.clients[clientId]
 }
 
+// Dispatched commands of a consensus request across all clients
+func (s *Server) GetRequestCmds(consensusRequestId string) []*Cmd {
+	cmds := make([]*Cmd, 0)
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+	for _, client := range s.clients {
+		client.mux.RLock()
+		for _, cmd := range client.DispatchedCmds {
+			if cmd.ConsensusRequestId == consensusRequestId {
+				cmds = append(cmds, cmd)
+			}
+		}
+		client.mux.RUnlock()
+	}
+	return cmds
+}
+
+// Ids of the clients matching the tag filters
+func (s *Server) FindClientIds(tagsInclude []string, tagsExclude []string) []string {
+	clientIds := make([]string, 0)
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+	for _, client := range s.clients {
+		if client.MatchesTags(tagsInclude, tagsExclude) {
+			clientIds = append(clientIds, client.ClientId)
+		}
+	}
+	sort.Strings(clientIds)
+	return clientIds
+}
+
 // Scan for old clients
 func (s *Server) CleanupClients() {
 	s.clientsMux.Lock()
@@ -101,6 +139,7 @@ func (client *RegisteredClient) Submit(cmd *Cmd) {
 	client.Cmds[cmd.Id] = cmd
 
 	// Keep track of command status
+	cmd.Dispatched = time.Now().Unix()
 	client.DispatchedCmds[cmd.Id] = cmd
 
 	client.mux.Unlock()
@@ -119,6 +158,7 @@ type RegisteredClient struct {
 	AuthToken string `json:"-"` // Do not add to JSON
 	LastPing  time.Time
 	Tags      []string
+	Facts     *ClientFacts // Reported by the client, nil until it did
 
 	// Dispatched commands to the client
 	DispatchedCmds map[string]*Cmd
@@ -166,6 +206,24 @@ func (c *RegisteredClient) GetDispatchedCmds() map[string]*Cmd {
 	return newMap
 }
 
+// Does it have all included tags and none of the excluded ones?
+func (c *RegisteredClient) MatchesTags(tagsInclude []string, tagsExclude []string) bool {
+	// Excluded? One match is enough to skip this one
+	for _, exclude := range tagsExclude {
+		if c.HasTag(exclude) {
+			return false
+		}
+	}
+
+	// Included? Must have all
+	for _, include := range tagsInclude {
+		if !c.HasTag(include) {
+			return false
+		}
+	}
+	return true
+}
+
 // Does this register client have this tag?
 func (c *RegisteredClient) HasTag(s string) bool {
 	if c.Tags == nil {
@@ -292,8 +350,16 @@ func (s *Server) Start() bool {
 
 	s.authService = createAuthService(s.userStore)
 
+	// Notifications
+	s.notifier = newNotifier()
+
 	// Templates
 	s.templateStore = newTemplateStore()
+	s.templateVersionStore = newTemplateVersionStore()
+	if s.templateVersionStore.ensureVersions(s.templateStore) {
+		s.templateVersionStore.save()
+		s.templateStore.save()
+	}
 
 	// Consensus handler
 	s.consensus = newConsensus()
@@ -304,6 +370,20 @@ func (s *Server) Start() bool {
 	// HTTP checks
 	s.httpCheckStore = newHttpCheckStore()
 
+	// Scheduled executions
+	s.scheduleStore = newScheduleStore()
+
+	// Maintenance windows
+	s.maintenanceWindowStore = newMaintenanceWindowStore()
+
+	// Templates from a directory
+	if len(conf.TemplateSyncDir) > 0 {
+		s.templateSync = newTemplateSync(conf.TemplateSyncDir)
+		if err := s.templateSync.Start(); err != nil {
+			log.Printf("Failed to watch template directory %s: %s", conf.TemplateSyncDir, err)
+		}
+	}
+
 	// Print info
 	log.Printf("Starting server at https://localhost:%d/", conf.ServerPort)
 
@@ -325,6 +405,7 @@ func (s *Server) Start() bool {
 		router.GET("/client/:clientId/cmds", ClientCmds)
 		router.PUT("/client/:clientId/cmd/:cmd/state", PutClientCmdState)
 		router.PUT("/client/:clientId/cmd/:cmd/logs", PutClientCmdLogs)
+		router.PUT("/client/:clientId/facts", PutClientFacts)
 		router.GET("/client/:clientId/cmd/:cmd/logs", GetClientCmdLogs)
 		router.POST("/client/:clientId/auth", PostClientAuth)
 
@@ -333,9 +414,21 @@ func (s *Server) Start() bool {
 
 		// Templates
 		router.GET("/templates", GetTemplate)
+		router.GET("/templates/export", GetTemplatesExport)
+		router.POST("/templates/import", PostTemplatesImport)
+		router.GET("/templates/sync", GetTemplatesSync)
+		router.POST("/templates/sync", PostTemplatesSync)
 		router.POST("/template/:templateid/validation", PostTemplateValidation)
 		router.DELETE("/template/:templateid/validation/:id", DeleteTemplateValidation)
+		router.GET("/template/:templateid/versions", GetTemplateVersions)
+		router.GET("/template/:templateid/diff", GetTemplateDiff)
+		router.POST("/template/:templateid/restore", PostTemplateRestore)
+		router.POST("/template/:templateid/disable", PostTemplateDisable)
+		router.POST("/template/:templateid/enable", PostTemplateEnable)
 		router.POST("/template", PostTemplate)
+		router.POST("/templates/search", PostTemplatesSearch)
+		router.GET("/templates/categories", GetTemplateCategories)
+		router.PUT("/template/:templateid", PutTemplate)
 		router.DELETE("/template", DeleteTemplate)
 
 		// Update password
@@ -343,6 +436,7 @@ func (s *Server) Start() bool {
 
 		// List clients (~ slaves)
 		router.GET("/clients", GetClients)
+		router.GET("/clients/preview", GetClientsPreview)
 
 		// List users
 		router.GET("/users", GetUsers)
@@ -361,12 +455,23 @@ func (s *Server) Start() bool {
 
 		// Consensus requests
 		router.POST("/consensus/request", PostConsensusRequest)
+		router.PUT("/consensus/request", PutConsensusRequest)
 		router.DELETE("/consensus/request", DeleteConsensusRequest)
 		router.POST("/consensus/approve", PostConsensusApprove)
+		router.POST("/consensus/reject", PostConsensusReject)
+		router.POST("/consensus/breakglass", PostConsensusBreakGlass)
+		router.GET("/consensus/breakglass/reviews", GetConsensusBreakGlassReviews)
+		router.POST("/consensus/breakglass/review", PostConsensusBreakGlassReview)
 		router.GET("/consensus/pending", GetConsensusPending)
+		router.GET("/consensus/request/:id/report", GetConsensusRequestReport)
+		router.GET("/consensus/request/:id/comments", GetConsensusComments)
+		router.POST("/consensus/request/:id/comment", PostConsensusComment)
+		router.PUT("/consensus/request/:id/comment/:commentid", PutConsensusComment)
+		router.POST("/consensus/override", PostConsensusOverride)
 
 		// Dispatched commands list
 		router.POST("/dispatched", data_table.DefaultStoreHandler(DispatchedCmdQuery))
+		router.POST("/consensus/history", PostConsensusHistory)
 
 		// Http checks
 		router.GET("/http-check/:id", GetHttpCheck)
@@ -374,9 +479,20 @@ func (s *Server) Start() bool {
 		router.POST("/http-check", PostHttpCheck)
 		router.DELETE("/http-check", DeleteHttpCheck)
 
+		// Schedules
+		router.GET("/schedules", GetSchedules)
+		router.POST("/schedule", PostSchedule)
+		router.DELETE("/schedule", DeleteSchedule)
+
+		// Maintenance windows
+		router.GET("/maintenance-windows", GetMaintenanceWindows)
+		router.POST("/maintenance-window", PostMaintenanceWindow)
+		router.DELETE("/maintenance-window", DeleteMaintenanceWindow)
+
 		// Two factor auth
 		router.GET("/user/2fa", GetUser2fa)
 		router.PUT("/user/2fa", PutUser2fa)
+		router.POST("/user/stepup", PostUserStepUp)
 
 		// Backup
 		router.GET("/backup/configs.zip", GetBackupConfigs)
@@ -399,6 +515,10 @@ func (s *Server) Start() bool {
 		c := time.Tick(1 * time.Minute)
 		for _ = range c {
 			server.CleanupClients()
+			server.scheduleStore.RunDue(time.Now())
+			server.consensus.StartQueued()
+			server.consensus.ExpirePending(time.Now().Unix())
+			server.consensus.CheckBreakGlassReviews(time.Now().Unix())
 		}
 	}()
 
@@ -593,8 +713,8 @@ func GetConsensusPending(w http.ResponseWriter, r *http.Request, ps httprouter.P
 	pending := make([]*ConsensusRequest, 0)
 	work := make([]*ConsensusRequest, 0)
 	for _, req := range server.consensus.Pending {
-		// Ignore already executed
-		if req.Executed {
+		// Ignore already executed, cancelled and expired
+		if req.Executed || req.IsFinal() {
 			continue
 		}
 
@@ -610,8 +730,37 @@ func GetConsensusPending(w http.ResponseWriter, r *http.Request, ps httprouter.P
 			continue
 		}
 
+		// Only work we are allowed to vote on
+		if !req.CanVote(user) {
+			continue
+		}
+
 		work = append(work, req)
 	}
+
+	// Explain which quorum rules are still unmet, and what approvers should look out for
+	unmet := make(map[string][]string)
+	lintWarnings := make(map[string][]*TemplateLintWarning)
+	targetPreview := make(map[string][]string) // Clients tag expressions would resolve to right now
+	for _, req := range append(pending, work...) {
+		template := req.Template()
+		if rules := req.UnmetQuorumRules(template); len(rules) > 0 {
+			unmet[req.Id] = rules
+		}
+		if len(req.TargetExpression) > 0 && template != nil {
+			if e, err := parseTagExpression(req.TargetExpression); err == nil {
+				targetPreview[req.Id] = server.FindClientIdsByExpression(e, template.Acl)
+			}
+		}
+		if template != nil {
+			if warnings := lintTemplate(template); len(warnings) > 0 {
+				lintWarnings[req.Id] = warnings
+			}
+		}
+	}
+	jr.Set("unmet_quorum_rules", unmet)
+	jr.Set("lint_warnings", lintWarnings)
+	jr.Set("target_preview", targetPreview)
 	jr.Set("requests", pending)
 	jr.Set("server_instance_id", server.InstanceId)
 	jr.Set("work", work)
@@ -637,6 +786,13 @@ func PostConsensusApprove(w http.ResponseWriter, r *http.Request, ps httprouter.
 		return
 	}
 
+	// Recent second factor proof
+	if !checkStepUp(user, r, STEP_UP_CONSENSUS_APPROVE) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
 	// Vote
 	id := strings.TrimSpace(r.PostFormValue("id"))
 	req := server.consensus.Get(id)
@@ -648,11 +804,106 @@ func PostConsensusApprove(w http.ResponseWriter, r *http.Request, ps httprouter.
 	res := req.Approve(user)
 	server.consensus.save()
 
+	// Blocked by a maintenance window?
+	if len(req.QueuedReason) > 0 {
+		jr.Set("queued", req.QueuedReason)
+	} else if req.Executed && len(req.HaltReason) > 0 {
+		jr.Error(req.HaltReason)
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
 	jr.Set("approved", res)
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
 }
 
+// Reject execution request
+func PostConsensusReject(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostConsensusReject")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	user := getUser(r)
+	if !user.HasRole("approver") {
+		jr.Error("User not allowed for PostConsensusReject")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Recent second factor proof
+	if !checkStepUp(user, r, STEP_UP_CONSENSUS_REJECT) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Reason
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if len(reason) < 4 {
+		jr.Error("Please provide a valid reason")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Vote
+	id := strings.TrimSpace(r.PostFormValue("id"))
+	req := server.consensus.Get(id)
+	if req == nil {
+		jr.Error("Request not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	res := req.Reject(user, reason)
+	server.consensus.save()
+
+	jr.Set("rejected", res)
+	jr.Set("state", req.State)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Force execution of a request regardless of maintenance windows
+func PostConsensusOverride(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostConsensusOverride")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("User not allowed for PostConsensusOverride")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Verify two factor, this bypasses change freezes
+	if res, _ := user.ValidateTotp(r.PostFormValue("totp")); res == false {
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	id := strings.TrimSpace(r.PostFormValue("id"))
+	req := server.consensus.Get(id)
+	if req == nil {
+		jr.Error("Request not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	res := req.Override(user)
+	server.consensus.save()
+
+	jr.Set("overridden", res)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
 // Cancel execution request
 func DeleteConsensusRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
@@ -731,13 +982,39 @@ func PostConsensusRequest(w http.ResponseWriter, r *http.Request, ps httprouter.
 
 	// Template
 	templateId := strings.TrimSpace(r.PostFormValue("template"))
-	clientIds := strings.Split(strings.TrimSpace(r.PostFormValue("clients")), ",")
+	clientIds := splitCommaList(r.PostFormValue("clients"))
+	expression := strings.TrimSpace(r.PostFormValue("targets"))
+	if len(clientIds) == 0 && len(expression) == 0 {
+		jr.Error("Please provide at least one client or a tag expression")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
-	// Create request
-	cr := server.consensus.AddRequest(templateId, clientIds, user, reason)
+	// Create request, a tag expression is resolved again when execution starts
+	var cr *ConsensusRequest
+	var err error
+	if len(expression) > 0 {
+		cr, err = server.consensus.AddExpressionRequest(templateId, expression, user, reason)
+	} else {
+		cr, err = server.consensus.AddRequest(templateId, clientIds, user, reason)
+	}
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 	cr.check() // Check whether it can run straight away
 	server.consensus.save()
 
+	// Blocked by a maintenance window?
+	if len(cr.QueuedReason) > 0 {
+		jr.Set("queued", cr.QueuedReason)
+	} else if cr.Executed && len(cr.HaltReason) > 0 {
+		jr.Error(cr.HaltReason)
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
 }
@@ -762,22 +1039,36 @@ func PostTemplateValidation(w http.ResponseWriter, r *http.Request, ps httproute
 
 	// Input
 	txt := r.PostFormValue("text")
+	value := r.PostFormValue("value")
+	ruleType := strings.TrimSpace(r.PostFormValue("type"))
 	isFatal := r.PostFormValue("fatal") == "1"
 	mustContain := r.PostFormValue("must_contain") == "1"
-	streamId := 1 // Default process output stream only
-
-	// Text must have length
-	if len(strings.TrimSpace(txt)) < 1 {
-		jr.Error("Text can not be empty")
+	streamId, streamE := parseOutputStream(r.PostFormValue("stream"))
+	if streamE != nil {
+		jr.Error(fmt.Sprintf("%s", streamE))
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
 
 	// Create rule
-	rule := newExecutionValidation(txt, isFatal, mustContain, streamId)
+	rule, ruleE := newExecutionValidation(ruleType, txt, value, isFatal, mustContain, streamId)
+	if ruleE != nil {
+		jr.Error(fmt.Sprintf("%s", ruleE))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
-	// Add rule
-	template.AddValidationRule(rule)
+	// Add rule, to a copy that is published once its version exists
+	updated := cloneTemplate(template)
+	if updated == nil {
+		jr.Error("Failed to copy template")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	updated.AddValidationRule(rule)
+	server.templateVersionStore.Snapshot(updated, getUser(r).Id, fmt.Sprintf("Added validation rule %s", rule.Id))
+	server.templateStore.Add(updated)
+	server.templateVersionStore.save()
 
 	// Save
 	res := server.templateStore.save()
@@ -809,8 +1100,17 @@ func DeleteTemplateValidation(w http.ResponseWriter, r *http.Request, ps httprou
 	// Validaton rule id
 	id := ps.ByName("id")
 
-	// Delete rule
-	template.DeleteValidationRule(id)
+	// Delete rule, from a copy that is published once its version exists
+	updated := cloneTemplate(template)
+	if updated == nil {
+		jr.Error("Failed to copy template")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	updated.DeleteValidationRule(id)
+	server.templateVersionStore.Snapshot(updated, getUser(r).Id, fmt.Sprintf("Deleted validation rule %s", id))
+	server.templateStore.Add(updated)
+	server.templateVersionStore.save()
 
 	// Save
 	res := server.templateStore.save()
@@ -853,85 +1153,278 @@ func PostTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		return
 	}
 
-	title := strings.TrimSpace(r.PostFormValue("title"))
-	description := strings.TrimSpace(r.PostFormValue("description"))
-	command := r.PostFormValue("command")
-	includedTags := r.PostFormValue("includedTags")
-	excludedTags := r.PostFormValue("excludedTags")
-	executionStrategyStr := r.PostFormValue("executionStrategy")
-
-	// Create strategy
-	var executionStrategy *ExecutionStrategy
-	switch executionStrategyStr {
-	case "simple":
-		executionStrategy = newExecutionStrategy(SimpleExecutionStrategy)
-		break
-	case "one-test":
-		executionStrategy = newExecutionStrategy(OneTestExecutionStrategy)
-		break
-	case "rolling":
-		executionStrategy = newExecutionStrategy(RollingExecutionStrategy)
-		break
-	case "exponential-rolling":
-		executionStrategy = newExecutionStrategy(ExponentialRollingExecutionStrategy)
-		break
-	default:
-		jr.Error("Strategy not found")
+	// Recent second factor proof
+	if !checkStepUp(user, r, STEP_UP_TEMPLATE_CREATE) {
+		jr.Error("Confirm this action with your two factor token")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
 
-	// Minimum authorizations
-	minAuthStr := strings.TrimSpace(r.PostFormValue("minAuth"))
-	minAuth, minAuthE := strconv.ParseInt(minAuthStr, 10, 0)
-	if len(minAuthStr) < 1 {
-		jr.Error("Fill in min auth")
+	template, formE := templateFromForm(r)
+	if formE != nil {
+		jr.Error(fmt.Sprintf("%s", formE))
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
-	} else if minAuthE != nil {
-		jr.Error(fmt.Sprintf("%s", minAuthE))
+	}
+	valid, err := template.IsValid()
+	if !valid {
+		jr.Error(fmt.Sprintf("%s", err))
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
-	} else if minAuth < 1 {
-		jr.Error("Min auth must be at least 1")
+	}
+	lintWarnings := lintTemplate(template)
+	if err := lintBlockingError(lintWarnings); err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
 
-	// Timeout
-	timeoutStr := strings.TrimSpace(r.PostFormValue("timeout"))
-	timeout, timeoutE := strconv.ParseInt(timeoutStr, 10, 0)
-	if len(timeoutStr) < 1 {
-		jr.Error("Fill in timeout")
+	server.templateVersionStore.Snapshot(template, user.Id, "Created")
+	server.templateStore.Add(template)
+	server.templateVersionStore.save()
+	server.templateStore.save()
+	jr.Set("template", template)
+	jr.Set("lint_warnings", lintWarnings)
+	jr.Set("saved", true)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Update template in place, pending requests are pinned to the previous version or invalidated
+func PutTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PutTemplate")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
-	} else if timeoutE != nil {
-		jr.Error(fmt.Sprintf("%s", timeoutE))
+	}
+
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("User not allowed to PutTemplate")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
-	} else if timeout < 1 {
-		jr.Error("Timeout must be at least 1 second")
+	}
+
+	// Recent second factor proof
+	if !checkStepUp(user, r, STEP_UP_TEMPLATE_UPDATE) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	existing := server.templateStore.Get(ps.ByName("templateid"))
+	if existing == nil {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// What happens to requests that are not executed yet
+	invalidate := false
+	switch strings.TrimSpace(r.PostFormValue("pending")) {
+	case "", "pin":
+	case "invalidate":
+		invalidate = true
+	default:
+		jr.Error("Pending must be pin or invalidate")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
 
-	// Validate template
-	template := newTemplate(title, description, command, true, strings.Split(includedTags, ","), strings.Split(excludedTags, ","), uint(minAuth), int(timeout), executionStrategy)
+	template, formE := templateFromForm(r)
+	if formE != nil {
+		jr.Error(fmt.Sprintf("%s", formE))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	template.Id = existing.Id
+	existing.mux.RLock()
+	template.ValidationRules = existing.ValidationRules
+	template.Version = existing.Version
+	template.Source = existing.Source
+	template.Enabled = existing.Enabled // Only changed through disable and enable
+	template.Disabled = existing.Disabled
+	existing.mux.RUnlock()
 	valid, err := template.IsValid()
 	if !valid {
 		jr.Error(fmt.Sprintf("%s", err))
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
+	lintWarnings := lintTemplate(template)
+	if err := lintBlockingError(lintWarnings); err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	diff := diffTemplates(existing, template)
+	if len(diff) == 0 {
+		jr.Error("Nothing changed")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	fields := make([]string, 0)
+	for _, elm := range diff {
+		fields = append(fields, elm.Field)
+	}
+
+	// Pending requests
+	pending := server.consensus.UnexecutedForTemplate(template.Id)
+	for _, cr := range pending {
+		if invalidate {
+			cr.Invalidate(user, fmt.Sprintf("Template %s was changed", existing.Title))
+		} else if cr.TemplateVersion < 1 {
+			cr.TemplateVersion = existing.Version
+		}
+	}
 
+	// Versioned before it is published, requests of the previous version keep resolving to it
+	version := server.templateVersionStore.Snapshot(template, user.Id, fmt.Sprintf("Updated %s", strings.Join(fields, ", ")))
 	server.templateStore.Add(template)
+	server.templateVersionStore.save()
 	server.templateStore.save()
+	server.consensus.save()
+	audit.Log(user, "Template", fmt.Sprintf("Updated %s to version %d: %s", template.Id, version.Version, strings.Join(fields, ", ")))
+
 	jr.Set("template", template)
+	jr.Set("diff", diff)
+	jr.Set("lint_warnings", lintWarnings)
+	if invalidate {
+		jr.Set("invalidated", len(pending))
+	} else {
+		jr.Set("pinned", len(pending))
+	}
 	jr.Set("saved", true)
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
 }
 
+// Template from the create and update form, not yet validated
+func templateFromForm(r *http.Request) (*Template, error) {
+	title := strings.TrimSpace(r.PostFormValue("title"))
+	description := strings.TrimSpace(r.PostFormValue("description"))
+	command := r.PostFormValue("command")
+	includedTags := r.PostFormValue("includedTags")
+	excludedTags := r.PostFormValue("excludedTags")
+	rollbackTemplateId := strings.TrimSpace(r.PostFormValue("rollbackTemplate"))
+
+	// Create strategy
+	executionStrategy, strategyE := parseExecutionStrategy(r.PostFormValue("executionStrategy"))
+	if strategyE != nil {
+		return nil, strategyE
+	}
+
+	// Minimum authorizations
+	minAuthStr := strings.TrimSpace(r.PostFormValue("minAuth"))
+	minAuth, minAuthE := strconv.ParseInt(minAuthStr, 10, 0)
+	if len(minAuthStr) < 1 {
+		return nil, errors.New("Fill in min auth")
+	} else if minAuthE != nil {
+		return nil, minAuthE
+	} else if minAuth < 1 {
+		return nil, errors.New("Min auth must be at least 1")
+	}
+
+	// Timeout
+	timeoutStr := strings.TrimSpace(r.PostFormValue("timeout"))
+	timeout, timeoutE := strconv.ParseInt(timeoutStr, 10, 0)
+	if len(timeoutStr) < 1 {
+		return nil, errors.New("Fill in timeout")
+	} else if timeoutE != nil {
+		return nil, timeoutE
+	} else if timeout < 1 {
+		return nil, errors.New("Timeout must be at least 1 second")
+	}
+
+	// Health probe between batches
+	var healthProbe *HealthProbe
+	if probeType := strings.TrimSpace(r.PostFormValue("probeType")); len(probeType) > 0 {
+		healthProbe = newHealthProbe(probeType)
+		healthProbe.Uri = strings.TrimSpace(r.PostFormValue("probeUri"))
+		healthProbe.ExpectedStatus = cast.ToInt(r.PostFormValue("probeExpectedStatus"))
+		healthProbe.ExpectedBody = r.PostFormValue("probeExpectedBody")
+		healthProbe.Address = strings.TrimSpace(r.PostFormValue("probeAddress"))
+		healthProbe.TemplateId = strings.TrimSpace(r.PostFormValue("probeTemplate"))
+		if probeTimeout := cast.ToInt(r.PostFormValue("probeTimeout")); probeTimeout > 0 {
+			healthProbe.Timeout = probeTimeout
+		}
+		if probeInterval := cast.ToInt(r.PostFormValue("probeInterval")); probeInterval > 0 {
+			healthProbe.Interval = probeInterval
+		}
+		if valid, err := healthProbe.IsValid(); !valid {
+			return nil, err
+		}
+	}
+
+	// Enabled unless explicitly disabled
+	enabled := true
+	if enabledStr := strings.TrimSpace(r.PostFormValue("enabled")); len(enabledStr) > 0 {
+		enabled = cast.ToBool(enabledStr)
+	}
+
+	template := newTemplate(title, description, command, enabled, strings.Split(includedTags, ","), strings.Split(excludedTags, ","), uint(minAuth), int(timeout), executionStrategy)
+	template.RollbackTemplateId = rollbackTemplateId
+	template.HealthProbe = healthProbe
+	template.Slug = strings.TrimSpace(r.PostFormValue("slug"))
+	if len(template.Slug) > 0 && !templateSlugRegexp.MatchString(template.Slug) {
+		return nil, errors.New("Slug can only contain lowercase letters, digits and dashes")
+	}
+	template.Acl.ApprovalDeadline = cast.ToInt(r.PostFormValue("approvalDeadline"))
+	if template.Acl.ApprovalDeadline < 0 {
+		return nil, errors.New("Approval deadline can not be negative")
+	}
+	minReject := cast.ToInt(r.PostFormValue("minReject"))
+	if minReject < 0 {
+		return nil, errors.New("Min reject can not be negative")
+	}
+	template.Acl.MinReject = uint(minReject)
+	template.Acl.VetoRoles = splitCommaList(r.PostFormValue("vetoRoles"))
+	quorumRules, quorumRulesE := parseQuorumRules(r.PostFormValue("quorumRules"))
+	if quorumRulesE != nil {
+		return nil, quorumRulesE
+	}
+	template.Acl.QuorumRules = quorumRules
+
+	// Blast radius
+	template.Acl.MaxTargets = cast.ToInt(r.PostFormValue("maxTargets"))
+	template.Acl.MaxTargetsPercent = cast.ToInt(r.PostFormValue("maxTargetsPercent"))
+	exceedMinAuth := cast.ToInt(r.PostFormValue("exceedMinAuth"))
+	if exceedMinAuth < 0 {
+		return nil, errors.New("Authorizations over the target limit can not be negative")
+	}
+	template.Acl.ExceedMinAuth = uint(exceedMinAuth)
+	if valid, err := template.Acl.IsValidTargetLimit(); !valid {
+		return nil, err
+	}
+
+	// Eligible requesters and approvers
+	var usersE error
+	if template.Acl.RequesterUserIds, usersE = userIdsByName(r.PostFormValue("requesterUsers")); usersE != nil {
+		return nil, usersE
+	}
+	if template.Acl.ApproverUserIds, usersE = userIdsByName(r.PostFormValue("approverUsers")); usersE != nil {
+		return nil, usersE
+	}
+	template.Acl.RequesterGroups = splitCommaList(r.PostFormValue("requesterGroups"))
+	template.Acl.ApproverGroups = splitCommaList(r.PostFormValue("approverGroups"))
+
+	// Organisation
+	template.Category = parseTemplateCategory(r.PostFormValue("category"))
+	if template.OwnerUserIds, usersE = userIdsByName(r.PostFormValue("ownerUsers")); usersE != nil {
+		return nil, usersE
+	}
+	template.OwnerGroups = splitCommaList(r.PostFormValue("ownerGroups"))
+	template.Labels = parseTemplateLabels(strings.Split(r.PostFormValue("labels"), ","))
+	riskLevel, riskLevelE := parseRiskLevel(r.PostFormValue("riskLevel"))
+	if riskLevelE != nil {
+		return nil, riskLevelE
+	}
+	template.RiskLevel = riskLevel
+	template.ReadOnly = cast.ToBool(r.PostFormValue("readOnly"))
+	return template, nil
+}
+
 // Login
 func PostAuth(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
@@ -1077,6 +1570,13 @@ func DeleteTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		return
 	}
 
+	// Recent second factor proof
+	if !checkStepUp(usr, r, STEP_UP_TEMPLATE_DELETE) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
 	// Username
 	id := strings.TrimSpace(r.URL.Query().Get("id"))
 
@@ -1087,6 +1587,13 @@ func DeleteTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		return
 	}
 
+	// Make sure it's not used by a schedule
+	if len(server.scheduleStore.FindByTemplate(id)) > 0 {
+		jr.Error("This template is used by one or multiple schedules. You need to revoke those first before deleting the template.")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
 	// Remove
 	server.templateStore.Remove(id)
 	server.templateStore.save()
@@ -1184,6 +1691,9 @@ func PostUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	// Create user
 	res := server.userStore.CreateUser(username, newPwd, email, roles)
+	if res {
+		server.userStore.ByName(username).SetGroups(splitCommaList(r.PostFormValue("groups")))
+	}
 	server.userStore.save()
 
 	jr.Set("saved", res)
@@ -1225,6 +1735,10 @@ func PutUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		switch key {
 		case "enable":
 			user.Enabled = cast.ToBool(r.PostFormValue(key))
+		case "groups":
+			groups := splitCommaList(r.PostFormValue(key))
+			audit.Log(admin, "User", fmt.Sprintf("Groups of %s set to %v", user.Username, groups))
+			user.SetGroups(groups)
 		case "username", "token":
 			continue
 		default:
@@ -1312,29 +1826,23 @@ func GetClients(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	if len(tagsExclude) == 1 && tagsExclude[0] == "" {
 		tagsExclude = make([]string, 0)
 	}
+	var expression *TagExpression
+	if s := strings.TrimSpace(r.URL.Query().Get("filter_expression")); len(s) > 0 {
+		var err error
+		if expression, err = parseTagExpression(s); err != nil {
+			jr.Error(fmt.Sprintf("%s", err))
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+	}
 
 	clients := make([]RegisteredClient, 0)
 	server.clientsMux.RLock()
-outer:
 	for _, clientPtr := range server.clients {
-		// Excluded? One match is enough to skip this one
-		if len(tagsExclude) > 0 {
-			for _, exclude := range tagsExclude {
-				if clientPtr.HasTag(exclude) {
-					continue outer
-				}
-			}
-		}
-
-		// Included? Must have all
-		var match bool = true
-		for _, include := range tagsInclude {
-			if !clientPtr.HasTag(include) {
-				match = false
-				break
-			}
+		if !clientPtr.MatchesTags(tagsInclude, tagsExclude) {
+			continue
 		}
-		if len(tagsInclude) > 0 && match == false {
+		if expression != nil && !clientPtr.MatchesExpression(expression) {
 			continue
 		}
 
@@ -1497,6 +2005,12 @@ func PutClientCmdState(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	// State
 	state := r.URL.Query().Get("state")
 
+	// Exit code is only meaningful once execution ended
+	switch state {
+	case "finished_execution", "failed_execution", "killed_execution":
+		cmd.ExitCode = cast.ToInt(r.URL.Query().Get("exit_code"))
+	}
+
 	// Save state in local server
 	cmd.SetState(state)
 
@@ -1561,6 +2075,11 @@ func ClientPing(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	tags := strings.Split(r.URL.Query().Get("tags"), ",")
 	server.RegisterClient(ps.ByName("clientId"), tags)
 	jr.Set("ack", true)
+	if registeredClient := server.GetClient(ps.ByName("clientId")); registeredClient != nil {
+		registeredClient.mux.RLock()
+		jr.Set("facts_known", registeredClient.Facts != nil)
+		registeredClient.mux.RUnlock()
+	}
 	jr.Set("server_instance_id", server.InstanceId)
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
@@ -1608,6 +2127,31 @@ func authUser(r *http.Request) bool {
 	return true
 }
 
+// Resolve a comma separated list of usernames
+func userIdsByName(s string) ([]string, error) {
+	userIds := make([]string, 0)
+	for _, username := range splitCommaList(s) {
+		usr := server.userStore.ByName(username)
+		if usr == nil {
+			return nil, fmt.Errorf("User %s not found", username)
+		}
+		userIds = append(userIds, usr.Id)
+	}
+	return userIds, nil
+}
+
+// Comma separated list without empty values
+func splitCommaList(s string) []string {
+	list := make([]string, 0)
+	for _, elm := range strings.Split(s, ",") {
+		elm = strings.TrimSpace(elm)
+		if len(elm) > 0 {
+			list = append(list, elm)
+		}
+	}
+	return list
+}
+
 // Get ip
 func getIp(r *http.Request) string {
 	return r.RemoteAddr
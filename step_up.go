@@ -0,0 +1,75 @@
+package main
+
+// Step-up authentication, sensitive actions require a recent second factor proof on top of the session
+// @author Robin Verlangen
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"time"
+)
+
+const (
+	STEP_UP_CONSENSUS_APPROVE = "consensus_approve"
+	STEP_UP_CONSENSUS_REJECT  = "consensus_reject"
+	STEP_UP_TEMPLATE_CREATE   = "template_create"
+	STEP_UP_TEMPLATE_UPDATE   = "template_update"
+	STEP_UP_TEMPLATE_DELETE   = "template_delete"
+	STEP_UP_BACKUP            = "backup"
+)
+
+// Is the action configured as sensitive?
+func (c *Conf) IsStepUpAction(action string) bool {
+	for _, elm := range c.StepUpActions {
+		if elm == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Does the user meet the step-up requirement of the action? A valid token in the request counts as a fresh proof
+func checkStepUp(user *User, r *http.Request, action string) bool {
+	if !conf.IsStepUpAction(action) {
+		return true
+	}
+	if totp := r.FormValue("totp"); len(totp) > 0 {
+		if res, _ := user.ValidateTotp(totp); res {
+			user.StepUp()
+			return true
+		}
+		audit.Log(user, "Step-up", fmt.Sprintf("Invalid two factor token for %s", action))
+		return false
+	}
+	gracePeriod := conf.StepUpGracePeriod
+	if gracePeriod < 0 {
+		gracePeriod = 0
+	}
+	return user.HasStepUp(time.Duration(gracePeriod) * time.Second)
+}
+
+// Prove the second factor for the upcoming sensitive actions
+func PostUserStepUp(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostUserStepUp")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+
+	if res, _ := user.ValidateTotp(r.PostFormValue("totp")); res == false {
+		audit.Log(user, "Step-up", "Invalid two factor token")
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user.StepUp()
+	audit.Log(user, "Step-up", "Confirmed")
+
+	jr.Set("grace_period", conf.StepUpGracePeriod)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
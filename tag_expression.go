@@ -0,0 +1,309 @@
+package main
+
+// Boolean expressions over client tags and facts, e.g. web AND prod AND NOT canary, resolved when execution starts
+// @author Robin Verlangen
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	TAG_EXPR_TAG = "tag"
+	TAG_EXPR_AND = "and"
+	TAG_EXPR_OR  = "or"
+	TAG_EXPR_NOT = "not"
+)
+
+type TagExpression struct {
+	Op       string // See TAG_EXPR_*
+	Tag      string // Only for TAG_EXPR_TAG
+	Children []*TagExpression
+}
+
+// Does a client with these tags match?
+func (e *TagExpression) Evaluate(hasTag func(string) bool) bool {
+	switch e.Op {
+	case TAG_EXPR_TAG:
+		return hasTag(e.Tag)
+	case TAG_EXPR_NOT:
+		return !e.Children[0].Evaluate(hasTag)
+	case TAG_EXPR_AND:
+		for _, child := range e.Children {
+			if !child.Evaluate(hasTag) {
+				return false
+			}
+		}
+		return true
+	case TAG_EXPR_OR:
+		for _, child := range e.Children {
+			if child.Evaluate(hasTag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Normalised form, fully parenthesised where operators are mixed
+func (e *TagExpression) String() string {
+	switch e.Op {
+	case TAG_EXPR_TAG:
+		return e.Tag
+	case TAG_EXPR_NOT:
+		return fmt.Sprintf("NOT %s", e.Children[0].nestedString())
+	}
+	parts := make([]string, 0)
+	for _, child := range e.Children {
+		parts = append(parts, child.nestedString())
+	}
+	return strings.Join(parts, fmt.Sprintf(" %s ", strings.ToUpper(e.Op)))
+}
+
+func (e *TagExpression) nestedString() string {
+	if e.Op == TAG_EXPR_AND || e.Op == TAG_EXPR_OR {
+		return fmt.Sprintf("(%s)", e.String())
+	}
+	return e.String()
+}
+
+type tagExpressionParser struct {
+	tokens []string
+	pos    int
+}
+
+// Parse an expression, AND binds stronger than OR, keywords are case insensitive
+func parseTagExpression(s string) (*TagExpression, error) {
+	p := &tagExpressionParser{tokens: tokenizeTagExpression(s)}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("Tag expression can not be empty")
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %s in tag expression, combine tags with AND or OR", p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+func tokenizeTagExpression(s string) []string {
+	s = strings.Replace(strings.Replace(s, "(", " ( ", -1), ")", " ) ", -1)
+	return strings.Fields(s)
+}
+
+func (p *tagExpressionParser) peekKeyword() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return strings.ToLower(p.tokens[p.pos])
+}
+
+func (p *tagExpressionParser) parseOr() (*TagExpression, error) {
+	return p.parseList(TAG_EXPR_OR, p.parseAnd)
+}
+
+func (p *tagExpressionParser) parseAnd() (*TagExpression, error) {
+	return p.parseList(TAG_EXPR_AND, p.parseNot)
+}
+
+// Operands joined by the operator, a single operand is returned as is
+func (p *tagExpressionParser) parseList(op string, operand func() (*TagExpression, error)) (*TagExpression, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	children := []*TagExpression{first}
+	for p.peekKeyword() == op {
+		p.pos++
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &TagExpression{Op: op, Children: children}, nil
+}
+
+func (p *tagExpressionParser) parseNot() (*TagExpression, error) {
+	if p.peekKeyword() == TAG_EXPR_NOT {
+		p.pos++
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &TagExpression{Op: TAG_EXPR_NOT, Children: []*TagExpression{child}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *tagExpressionParser) parsePrimary() (*TagExpression, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("Tag expression ends unexpectedly")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch strings.ToLower(token) {
+	case "(":
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos] != ")" {
+			return nil, errors.New("Missing ) in tag expression")
+		}
+		p.pos++
+		return e, nil
+	case ")", TAG_EXPR_AND, TAG_EXPR_OR, TAG_EXPR_NOT:
+		return nil, fmt.Errorf("Unexpected %s in tag expression", token)
+	}
+	if isFactCondition(token) {
+		if _, err := parseFactCondition(token); err != nil {
+			return nil, err
+		}
+	}
+	return &TagExpression{Op: TAG_EXPR_TAG, Tag: token}, nil
+}
+
+// Does the client match the expression?
+func (c *RegisteredClient) MatchesExpression(e *TagExpression) bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return e.Evaluate(c.hasTagOrFact)
+}
+
+// Ids of the clients matching the expression that the template may run on
+func (s *Server) FindClientIdsByExpression(e *TagExpression, acl *TemplateACL) []string {
+	clientIds := make([]string, 0)
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+	for _, client := range s.clients {
+		if client.MatchesExpression(e) && len(clientTargetError(client, acl)) == 0 {
+			clientIds = append(clientIds, client.ClientId)
+		}
+	}
+	sort.Strings(clientIds)
+	return clientIds
+}
+
+// Request targeting the clients that match the expression, previewed now and resolved again when execution starts
+func (c *Consensus) AddExpressionRequest(templateId string, expression string, user *User, reason string) (*ConsensusRequest, error) {
+	e, err := parseTagExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	template := server.templateStore.Get(templateId)
+	if template == nil {
+		return nil, errors.New("Template not found")
+	}
+	clientIds := server.FindClientIdsByExpression(e, template.Acl)
+	if len(clientIds) == 0 {
+		return nil, fmt.Errorf("No clients match %s", e.String())
+	}
+	cr, err := c.AddRequest(templateId, clientIds, user, reason)
+	if err != nil {
+		return nil, err
+	}
+	cr.TargetExpression = e.String()
+	audit.Log(user, "Consensus", fmt.Sprintf("Request %s targets %s, currently %s", cr.Id, cr.TargetExpression, strings.Join(clientIds, ", ")))
+	return cr, nil
+}
+
+// Resolve the expression of the request to the clients of this moment, the approvals must still cover the result
+func (c *ConsensusRequest) resolveTargets(template *Template) ([]string, error) {
+	e, err := parseTagExpression(c.TargetExpression)
+	if err != nil {
+		return nil, err
+	}
+	clientIds := server.FindClientIdsByExpression(e, template.Acl)
+	if len(clientIds) == 0 {
+		return nil, fmt.Errorf("No clients match %s anymore", c.TargetExpression)
+	}
+	exceeded, limitE := template.Acl.CheckTargetLimit(len(clientIds), len(server.FindClientIds(template.Acl.IncludedTags, template.Acl.ExcludedTags)))
+	if limitE != nil {
+		return nil, limitE
+	}
+	if len(exceeded) > 0 && uint(len(c.ApproveUserIds)+1) < template.Acl.ExceedMinAuth {
+		return nil, fmt.Errorf("Resolved to %s", exceeded)
+	}
+	return clientIds, nil
+}
+
+// Execute on the resolved clients from now on
+func (c *ConsensusRequest) commitTargets(clientIds []string) {
+	added, removed := diffClientIds(c.ClientIds, clientIds)
+	c.ClientIds = clientIds
+	c.TargetResolveTime = time.Now().Unix()
+	msg := fmt.Sprintf("Resolved %s to %s", c.TargetExpression, strings.Join(clientIds, ", "))
+	if len(added) > 0 {
+		msg += fmt.Sprintf(", added since the request %s", strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		msg += fmt.Sprintf(", removed since the request %s", strings.Join(removed, ", "))
+	}
+	c.addHistory(nil, msg)
+	audit.Log(nil, "Consensus", fmt.Sprintf("Request %s: %s", c.Id, msg))
+}
+
+// Ids in b but not in a, and in a but not in b
+func diffClientIds(a []string, b []string) ([]string, []string) {
+	inA := make(map[string]bool)
+	for _, id := range a {
+		inA[id] = true
+	}
+	inB := make(map[string]bool)
+	added := make([]string, 0)
+	for _, id := range b {
+		inB[id] = true
+		if !inA[id] {
+			added = append(added, id)
+		}
+	}
+	removed := make([]string, 0)
+	for _, id := range a {
+		if !inB[id] {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
+
+// Clients an expression matches right now
+func GetClientsPreview(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetClientsPreview")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	e, err := parseTagExpression(r.URL.Query().Get("expression"))
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	var acl *TemplateACL
+	if templateId := strings.TrimSpace(r.URL.Query().Get("template")); len(templateId) > 0 {
+		template := server.templateStore.Get(templateId)
+		if template == nil {
+			jr.Error("Template not found")
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+		acl = template.Acl
+	}
+	jr.Set("expression", e.String())
+	jr.Set("clients", server.FindClientIdsByExpression(e, acl))
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func tagSet(tags ...string) func(string) bool {
+	return func(tag string) bool {
+		for _, elm := range tags {
+			if elm == tag {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestParseTagExpression(t *testing.T) {
+	e, err := parseTagExpression("web AND prod AND NOT canary")
+	assert.Nil(t, err)
+	assert.Equal(t, "web AND prod AND NOT canary", e.String())
+	assert.True(t, e.Evaluate(tagSet("web", "prod")))
+	assert.False(t, e.Evaluate(tagSet("web", "prod", "canary")))
+	assert.False(t, e.Evaluate(tagSet("web")))
+
+	// AND binds stronger than OR, keywords in any case
+	e, err = parseTagExpression("web and eu or db")
+	assert.Nil(t, err)
+	assert.Equal(t, "(web AND eu) OR db", e.String())
+	assert.True(t, e.Evaluate(tagSet("db")))
+	assert.False(t, e.Evaluate(tagSet("web")))
+
+	e, err = parseTagExpression("web AND (eu OR us) AND NOT (canary OR drained)")
+	assert.Nil(t, err)
+	assert.Equal(t, "web AND (eu OR us) AND NOT (canary OR drained)", e.String())
+	assert.True(t, e.Evaluate(tagSet("web", "us")))
+	assert.False(t, e.Evaluate(tagSet("web", "us", "drained")))
+	assert.False(t, e.Evaluate(tagSet("eu", "us")))
+
+	e, err = parseTagExpression("NOT NOT web")
+	assert.Nil(t, err)
+	assert.True(t, e.Evaluate(tagSet("web")))
+}
+
+func TestParseTagExpressionErrors(t *testing.T) {
+	for _, s := range []string{"", "  ", "web prod", "web AND", "AND web", "(web OR db", "web)", "()", "NOT"} {
+		_, err := parseTagExpression(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestDiffClientIds(t *testing.T) {
+	added, removed := diffClientIds([]string{"a", "b"}, []string{"b", "c"})
+	assert.Equal(t, []string{"c"}, added)
+	assert.Equal(t, []string{"a"}, removed)
+}
+
+func TestFindClientIdsByExpression(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = &Server{clients: map[string]*RegisteredClient{
+		"web1": {ClientId: "web1", Tags: []string{"web", "prod"}},
+		"web2": {ClientId: "web2", Tags: []string{"web", "prod", "canary"}},
+		"web3": {ClientId: "web3", Tags: []string{"web", "staging"}},
+		"db1":  {ClientId: "db1", Tags: []string{"db", "prod"}},
+	}}
+
+	e, _ := parseTagExpression("prod AND NOT canary")
+	assert.Equal(t, []string{"db1", "web1"}, server.FindClientIdsByExpression(e, nil))
+
+	// Never wider than the tags of the template
+	acl := newTemplateAcl()
+	acl.IncludedTags = []string{"web"}
+	assert.Equal(t, []string{"web1"}, server.FindClientIdsByExpression(e, acl))
+}
+
+func TestExpressionTargetsHeldByMaintenanceWindow(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	template := newTemplate("Deploy", "Deploys the site", "deploy", true, []string{}, []string{}, 1, 10, nil)
+	freeze := newMaintenanceWindow()
+	freeze.Type = MAINTENANCE_WINDOW_DENY
+	freeze.Tags = []string{"canary"}
+	freeze.End = time.Now().Unix() + 3600
+	server = &Server{
+		templateStore:          &TemplateStore{Templates: map[string]*Template{template.Id: template}},
+		templateVersionStore:   &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)},
+		maintenanceWindowStore: &MaintenanceWindowStore{Windows: map[string]*MaintenanceWindow{freeze.Id: freeze}},
+		clients: map[string]*RegisteredClient{
+			"web1": {ClientId: "web1", Tags: []string{"web"}},
+			"web2": {ClientId: "web2", Tags: []string{"web", "canary"}},
+		},
+	}
+
+	// Only web1 matched when requested, the frozen web2 matches now
+	cr := newConsensusRequest()
+	cr.TemplateId = template.Id
+	cr.ClientIds = []string{"web1"}
+	cr.TargetExpression = "web"
+	cr.setState(CONSENSUS_STATE_APPROVED, nil, "")
+
+	assert.False(t, cr.start())
+	assert.False(t, cr.Executed)
+	assert.Contains(t, cr.QueuedReason, "web2")
+	assert.Equal(t, []string{"web1"}, cr.ClientIds)
+}
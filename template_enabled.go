@@ -0,0 +1,201 @@
+package main
+
+// Disabling templates that should not run anymore, and enabling them again
+// @author Robin Verlangen
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	TEMPLATE_DISABLE_HOLD   = "hold"   // Requests of the template wait until it is enabled again
+	TEMPLATE_DISABLE_CANCEL = "cancel" // Requests of the template are cancelled
+)
+
+type TemplateDisabled struct {
+	UserId string
+	Reason string
+	Time   int64
+}
+
+// Can the template be requested and executed?
+func (t *Template) IsEnabled() bool {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	return t.Enabled
+}
+
+// Why the template can not be used, nil if it is enabled
+func (t *Template) DisabledError() error {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	if t.Enabled {
+		return nil
+	}
+	if t.Disabled != nil && len(t.Disabled.Reason) > 0 {
+		return fmt.Errorf("Template %s is disabled: %s", t.Title, t.Disabled.Reason)
+	}
+	return fmt.Errorf("Template %s is disabled", t.Title)
+}
+
+// Disable with a reason, returns false if it already was
+func (t *Template) Disable(user *User, reason string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if !t.Enabled {
+		return false
+	}
+	t.Enabled = false
+	t.Disabled = &TemplateDisabled{
+		UserId: user.Id,
+		Reason: reason,
+		Time:   time.Now().Unix(),
+	}
+	return true
+}
+
+// Enable again, returns false if it already was
+func (t *Template) Enable() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.Enabled {
+		return false
+	}
+	t.Enabled = true
+	t.Disabled = nil
+	return true
+}
+
+// Check the current template, also for requests pinned to an older version
+func checkTemplateEnabled(templateId string) error {
+	template := server.templateStore.Get(templateId)
+	if template == nil {
+		return errors.New("Template not found")
+	}
+	return template.DisabledError()
+}
+
+// Disable a template, its requests are held or cancelled
+func PostTemplateDisable(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostTemplateDisable")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("User not allowed to PostTemplateDisable")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if !checkStepUp(user, r, STEP_UP_TEMPLATE_UPDATE) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	template := server.templateStore.Get(ps.ByName("templateid"))
+	if template == nil {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if len(reason) < 4 {
+		jr.Error("Please provide a valid reason")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	pending := strings.TrimSpace(r.PostFormValue("pending"))
+	if len(pending) == 0 {
+		pending = TEMPLATE_DISABLE_HOLD
+	}
+	if pending != TEMPLATE_DISABLE_HOLD && pending != TEMPLATE_DISABLE_CANCEL {
+		jr.Error("Pending must be hold or cancel")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	if !template.Disable(user, reason) {
+		jr.Error("Template is already disabled")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	audit.Log(user, "Template", fmt.Sprintf("Disabled %s, reason: %s", template.Id, reason))
+
+	// Requests that did not start yet, running ones are left to finish
+	requests := server.consensus.UnexecutedForTemplate(template.Id)
+	for _, cr := range requests {
+		if pending == TEMPLATE_DISABLE_CANCEL {
+			cr.Invalidate(user, fmt.Sprintf("Template %s was disabled: %s", template.Title, reason))
+		} else {
+			cr.addHistory(user, fmt.Sprintf("Held, template disabled: %s", reason))
+		}
+	}
+	server.templateStore.save()
+	server.consensus.save()
+
+	jr.Set("template", template)
+	if pending == TEMPLATE_DISABLE_CANCEL {
+		jr.Set("cancelled", len(requests))
+	} else {
+		jr.Set("held", len(requests))
+	}
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Enable a template again, held requests continue
+func PostTemplateEnable(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostTemplateEnable")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("User not allowed to PostTemplateEnable")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if !checkStepUp(user, r, STEP_UP_TEMPLATE_UPDATE) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	template := server.templateStore.Get(ps.ByName("templateid"))
+	if template == nil {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if len(reason) < 4 {
+		jr.Error("Please provide a valid reason")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if !template.Enable() {
+		jr.Error("Template is already enabled")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	audit.Log(user, "Template", fmt.Sprintf("Enabled %s, reason: %s", template.Id, reason))
+	server.templateStore.save()
+
+	// Approved requests that were held start now
+	server.consensus.StartQueued()
+
+	jr.Set("template", template)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
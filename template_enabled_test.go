@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTemplateDisableEnable(t *testing.T) {
+	template := newTemplate("Restart nginx", "Restarts the web server", "service nginx restart", true, []string{}, []string{}, 1, 30, nil)
+	admin := newUser()
+	admin.Id = "admin1"
+
+	assert.True(t, template.IsEnabled())
+	assert.Nil(t, template.DisabledError())
+
+	assert.True(t, template.Disable(admin, "Replaced by reload"))
+	assert.False(t, template.Disable(admin, "Again"))
+	assert.False(t, template.IsEnabled())
+	assert.Equal(t, "admin1", template.Disabled.UserId)
+	assert.Equal(t, "Template Restart nginx is disabled: Replaced by reload", template.DisabledError().Error())
+
+	assert.True(t, template.Enable())
+	assert.False(t, template.Enable())
+	assert.Nil(t, template.Disabled)
+	assert.Nil(t, template.DisabledError())
+
+	// Created disabled, without a reason
+	template.Enabled = false
+	assert.Equal(t, "Template Restart nginx is disabled", template.DisabledError().Error())
+}
+
+func TestConsensusRejectsDisabledTemplate(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = &Server{templateStore: &TemplateStore{Templates: make(map[string]*Template)}}
+
+	template := newTemplate("Restart nginx", "Restarts the web server", "service nginx restart", true, []string{}, []string{}, 1, 30, nil)
+	server.templateStore.Add(template)
+	user := newUser()
+	user.AddRole("requester")
+	template.Disable(user, "Retired")
+
+	_, err := (&Consensus{Pending: make(map[string]*ConsensusRequest)}).AddRequest(template.Id, []string{"web1"}, user, "Restart please")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Retired")
+
+	// Requests pinned to an older version check the current template
+	assert.NotNil(t, checkTemplateEnabled(template.Id))
+	template.Enable()
+	assert.Nil(t, checkTemplateEnabled(template.Id))
+	assert.NotNil(t, checkTemplateEnabled("unknown"))
+}
@@ -0,0 +1,127 @@
+package main
+
+// Static checks of template commands for patterns that are known to go wrong
+// @author Robin Verlangen
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	LINT_RM_VARIABLE       = "rm-variable"       // rm on a variable that may be empty, e.g. rm -rf $DIR/
+	LINT_PIPE_TO_SHELL     = "pipe-to-shell"     // Downloaded scripts executed without review, e.g. curl | sh
+	LINT_MISSING_SET_E     = "missing-set-e"     // Multiple statements that continue after a failure
+	LINT_UNQUOTED_VARIABLE = "unquoted-variable" // Expansions that split on whitespace
+)
+
+var lintRmRegexp = regexp.MustCompile(`(^|[;&|(\s])rm\s[^;&|]*`)
+var lintVariableRegexp = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*|\{[A-Za-z_][A-Za-z0-9_]*\})`)
+var lintPipeToShellRegexp = regexp.MustCompile(`\b(curl|wget)\b[^|;&]*\|\s*(sudo\s+)?(ba|da|k|z)?sh\b`)
+var lintSetERegexp = regexp.MustCompile(`\bset\s+(-[a-zA-Z]*e[a-zA-Z]*|-o\s+errexit)\b`)
+
+type TemplateLintWarning struct {
+	Rule     string
+	Line     int // 1 based
+	Message  string
+	Blocking bool // Prevents saving the template
+}
+
+// Run all rules on a command, disabled rules are skipped and blocking ones marked
+func lintCommand(command string, disabled []string, blocking []string) []*TemplateLintWarning {
+	skip := make(map[string]bool)
+	for _, rule := range disabled {
+		skip[rule] = true
+	}
+	block := make(map[string]bool)
+	for _, rule := range blocking {
+		block[rule] = true
+	}
+
+	warnings := make([]*TemplateLintWarning, 0)
+	add := func(rule string, line int, msg string) {
+		if skip[rule] {
+			return
+		}
+		warnings = append(warnings, &TemplateLintWarning{
+			Rule:     rule,
+			Line:     line,
+			Message:  msg,
+			Blocking: block[rule],
+		})
+	}
+
+	statements := 0
+	for i, line := range strings.Split(command, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		statements += 1 + strings.Count(line, ";")
+
+		for _, rm := range lintRmRegexp.FindAllString(line, -1) {
+			if vars := lintVariableRegexp.FindAllString(rm, -1); len(vars) > 0 {
+				add(LINT_RM_VARIABLE, i+1, fmt.Sprintf("rm on %s removes the wrong files when it is empty, use ${NAME:?} to abort instead", strings.Join(vars, ", ")))
+				break
+			}
+		}
+		if lintPipeToShellRegexp.MatchString(line) {
+			add(LINT_PIPE_TO_SHELL, i+1, "Downloaded script is executed without being verified")
+		}
+		if vars := unquotedVariables(line); len(vars) > 0 {
+			add(LINT_UNQUOTED_VARIABLE, i+1, fmt.Sprintf("Quote %s to prevent word splitting and globbing", strings.Join(vars, ", ")))
+		}
+	}
+	if statements > 1 && !lintSetERegexp.MatchString(command) {
+		add(LINT_MISSING_SET_E, 1, "Multiple statements without set -e continue after a failing one")
+	}
+	return warnings
+}
+
+// Variable expansions outside of double quotes, single quoted text is not expanded at all
+func unquotedVariables(line string) []string {
+	vars := make([]string, 0)
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == '\\' && quote != '\'':
+			i++
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '$':
+			if loc := lintVariableRegexp.FindStringIndex(line[i:]); loc != nil && loc[0] == 0 {
+				vars = append(vars, line[i:i+loc[1]])
+				i += loc[1] - 1
+			}
+		}
+	}
+	return vars
+}
+
+// Lint with the rules from the configuration
+func lintTemplate(template *Template) []*TemplateLintWarning {
+	template.mux.RLock()
+	command := template.Command
+	template.mux.RUnlock()
+	return lintCommand(command, conf.TemplateLintDisabledRules, conf.TemplateLintBlockingRules)
+}
+
+// Error describing the warnings that prevent saving, nil if there are none
+func lintBlockingError(warnings []*TemplateLintWarning) error {
+	msgs := make([]string, 0)
+	for _, warning := range warnings {
+		if warning.Blocking {
+			msgs = append(msgs, fmt.Sprintf("%s on line %d: %s", warning.Rule, warning.Line, warning.Message))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Command is not allowed, %s", strings.Join(msgs, "; "))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func lintRules(warnings []*TemplateLintWarning) []string {
+	rules := make([]string, 0)
+	for _, warning := range warnings {
+		rules = append(rules, warning.Rule)
+	}
+	return rules
+}
+
+func TestLintRmVariable(t *testing.T) {
+	warnings := lintCommand(`rm -rf $DIR/`, nil, nil)
+	assert.Equal(t, []string{LINT_RM_VARIABLE, LINT_UNQUOTED_VARIABLE}, lintRules(warnings))
+	assert.Equal(t, 1, warnings[0].Line)
+	assert.Contains(t, warnings[0].Message, "$DIR")
+
+	assert.Equal(t, []string{LINT_RM_VARIABLE}, lintRules(lintCommand(`rm -rf "${DIR}/cache"`, nil, nil)))
+	assert.Len(t, lintCommand(`rm -rf "${DIR:?}/cache"`, nil, nil), 0)
+	assert.Len(t, lintCommand(`rm -rf /tmp/cache`, nil, nil), 0)
+	assert.Len(t, lintCommand(`echo "$HOME" | grep x`, nil, nil), 0)
+}
+
+func TestLintPipeToShell(t *testing.T) {
+	assert.Equal(t, []string{LINT_PIPE_TO_SHELL}, lintRules(lintCommand(`curl -s https://example.com/install.sh | sudo bash`, nil, nil)))
+	assert.Equal(t, []string{LINT_PIPE_TO_SHELL}, lintRules(lintCommand(`wget -qO- https://example.com/x | sh`, nil, nil)))
+	assert.Len(t, lintCommand(`curl -s https://example.com/status | grep OK`, nil, nil), 0)
+}
+
+func TestLintMissingSetE(t *testing.T) {
+	assert.Equal(t, []string{LINT_MISSING_SET_E}, lintRules(lintCommand("cd /srv/app\ngit pull", nil, nil)))
+	assert.Equal(t, []string{LINT_MISSING_SET_E}, lintRules(lintCommand("cd /srv/app; git pull", nil, nil)))
+	assert.Len(t, lintCommand("set -euo pipefail\ncd /srv/app\ngit pull", nil, nil), 0)
+	assert.Len(t, lintCommand("set -o errexit; cd /srv/app; git pull", nil, nil), 0)
+	assert.Len(t, lintCommand("# Update the code\ngit pull", nil, nil), 0)
+	assert.Len(t, lintCommand("cd /srv/app && git pull", nil, nil), 0)
+}
+
+func TestLintUnquotedVariable(t *testing.T) {
+	warnings := lintCommand(`cp $SRC "$DST" '$LITERAL' \$ESCAPED`, nil, nil)
+	assert.Equal(t, []string{LINT_UNQUOTED_VARIABLE}, lintRules(warnings))
+	assert.Contains(t, warnings[0].Message, "$SRC")
+	assert.NotContains(t, warnings[0].Message, "$DST")
+	assert.NotContains(t, warnings[0].Message, "$LITERAL")
+	assert.NotContains(t, warnings[0].Message, "$ESCAPED")
+}
+
+func TestLintConfiguredRules(t *testing.T) {
+	cmd := "curl https://example.com/x | sh\nrm -rf $DIR/"
+	warnings := lintCommand(cmd, []string{LINT_UNQUOTED_VARIABLE, LINT_MISSING_SET_E}, []string{LINT_PIPE_TO_SHELL})
+	assert.Equal(t, []string{LINT_PIPE_TO_SHELL, LINT_RM_VARIABLE}, lintRules(warnings))
+	assert.True(t, warnings[0].Blocking)
+	assert.False(t, warnings[1].Blocking)
+	assert.Equal(t, 2, warnings[1].Line)
+
+	err := lintBlockingError(warnings)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), LINT_PIPE_TO_SHELL)
+	assert.NotContains(t, err.Error(), LINT_RM_VARIABLE)
+
+	assert.Nil(t, lintBlockingError(lintCommand(cmd, nil, nil)))
+}
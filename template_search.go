@@ -0,0 +1,212 @@
+package main
+
+// Organising templates in categories with owners, labels and a risk level, and searching through them
+// @author Robin Verlangen
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"github.com/unilama/indispenso/data_table"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	TEMPLATE_RISK_LOW      = "low"
+	TEMPLATE_RISK_MEDIUM   = "medium"
+	TEMPLATE_RISK_HIGH     = "high"
+	TEMPLATE_RISK_CRITICAL = "critical"
+)
+
+var templateRiskLevels = []string{TEMPLATE_RISK_LOW, TEMPLATE_RISK_MEDIUM, TEMPLATE_RISK_HIGH, TEMPLATE_RISK_CRITICAL}
+
+type TemplateSearchFilter struct {
+	Category    string   // Category including its subcategories
+	OwnerUserId string   // Owned by the user directly or through one of OwnerGroups
+	OwnerGroups []string // Groups of the owner
+	Label       string
+	RiskLevel   string
+}
+
+// Risk level from input, empty if not set
+func parseRiskLevel(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) == 0 {
+		return "", nil
+	}
+	for _, level := range templateRiskLevels {
+		if s == level {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid risk level %s, use one of %s", s, strings.Join(templateRiskLevels, ", "))
+}
+
+// Category as a path of folders, e.g. " /web//nginx/ " becomes web/nginx
+func parseTemplateCategory(s string) string {
+	folders := make([]string, 0)
+	for _, folder := range strings.Split(s, "/") {
+		if folder = strings.TrimSpace(folder); len(folder) > 0 {
+			folders = append(folders, folder)
+		}
+	}
+	return strings.Join(folders, "/")
+}
+
+// Labels without duplicates, sorted
+func parseTemplateLabels(labels []string) []string {
+	seen := make(map[string]bool)
+	res := make([]string, 0)
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if len(label) == 0 || seen[label] {
+			continue
+		}
+		seen[label] = true
+		res = append(res, label)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Is the user an owner directly or through one of the groups?
+func (t *Template) IsOwner(userId string, groups []string) bool {
+	for _, ownerId := range t.OwnerUserIds {
+		if ownerId == userId {
+			return true
+		}
+	}
+	for _, group := range groups {
+		for _, ownerGroup := range t.OwnerGroups {
+			if group == ownerGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *Template) HasLabel(label string) bool {
+	for _, elm := range t.Labels {
+		if elm == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Does the template pass all filters that are set?
+func (f *TemplateSearchFilter) Matches(t *Template) bool {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	if len(f.Category) > 0 && t.Category != f.Category && !strings.HasPrefix(t.Category, f.Category+"/") {
+		return false
+	}
+	if len(f.OwnerUserId) > 0 && !t.IsOwner(f.OwnerUserId, f.OwnerGroups) {
+		return false
+	}
+	if len(f.Label) > 0 && !t.HasLabel(strings.ToLower(f.Label)) {
+		return false
+	}
+	if len(f.RiskLevel) > 0 && t.RiskLevel != f.RiskLevel {
+		return false
+	}
+	return true
+}
+
+// Filter from the form, the owner is referenced by name
+func parseTemplateSearchFilter(r *http.Request) (*TemplateSearchFilter, error) {
+	f := &TemplateSearchFilter{
+		Category: parseTemplateCategory(r.FormValue("category")),
+		Label:    strings.TrimSpace(r.FormValue("label")),
+	}
+	var err error
+	if f.RiskLevel, err = parseRiskLevel(r.FormValue("risk")); err != nil {
+		return nil, err
+	}
+	if username := strings.TrimSpace(r.FormValue("owner")); len(username) > 0 {
+		usr := server.userStore.ByName(username)
+		if usr == nil {
+			return nil, fmt.Errorf("User %s not found", username)
+		}
+		f.OwnerUserId = usr.Id
+		f.OwnerGroups = usr.Groups
+	}
+	return f, nil
+}
+
+func TemplateSearchQuery(tableStore *data_table.DefaultStore, filter *TemplateSearchFilter) *data_table.DefaultStore {
+	server.templateStore.templateMux.RLock()
+	templates := make([]*Template, 0)
+	for _, template := range server.templateStore.Templates {
+		templates = append(templates, template)
+	}
+	server.templateStore.templateMux.RUnlock()
+
+	for _, template := range templates {
+		if !filter.Matches(template) {
+			continue
+		}
+		template.mux.RLock()
+		row := make(map[string]interface{})
+		row["id"] = template.Id
+		row["title"] = template.Title
+		row["description"] = template.Description
+		row["command"] = template.Command
+		row["category"] = template.Category
+		row["labels"] = strings.Join(template.Labels, ", ")
+		row["risk"] = template.RiskLevel
+		row["owners"] = strings.Join(append(usernamesById(template.OwnerUserIds), template.OwnerGroups...), ", ")
+		row["enabled"] = template.Enabled
+		template.mux.RUnlock()
+
+		rowObj := tableStore.CreateRow(row)
+		rowObj.RowId = template.Id
+		if len(template.RiskLevel) > 0 {
+			rowObj.RowClass = fmt.Sprintf("risk-%s", template.RiskLevel)
+		}
+		tableStore.AddRow(rowObj)
+	}
+	return tableStore
+}
+
+// Search through templates on title, description, command and labels
+func PostTemplatesSearch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !authUser(r) {
+		jr := jresp.NewJsonResp()
+		jr.Error("User not authorized for PostTemplatesSearch")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	filter, err := parseTemplateSearchFilter(r)
+	if err != nil {
+		jr := jresp.NewJsonResp()
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	data_table.DefaultStoreHandler(func(tableStore *data_table.DefaultStore) *data_table.DefaultStore {
+		return TemplateSearchQuery(tableStore, filter)
+	})(w, r, ps)
+}
+
+// Categories in use with the number of templates in each
+func GetTemplateCategories(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetTemplateCategories")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	categories := make(map[string]int)
+	server.templateStore.templateMux.RLock()
+	for _, template := range server.templateStore.Templates {
+		categories[template.Category]++
+	}
+	server.templateStore.templateMux.RUnlock()
+	jr.Set("categories", categories)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRiskLevel(t *testing.T) {
+	level, err := parseRiskLevel(" High ")
+	assert.Nil(t, err)
+	assert.Equal(t, TEMPLATE_RISK_HIGH, level)
+	level, err = parseRiskLevel("")
+	assert.Nil(t, err)
+	assert.Equal(t, "", level)
+	_, err = parseRiskLevel("extreme")
+	assert.NotNil(t, err)
+}
+
+func TestParseTemplateCategoryAndLabels(t *testing.T) {
+	assert.Equal(t, "web/nginx", parseTemplateCategory(" /web// nginx/ "))
+	assert.Equal(t, "", parseTemplateCategory("/"))
+	assert.Equal(t, []string{"nginx", "restart"}, parseTemplateLabels([]string{"Restart", " nginx", "", "restart"}))
+}
+
+func TestTemplateSearchFilter(t *testing.T) {
+	template := newTemplate("Restart nginx", "Restarts the web server", "service nginx restart", true, []string{}, []string{}, 1, 30, nil)
+	template.Category = "web/nginx"
+	template.OwnerUserIds = []string{"u1"}
+	template.OwnerGroups = []string{"ops"}
+	template.Labels = []string{"nginx", "restart"}
+	template.RiskLevel = TEMPLATE_RISK_MEDIUM
+
+	assert.True(t, (&TemplateSearchFilter{}).Matches(template))
+	assert.True(t, (&TemplateSearchFilter{Category: "web", Label: "Restart", RiskLevel: TEMPLATE_RISK_MEDIUM, OwnerUserId: "u1"}).Matches(template))
+	assert.True(t, (&TemplateSearchFilter{Category: "web/nginx", OwnerUserId: "u2", OwnerGroups: []string{"dev", "ops"}}).Matches(template))
+	assert.False(t, (&TemplateSearchFilter{Category: "we"}).Matches(template))
+	assert.False(t, (&TemplateSearchFilter{Category: "db"}).Matches(template))
+	assert.False(t, (&TemplateSearchFilter{OwnerUserId: "u2", OwnerGroups: []string{"dev"}}).Matches(template))
+	assert.False(t, (&TemplateSearchFilter{Label: "reload"}).Matches(template))
+	assert.False(t, (&TemplateSearchFilter{RiskLevel: TEMPLATE_RISK_HIGH}).Matches(template))
+}
@@ -0,0 +1,800 @@
+package main
+
+// Declarative template definitions in YAML or JSON, for import, export and syncing from a directory
+// @author Robin Verlangen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/fsnotify.v1"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	TEMPLATE_SOURCE_DIRECTORY = "directory" // Managed by the files in Conf.TemplateSyncDir
+
+	TEMPLATE_FORMAT_YAML = "yaml"
+	TEMPLATE_FORMAT_JSON = "json"
+
+	TEMPLATE_SYNC_CREATE = "create"
+	TEMPLATE_SYNC_UPDATE = "update"
+	TEMPLATE_SYNC_DELETE = "delete"
+)
+
+var templateSlugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+var templateSlugInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+type TemplateDefinition struct {
+	Id                string                          `yaml:"id,omitempty" json:"id,omitempty"`
+	Slug              string                          `yaml:"slug" json:"slug"`
+	Title             string                          `yaml:"title" json:"title"`
+	Description       string                          `yaml:"description" json:"description"`
+	Command           string                          `yaml:"command" json:"command"`
+	Enabled           *bool                           `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	Timeout           int                             `yaml:"timeout" json:"timeout"`
+	Strategy          string                          `yaml:"strategy" json:"strategy"`
+	MinAuth           uint                            `yaml:"min_auth" json:"min_auth"`
+	IncludedTags      []string                        `yaml:"included_tags,omitempty" json:"included_tags,omitempty"`
+	ExcludedTags      []string                        `yaml:"excluded_tags,omitempty" json:"excluded_tags,omitempty"`
+	RollbackTemplate  string                          `yaml:"rollback_template,omitempty" json:"rollback_template,omitempty"` // Slug
+	ApprovalDeadline  int                             `yaml:"approval_deadline,omitempty" json:"approval_deadline,omitempty"`
+	MinReject         uint                            `yaml:"min_reject,omitempty" json:"min_reject,omitempty"`
+	VetoRoles         []string                        `yaml:"veto_roles,omitempty" json:"veto_roles,omitempty"`
+	QuorumRules       []string                        `yaml:"quorum_rules,omitempty" json:"quorum_rules,omitempty"`
+	MaxTargets        int                             `yaml:"max_targets,omitempty" json:"max_targets,omitempty"`
+	MaxTargetsPercent int                             `yaml:"max_targets_percent,omitempty" json:"max_targets_percent,omitempty"`
+	ExceedMinAuth     uint                            `yaml:"exceed_min_auth,omitempty" json:"exceed_min_auth,omitempty"`
+	RequesterUsers    []string                        `yaml:"requester_users,omitempty" json:"requester_users,omitempty"`
+	RequesterGroups   []string                        `yaml:"requester_groups,omitempty" json:"requester_groups,omitempty"`
+	ApproverUsers     []string                        `yaml:"approver_users,omitempty" json:"approver_users,omitempty"`
+	ApproverGroups    []string                        `yaml:"approver_groups,omitempty" json:"approver_groups,omitempty"`
+	HealthProbe       *HealthProbe                    `yaml:"health_probe,omitempty" json:"health_probe,omitempty"`
+	Category          string                          `yaml:"category,omitempty" json:"category,omitempty"`
+	OwnerUsers        []string                        `yaml:"owner_users,omitempty" json:"owner_users,omitempty"`
+	OwnerGroups       []string                        `yaml:"owner_groups,omitempty" json:"owner_groups,omitempty"`
+	Labels            []string                        `yaml:"labels,omitempty" json:"labels,omitempty"`
+	RiskLevel         string                          `yaml:"risk_level,omitempty" json:"risk_level,omitempty"`
+	ReadOnly          bool                            `yaml:"read_only,omitempty" json:"read_only,omitempty"`
+	ValidationRules   []*TemplateValidationDefinition `yaml:"validation_rules,omitempty" json:"validation_rules,omitempty"`
+}
+
+type TemplateValidationDefinition struct {
+	Type         string `yaml:"type,omitempty" json:"type,omitempty"`
+	Text         string `yaml:"text" json:"text"`
+	Fatal        bool   `yaml:"fatal,omitempty" json:"fatal,omitempty"`
+	MustContain  bool   `yaml:"must_contain,omitempty" json:"must_contain,omitempty"`
+	OutputStream int    `yaml:"output_stream,omitempty" json:"output_stream,omitempty"`
+	Value        string `yaml:"value,omitempty" json:"value,omitempty"`
+}
+
+type TemplateSyncChange struct {
+	Action     string
+	TemplateId string
+	Slug       string
+	Title      string
+	Diff       []*TemplateFieldDiff
+	template   *Template
+}
+
+type TemplateSyncPlan struct {
+	Changes   []*TemplateSyncChange
+	Unchanged int
+	Hash      string // Identifies the changes, to confirm exactly what was shown is applied
+}
+
+// Slug of a title, e.g. "Restart Nginx" becomes restart-nginx
+func slugify(s string) string {
+	return strings.Trim(templateSlugInvalidChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// Slug of a template, derived from the title if it has none yet
+func (t *Template) GetSlug() string {
+	if len(t.Slug) > 0 {
+		return t.Slug
+	}
+	return slugify(t.Title)
+}
+
+// Definition of a template, users are referenced by name and templates by slug
+func newTemplateDefinition(t *Template) *TemplateDefinition {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	d := &TemplateDefinition{
+		Id:          t.Id,
+		Slug:        t.GetSlug(),
+		Title:       t.Title,
+		Description: t.Description,
+		Command:     t.Command,
+		Timeout:     t.Timeout,
+		Strategy:    executionStrategyNames[SimpleExecutionStrategy],
+		HealthProbe: t.HealthProbe,
+		Category:    t.Category,
+		OwnerUsers:  usernamesById(t.OwnerUserIds),
+		OwnerGroups: t.OwnerGroups,
+		Labels:      t.Labels,
+		RiskLevel:   t.RiskLevel,
+		ReadOnly:    t.ReadOnly,
+	}
+	if !t.Enabled {
+		disabled := false
+		d.Enabled = &disabled // Enabled is the default, enabling again goes through the api with a reason
+	}
+	if t.ExecutionStrategy != nil {
+		d.Strategy = t.ExecutionStrategy.Name()
+	}
+	if len(t.RollbackTemplateId) > 0 {
+		if rollback := server.templateStore.Get(t.RollbackTemplateId); rollback != nil {
+			d.RollbackTemplate = rollback.GetSlug()
+		}
+	}
+	if t.Acl != nil {
+		d.MinAuth = t.Acl.MinAuth
+		d.IncludedTags = t.Acl.IncludedTags
+		d.ExcludedTags = t.Acl.ExcludedTags
+		d.ApprovalDeadline = t.Acl.ApprovalDeadline
+		d.MinReject = t.Acl.MinReject
+		d.MaxTargets = t.Acl.MaxTargets
+		d.MaxTargetsPercent = t.Acl.MaxTargetsPercent
+		d.ExceedMinAuth = t.Acl.ExceedMinAuth
+		d.VetoRoles = t.Acl.VetoRoles
+		for _, rule := range t.Acl.QuorumRules {
+			d.QuorumRules = append(d.QuorumRules, rule.Spec())
+		}
+		d.RequesterUsers = usernamesById(t.Acl.RequesterUserIds)
+		d.RequesterGroups = t.Acl.RequesterGroups
+		d.ApproverUsers = usernamesById(t.Acl.ApproverUserIds)
+		d.ApproverGroups = t.Acl.ApproverGroups
+	}
+	for _, rule := range t.ValidationRules {
+		d.ValidationRules = append(d.ValidationRules, &TemplateValidationDefinition{
+			Type:         rule.Type,
+			Value:        rule.Value,
+			Text:         rule.Text,
+			Fatal:        rule.Fatal,
+			MustContain:  rule.MustContain,
+			OutputStream: rule.OutputStream,
+		})
+	}
+	return d
+}
+
+// Template from the definition, references to other templates are resolved by the plan
+func (d *TemplateDefinition) toTemplate(id string) (*Template, error) {
+	if !templateSlugRegexp.MatchString(d.Slug) {
+		return nil, fmt.Errorf("Invalid slug %s, use lowercase letters, digits and dashes", d.Slug)
+	}
+	if len(strings.TrimSpace(d.Title)) < 1 {
+		return nil, errors.New("Fill in a title")
+	}
+	if len(strings.TrimSpace(d.Description)) < 1 {
+		return nil, errors.New("Fill in a description")
+	}
+	if len(d.Command) < 1 {
+		return nil, errors.New("Fill in a command")
+	}
+	if d.MinAuth < 1 {
+		return nil, errors.New("Min auth must be at least 1")
+	}
+	if d.Timeout < 1 {
+		return nil, errors.New("Timeout must be at least 1 second")
+	}
+	if d.ApprovalDeadline < 0 {
+		return nil, errors.New("Approval deadline can not be negative")
+	}
+	strategy, strategyE := parseExecutionStrategy(d.Strategy)
+	if strategyE != nil {
+		return nil, strategyE
+	}
+	enabled := true
+	if d.Enabled != nil {
+		enabled = *d.Enabled
+	}
+
+	t := newTemplate(strings.TrimSpace(d.Title), strings.TrimSpace(d.Description), d.Command, enabled, nonNilList(d.IncludedTags), nonNilList(d.ExcludedTags), d.MinAuth, d.Timeout, strategy)
+	t.Id = id
+	t.Slug = d.Slug
+	t.Acl.ApprovalDeadline = d.ApprovalDeadline
+	t.Acl.MinReject = d.MinReject
+	t.Acl.VetoRoles = nonNilList(d.VetoRoles)
+	quorumRules, quorumRulesE := parseQuorumRules(strings.Join(d.QuorumRules, ","))
+	if quorumRulesE != nil {
+		return nil, quorumRulesE
+	}
+	t.Acl.QuorumRules = quorumRules
+	t.Acl.MaxTargets = d.MaxTargets
+	t.Acl.MaxTargetsPercent = d.MaxTargetsPercent
+	t.Acl.ExceedMinAuth = d.ExceedMinAuth
+	if valid, err := t.Acl.IsValidTargetLimit(); !valid {
+		return nil, err
+	}
+	var usersE error
+	if t.Acl.RequesterUserIds, usersE = userIdsByName(strings.Join(d.RequesterUsers, ",")); usersE != nil {
+		return nil, usersE
+	}
+	if t.Acl.ApproverUserIds, usersE = userIdsByName(strings.Join(d.ApproverUsers, ",")); usersE != nil {
+		return nil, usersE
+	}
+	if t.OwnerUserIds, usersE = userIdsByName(strings.Join(d.OwnerUsers, ",")); usersE != nil {
+		return nil, usersE
+	}
+	t.OwnerGroups = nonNilList(d.OwnerGroups)
+	t.Category = parseTemplateCategory(d.Category)
+	t.Labels = parseTemplateLabels(d.Labels)
+	riskLevel, riskLevelE := parseRiskLevel(d.RiskLevel)
+	if riskLevelE != nil {
+		return nil, riskLevelE
+	}
+	t.RiskLevel = riskLevel
+	t.ReadOnly = d.ReadOnly
+	t.Acl.RequesterGroups = nonNilList(d.RequesterGroups)
+	t.Acl.ApproverGroups = nonNilList(d.ApproverGroups)
+	if d.HealthProbe != nil {
+		if valid, err := d.HealthProbe.IsValid(); !valid {
+			return nil, err
+		}
+		t.HealthProbe = d.HealthProbe
+	}
+
+	// Rule ids derive from the slug, so unchanged rules do not show up in diffs
+	for i, rule := range d.ValidationRules {
+		stream := rule.OutputStream
+		if stream == 0 {
+			stream = OUTPUT_STREAM_STDOUT
+		}
+		v := &ExecutionValidation{
+			Id:           fmt.Sprintf("%s-%d", d.Slug, i+1),
+			Type:         rule.Type,
+			Fatal:        rule.Fatal,
+			MustContain:  rule.MustContain,
+			OutputStream: stream,
+			Text:         rule.Text,
+			Value:        rule.Value,
+		}
+		if valid, err := v.IsValid(); !valid {
+			return nil, fmt.Errorf("Validation rule %d: %s", i+1, err)
+		}
+		t.AddValidationRule(v)
+	}
+	return t, nil
+}
+
+// Id for a new template that stays the same for every plan, in the format of a uuid
+func templateIdForSlug(slug string) string {
+	sum := sha256.Sum256([]byte(slug))
+	h := hex.EncodeToString(sum[:16])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+func nonNilList(list []string) []string {
+	if list == nil {
+		return make([]string, 0)
+	}
+	return list
+}
+
+func usernamesById(userIds []string) []string {
+	usernames := make([]string, 0)
+	for _, userId := range userIds {
+		if usr := server.userStore.ById(userId); usr != nil {
+			usernames = append(usernames, usr.Username)
+		}
+	}
+	return usernames
+}
+
+// Definitions from a document holding either a single definition or a list
+func parseTemplateDefinitions(b []byte, format string) ([]*TemplateDefinition, error) {
+	var list []*TemplateDefinition
+	var single *TemplateDefinition
+	switch format {
+	case TEMPLATE_FORMAT_JSON:
+		if err := json.Unmarshal(b, &list); err != nil {
+			if err := json.Unmarshal(b, &single); err != nil {
+				return nil, fmt.Errorf("Invalid JSON: %s", err)
+			}
+		}
+	case TEMPLATE_FORMAT_YAML, "":
+		if err := yaml.Unmarshal(b, &list); err != nil {
+			if err := yaml.Unmarshal(b, &single); err != nil {
+				return nil, fmt.Errorf("Invalid YAML: %s", err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown format %s", format)
+	}
+	if single != nil {
+		list = []*TemplateDefinition{single}
+	}
+	return list, nil
+}
+
+// Document holding the definitions
+func formatTemplateDefinitions(defs []*TemplateDefinition, format string) ([]byte, error) {
+	switch format {
+	case TEMPLATE_FORMAT_JSON:
+		return json.MarshalIndent(defs, "", "  ")
+	case TEMPLATE_FORMAT_YAML, "":
+		return yaml.Marshal(defs)
+	}
+	return nil, fmt.Errorf("Unknown format %s", format)
+}
+
+// Existing template a definition refers to, by id, slug or the slug of its title
+func (s *TemplateStore) FindForDefinition(d *TemplateDefinition) *Template {
+	s.templateMux.RLock()
+	defer s.templateMux.RUnlock()
+	if len(d.Id) > 0 && s.Templates[d.Id] != nil {
+		return s.Templates[d.Id]
+	}
+	for _, template := range s.Templates {
+		if template.Slug == d.Slug {
+			return template
+		}
+	}
+	for _, template := range s.Templates {
+		if len(template.Slug) == 0 && slugify(template.Title) == d.Slug {
+			return template
+		}
+	}
+	return nil
+}
+
+// Changes needed to make the templates match the definitions, prune removes templates of the source that are no longer defined
+// and takeOver moves existing templates to the source instead of keeping the one that manages them
+func planTemplateSync(defs []*TemplateDefinition, source string, prune bool, takeOver bool) (*TemplateSyncPlan, error) {
+	plan := &TemplateSyncPlan{
+		Changes: make([]*TemplateSyncChange, 0),
+	}
+	slugIds := make(map[string]string)
+	titles := make(map[string]string)
+	existing := make(map[string]*Template)
+	templates := make([]*Template, 0)
+	for _, d := range defs {
+		if _, ok := slugIds[d.Slug]; ok {
+			return nil, fmt.Errorf("Slug %s is defined more than once", d.Slug)
+		}
+		current := server.templateStore.FindForDefinition(d)
+		id := d.Id
+		if current != nil {
+			id = current.Id
+		} else if len(id) == 0 {
+			id = templateIdForSlug(d.Slug)
+		}
+		t, err := d.toTemplate(id)
+		if err != nil {
+			return nil, fmt.Errorf("Template %s: %s", d.Slug, err)
+		}
+		t.Source = source
+		if current != nil && !takeOver {
+			t.Source = current.Source
+		}
+		if other, ok := titles[t.Title]; ok {
+			return nil, fmt.Errorf("Template %s: title is also used by %s", d.Slug, other)
+		}
+		titles[t.Title] = d.Slug
+		slugIds[d.Slug] = id
+		existing[id] = current
+		templates = append(templates, t)
+	}
+
+	// Templates that stay as they are, all templates as they will be after the sync are validated together
+	planned := make(map[string]*Template)
+	server.templateStore.templateMux.RLock()
+	for _, template := range server.templateStore.Templates {
+		if _, ok := existing[template.Id]; ok {
+			continue
+		}
+		if prune && len(source) > 0 && template.Source == source {
+			plan.Changes = append(plan.Changes, &TemplateSyncChange{
+				Action:     TEMPLATE_SYNC_DELETE,
+				TemplateId: template.Id,
+				Slug:       template.GetSlug(),
+				Title:      template.Title,
+				Diff:       make([]*TemplateFieldDiff, 0),
+			})
+			continue
+		}
+		if _, ok := slugIds[template.GetSlug()]; !ok {
+			slugIds[template.GetSlug()] = template.Id
+		}
+		if other, ok := titles[template.Title]; ok {
+			server.templateStore.templateMux.RUnlock()
+			return nil, fmt.Errorf("Template %s: title is already used by another template", other)
+		}
+		planned[template.Id] = template
+	}
+	server.templateStore.templateMux.RUnlock()
+	for _, t := range templates {
+		planned[t.Id] = t
+	}
+
+	for i, t := range templates {
+		d := defs[i]
+		if len(d.RollbackTemplate) > 0 {
+			if t.RollbackTemplateId = slugIds[d.RollbackTemplate]; len(t.RollbackTemplateId) == 0 {
+				return nil, fmt.Errorf("Template %s: rollback template %s not found", d.Slug, d.RollbackTemplate)
+			}
+		}
+		if valid, err := t.isValidAmong(planned); !valid {
+			return nil, fmt.Errorf("Template %s: %s", d.Slug, err)
+		}
+		change := &TemplateSyncChange{
+			TemplateId: t.Id,
+			Slug:       t.Slug,
+			Title:      t.Title,
+			template:   t,
+		}
+		if current := existing[t.Id]; current != nil {
+			t.Version = current.Version
+			// Definitions can disable, enabling needs the reason the enable endpoint asks for
+			current.mux.RLock()
+			if t.Enabled || !current.Enabled {
+				t.Enabled = current.Enabled
+				t.Disabled = current.Disabled
+			}
+			current.mux.RUnlock()
+			change.Action = TEMPLATE_SYNC_UPDATE
+			change.Diff = diffTemplates(current, t)
+			if len(change.Diff) == 0 {
+				plan.Unchanged++
+				continue
+			}
+		} else {
+			change.Action = TEMPLATE_SYNC_CREATE
+			change.Diff = diffTemplates(nil, t)
+		}
+		plan.Changes = append(plan.Changes, change)
+	}
+	sort.Sort(templateSyncChangesBySlug(plan.Changes))
+
+	b, _ := json.Marshal(plan.Changes)
+	sum := sha256.Sum256(b)
+	plan.Hash = hex.EncodeToString(sum[:])
+	return plan, nil
+}
+
+// Apply the changes, returns the changes that could not be applied
+func (p *TemplateSyncPlan) Apply(user *User) []string {
+	errs := make([]string, 0)
+	userId := ""
+	if user != nil {
+		userId = user.Id
+	}
+	for _, change := range p.Changes {
+		switch change.Action {
+		case TEMPLATE_SYNC_CREATE, TEMPLATE_SYNC_UPDATE:
+			if err := lintBlockingError(lintTemplate(change.template)); err != nil {
+				errs = append(errs, fmt.Sprintf("Template %s: %s", change.Slug, err))
+				continue
+			}
+			if change.Action == TEMPLATE_SYNC_UPDATE {
+				if current := server.templateStore.Get(change.TemplateId); current != nil {
+					for _, cr := range server.consensus.UnexecutedForTemplate(change.TemplateId) {
+						if cr.TemplateVersion < 1 {
+							cr.TemplateVersion = current.Version
+						}
+					}
+				}
+			}
+			server.templateVersionStore.Snapshot(change.template, userId, fmt.Sprintf("Synced from definition %s", change.Slug))
+			server.templateStore.Add(change.template)
+			audit.Log(user, "Template", fmt.Sprintf("Sync %s %s (%s)", change.Action, change.Slug, change.TemplateId))
+		case TEMPLATE_SYNC_DELETE:
+			if len(server.httpCheckStore.FindByTemplate(change.TemplateId)) > 0 || len(server.scheduleStore.FindByTemplate(change.TemplateId)) > 0 {
+				errs = append(errs, fmt.Sprintf("Template %s is still used by http checks or schedules", change.Slug))
+				continue
+			}
+			server.templateStore.Remove(change.TemplateId)
+			audit.Log(user, "Template", fmt.Sprintf("Sync delete %s (%s)", change.Slug, change.TemplateId))
+		}
+	}
+	server.templateVersionStore.save()
+	server.templateStore.save()
+	server.consensus.save()
+	return errs
+}
+
+type templateSyncChangesBySlug []*TemplateSyncChange
+
+func (a templateSyncChangesBySlug) Len() int           { return len(a) }
+func (a templateSyncChangesBySlug) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a templateSyncChangesBySlug) Less(i, j int) bool { return a[i].Slug < a[j].Slug }
+
+// Reconciles templates with the definitions in a directory, changes wait for confirmation by an admin
+type TemplateSync struct {
+	Dir      string
+	plan     *TemplateSyncPlan
+	err      error
+	notified string // Hash of the last plan admins were told about
+	mux      sync.RWMutex
+	planMux  sync.Mutex // One refresh at a time
+	applyMux sync.Mutex // One apply at a time
+	watcher  *fsnotify.Watcher
+}
+
+// Definitions of all yaml, yml and json files in the directory
+func loadTemplateDir(dir string) ([]*TemplateDefinition, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defs := make([]*TemplateDefinition, 0)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		format := ""
+		switch strings.ToLower(filepath.Ext(file.Name())) {
+		case ".yaml", ".yml":
+			format = TEMPLATE_FORMAT_YAML
+		case ".json":
+			format = TEMPLATE_FORMAT_JSON
+		default:
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		list, err := parseTemplateDefinitions(b, format)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file.Name(), err)
+		}
+		defs = append(defs, list...)
+	}
+	return defs, nil
+}
+
+// Plan the changes for the current contents of the directory
+func (s *TemplateSync) Refresh() (*TemplateSyncPlan, error) {
+	s.planMux.Lock()
+	defer s.planMux.Unlock()
+	var plan *TemplateSyncPlan
+	defs, err := loadTemplateDir(s.Dir)
+	if err == nil {
+		plan, err = planTemplateSync(defs, TEMPLATE_SOURCE_DIRECTORY, true, true)
+	}
+	s.mux.Lock()
+	s.plan = plan
+	s.err = err
+	s.mux.Unlock()
+	if err != nil {
+		log.Printf("Failed to sync templates from %s: %s", s.Dir, err)
+		return nil, err
+	}
+
+	// Tell admins once there is something to confirm
+	if len(plan.Changes) > 0 && plan.Hash != s.notified {
+		s.notified = plan.Hash
+		audit.Log(nil, "Template", fmt.Sprintf("%d template change(s) from %s waiting for confirmation", len(plan.Changes), s.Dir))
+		server.notifier.NotifyRole("admin", "Template changes waiting", fmt.Sprintf("%d template change(s) from %s are waiting for confirmation", len(plan.Changes), s.Dir))
+	}
+	return plan, nil
+}
+
+// Plan as last refreshed
+func (s *TemplateSync) Plan() (*TemplateSyncPlan, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.plan, s.err
+}
+
+// Apply the plan that was confirmed, only if the directory did not change since
+func (s *TemplateSync) Apply(user *User, hash string) ([]string, error) {
+	s.applyMux.Lock()
+	defer s.applyMux.Unlock()
+	plan, err := s.Refresh()
+	if err != nil {
+		return nil, err
+	}
+	if plan.Hash != hash {
+		return nil, errors.New("The templates changed since the diff was shown, review them again")
+	}
+	errs := plan.Apply(user)
+	s.Refresh()
+	return errs, nil
+}
+
+// Plan now and whenever the directory changes
+func (s *TemplateSync) Start() error {
+	s.Refresh()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(s.Dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	s.watcher = watcher
+	go func() {
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				s.Refresh()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Template directory watcher error: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func newTemplateSync(dir string) *TemplateSync {
+	return &TemplateSync{
+		Dir: dir,
+	}
+}
+
+// Export templates as definitions
+func GetTemplatesExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetTemplatesExport")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	format := strings.TrimSpace(r.URL.Query().Get("format"))
+	if len(format) == 0 {
+		format = TEMPLATE_FORMAT_YAML
+	}
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+
+	templates := make([]*Template, 0)
+	server.templateStore.templateMux.RLock()
+	for _, template := range server.templateStore.Templates {
+		if len(id) > 0 && template.Id != id {
+			continue
+		}
+		templates = append(templates, template)
+	}
+	server.templateStore.templateMux.RUnlock()
+	defs := make([]*TemplateDefinition, 0)
+	for _, template := range templates {
+		defs = append(defs, newTemplateDefinition(template))
+	}
+	sort.Sort(templateDefinitionsBySlug(defs))
+
+	b, err := formatTemplateDefinitions(defs, format)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if format == TEMPLATE_FORMAT_JSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/x-yaml")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"templates.%s\"", format))
+	w.Write(b)
+}
+
+type templateDefinitionsBySlug []*TemplateDefinition
+
+func (a templateDefinitionsBySlug) Len() int           { return len(a) }
+func (a templateDefinitionsBySlug) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a templateDefinitionsBySlug) Less(i, j int) bool { return a[i].Slug < a[j].Slug }
+
+// Import definitions, with dryRun only the diff is returned
+func PostTemplatesImport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostTemplatesImport")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("User not allowed to PostTemplatesImport")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	dryRun := r.PostFormValue("dryRun") == "1"
+	if !dryRun && !checkStepUp(user, r, STEP_UP_TEMPLATE_UPDATE) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	defs, err := parseTemplateDefinitions([]byte(r.PostFormValue("definitions")), strings.TrimSpace(r.PostFormValue("format")))
+	if err == nil && len(defs) == 0 {
+		err = errors.New("No template definitions found")
+	}
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	plan, err := planTemplateSync(defs, "", false, r.PostFormValue("takeOver") == "1")
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("plan", plan)
+	if !dryRun {
+		jr.Set("errors", plan.Apply(user))
+	}
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Changes from the template directory that wait for confirmation
+func GetTemplatesSync(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetTemplatesSync")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if server.templateSync == nil {
+		jr.Error("Template directory sync is not enabled")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	plan, err := server.templateSync.Plan()
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("dir", server.templateSync.Dir)
+	jr.Set("plan", plan)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Apply the changes from the template directory as shown by the hash
+func PostTemplatesSync(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostTemplatesSync")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("User not allowed to PostTemplatesSync")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if !checkStepUp(user, r, STEP_UP_TEMPLATE_UPDATE) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if server.templateSync == nil {
+		jr.Error("Template directory sync is not enabled")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	errs, err := server.templateSync.Apply(user, strings.TrimSpace(r.PostFormValue("hash")))
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("errors", errs)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	assert.Equal(t, "restart-nginx", slugify("Restart Nginx"))
+	assert.Equal(t, "clear-cache-v2", slugify("  Clear cache (v2)! "))
+	assert.True(t, templateSlugRegexp.MatchString(slugify("Restart Nginx")))
+	assert.False(t, templateSlugRegexp.MatchString("Restart Nginx"))
+}
+
+func TestParseTemplateDefinitions(t *testing.T) {
+	yamlDoc := `
+- slug: restart-nginx
+  title: Restart nginx
+  description: Restarts the web server
+  command: service nginx restart
+  timeout: 30
+  strategy: rolling
+  min_auth: 2
+  included_tags: [web]
+  quorum_rules: ["ops:1"]
+  validation_rules:
+    - text: OK
+      must_contain: true
+`
+	defs, err := parseTemplateDefinitions([]byte(yamlDoc), TEMPLATE_FORMAT_YAML)
+	assert.Nil(t, err)
+	assert.Len(t, defs, 1)
+	assert.Equal(t, "restart-nginx", defs[0].Slug)
+	assert.Equal(t, uint(2), defs[0].MinAuth)
+	assert.Equal(t, []string{"web"}, defs[0].IncludedTags)
+	assert.True(t, defs[0].ValidationRules[0].MustContain)
+
+	// A single definition is accepted too
+	defs, err = parseTemplateDefinitions([]byte(`{"slug": "uptime", "title": "Uptime", "min_auth": 1}`), TEMPLATE_FORMAT_JSON)
+	assert.Nil(t, err)
+	assert.Len(t, defs, 1)
+	assert.Equal(t, "uptime", defs[0].Slug)
+
+	_, err = parseTemplateDefinitions([]byte(`{`), TEMPLATE_FORMAT_JSON)
+	assert.NotNil(t, err)
+	_, err = parseTemplateDefinitions([]byte(``), "xml")
+	assert.NotNil(t, err)
+}
+
+func TestTemplateDefinitionToTemplate(t *testing.T) {
+	d := &TemplateDefinition{
+		Slug:        "restart-nginx",
+		Title:       "Restart nginx",
+		Description: "Restarts the web server",
+		Command:     "service nginx restart",
+		Timeout:     30,
+		Strategy:    "rolling",
+		MinAuth:     2,
+		QuorumRules: []string{"ops:1", "*:2:exclude-requester"},
+		ValidationRules: []*TemplateValidationDefinition{
+			{Text: "OK", MustContain: true},
+		},
+	}
+	template, err := d.toTemplate("id1")
+	assert.Nil(t, err)
+	assert.Equal(t, "id1", template.Id)
+	assert.True(t, template.Enabled)
+	assert.Equal(t, RollingExecutionStrategy, template.ExecutionStrategy.Strategy)
+	assert.Len(t, template.Acl.QuorumRules, 2)
+	assert.Equal(t, "*:2:exclude-requester", template.Acl.QuorumRules[1].Spec())
+	assert.Equal(t, "restart-nginx-1", template.ValidationRules[0].Id)
+	assert.Equal(t, 1, template.ValidationRules[0].OutputStream)
+
+	d.Slug = "Restart nginx"
+	_, err = d.toTemplate("id1")
+	assert.NotNil(t, err)
+}
+
+func TestPlanTemplateSync(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = &Server{templateStore: &TemplateStore{Templates: make(map[string]*Template)}}
+
+	existing := newTemplate("Restart nginx", "Restarts the web server", "service nginx restart", true, []string{}, []string{}, 2, 30, newExecutionStrategy(SimpleExecutionStrategy))
+	existing.Version = 1
+	server.templateStore.Add(existing)
+	managed := newTemplate("Old", "No longer defined", "true", true, []string{}, []string{}, 1, 30, nil)
+	managed.Source = TEMPLATE_SOURCE_DIRECTORY
+	server.templateStore.Add(managed)
+
+	defs := []*TemplateDefinition{
+		newTemplateDefinition(existing),
+		{Slug: "uptime", Title: "Uptime", Description: "Shows the uptime", Command: "uptime", Timeout: 10, Strategy: "simple", MinAuth: 1, RollbackTemplate: "restart-nginx"},
+	}
+	defs[0].Command = "service nginx reload"
+
+	plan, err := planTemplateSync(defs, TEMPLATE_SOURCE_DIRECTORY, true, true)
+	assert.Nil(t, err)
+	assert.Len(t, plan.Changes, 3)
+	actions := make(map[string]*TemplateSyncChange)
+	for _, change := range plan.Changes {
+		actions[change.Action] = change
+	}
+	assert.Equal(t, existing.Id, actions[TEMPLATE_SYNC_UPDATE].TemplateId)
+	assert.Equal(t, managed.Id, actions[TEMPLATE_SYNC_DELETE].TemplateId)
+	assert.Equal(t, templateIdForSlug("uptime"), actions[TEMPLATE_SYNC_CREATE].TemplateId)
+	assert.Equal(t, existing.Id, actions[TEMPLATE_SYNC_CREATE].template.RollbackTemplateId)
+
+	// Same input, same plan
+	again, _ := planTemplateSync(defs, TEMPLATE_SOURCE_DIRECTORY, true, true)
+	assert.Equal(t, plan.Hash, again.Hash)
+
+	// Without pruning the managed template stays
+	plan, _ = planTemplateSync(defs, TEMPLATE_SOURCE_DIRECTORY, false, true)
+	assert.Len(t, plan.Changes, 2)
+
+	// Duplicate slugs
+	_, err = planTemplateSync([]*TemplateDefinition{defs[1], defs[1]}, "", false, false)
+	assert.NotNil(t, err)
+}
+
+func TestPlanTemplateSyncKeepsDisabled(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = &Server{templateStore: &TemplateStore{Templates: make(map[string]*Template)}}
+
+	existing := newTemplate("Restart nginx", "Restarts the web server", "service nginx restart", true, []string{}, []string{}, 2, 30, newExecutionStrategy(SimpleExecutionStrategy))
+	existing.Version = 1
+	existing.Slug = "restart-nginx"
+	existing.Source = TEMPLATE_SOURCE_DIRECTORY
+	server.templateStore.Add(existing)
+
+	// Enabled is the default and not exported
+	assert.Nil(t, newTemplateDefinition(existing).Enabled)
+
+	existing.Enabled = false
+	existing.Disabled = &TemplateDisabled{UserId: "u1", Reason: "Broken"}
+	d := newTemplateDefinition(existing)
+	assert.False(t, *d.Enabled)
+
+	// The export of a disabled template syncs without changes
+	plan, err := planTemplateSync([]*TemplateDefinition{d}, TEMPLATE_SOURCE_DIRECTORY, false, true)
+	assert.Nil(t, err)
+	assert.Len(t, plan.Changes, 0)
+
+	// A definition does not enable it again
+	enabled := true
+	d.Enabled = &enabled
+	plan, _ = planTemplateSync([]*TemplateDefinition{d}, TEMPLATE_SOURCE_DIRECTORY, false, true)
+	assert.Len(t, plan.Changes, 0)
+	d.Enabled = nil
+	plan, _ = planTemplateSync([]*TemplateDefinition{d}, TEMPLATE_SOURCE_DIRECTORY, false, true)
+	assert.Len(t, plan.Changes, 0)
+}
+
+func TestPlanTemplateSyncValidates(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = &Server{templateStore: &TemplateStore{Templates: make(map[string]*Template)}}
+
+	existing := newTemplate("Restart nginx", "Restarts the web server", "service nginx restart", true, []string{}, []string{}, 2, 30, newExecutionStrategy(SimpleExecutionStrategy))
+	existing.Slug = "restart-nginx"
+	existing.Source = TEMPLATE_SOURCE_DIRECTORY
+	server.templateStore.Add(existing)
+
+	// The probe template must be read-only, also when it is defined in the same sync
+	check := &TemplateDefinition{Slug: "check-nginx", Title: "Check nginx", Description: "Checks the web server", Command: "service nginx status", Timeout: 10, Strategy: "simple", MinAuth: 1}
+	d := newTemplateDefinition(existing)
+	d.HealthProbe = &HealthProbe{Type: HEALTH_PROBE_TEMPLATE, TemplateId: templateIdForSlug(check.Slug)}
+	_, err := planTemplateSync([]*TemplateDefinition{d, check}, "", false, false)
+	assert.Contains(t, err.Error(), "read-only")
+	check.ReadOnly = true
+	plan, err := planTemplateSync([]*TemplateDefinition{d, check}, "", false, false)
+	assert.Nil(t, err)
+	assert.Len(t, plan.Changes, 2)
+
+	// Imports keep the directory managing the template unless it is taken over
+	for _, change := range plan.Changes {
+		if change.TemplateId == existing.Id {
+			assert.Equal(t, TEMPLATE_SOURCE_DIRECTORY, change.template.Source)
+		}
+	}
+	plan, _ = planTemplateSync([]*TemplateDefinition{d, check}, "", false, true)
+	for _, change := range plan.Changes {
+		if change.TemplateId == existing.Id {
+			assert.Equal(t, "", change.template.Source)
+		}
+	}
+}
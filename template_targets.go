@@ -0,0 +1,101 @@
+package main
+
+// Limits on the clients a request can target, by tags and by the size of the blast radius
+// @author Robin Verlangen
+
+import (
+	"errors"
+	"fmt"
+)
+
+func (a *TemplateACL) IsValidTargetLimit() (bool, error) {
+	if a.MaxTargets < 0 {
+		return false, errors.New("Max targets can not be negative")
+	}
+	if a.MaxTargetsPercent < 0 || a.MaxTargetsPercent > 100 {
+		return false, errors.New("Max targets percentage must be between 0 and 100")
+	}
+	if a.ExceedMinAuth > 0 && a.ExceedMinAuth <= a.MinAuth {
+		return false, errors.New("Authorizations over the target limit must be more than min auth")
+	}
+	return true, nil
+}
+
+// Maximum number of targets out of the clients matching the template, 0 if unlimited
+func (a *TemplateACL) TargetLimit(matching int) int {
+	limit := a.MaxTargets
+	if a.MaxTargetsPercent > 0 {
+		// Rounded up, a template can always target at least one client
+		pctLimit := (matching*a.MaxTargetsPercent + 99) / 100
+		if pctLimit < 1 {
+			pctLimit = 1
+		}
+		if limit == 0 || pctLimit < limit {
+			limit = pctLimit
+		}
+	}
+	return limit
+}
+
+// Does the number of targets fit the limit? Returns why the request needs more approvals if it exceeds a limit that can be approved
+func (a *TemplateACL) CheckTargetLimit(targets int, matching int) (string, error) {
+	limit := a.TargetLimit(matching)
+	if limit == 0 || targets <= limit {
+		return "", nil
+	}
+	if a.ExceedMinAuth == 0 {
+		return "", fmt.Errorf("Request targets %d clients, the template allows at most %d", targets, limit)
+	}
+	return fmt.Sprintf("%d clients exceeds the limit of %d, %d authorizations required", targets, limit, a.ExceedMinAuth), nil
+}
+
+// Authorizations needed, more when the request exceeds the target limit
+func (c *ConsensusRequest) requiredAuth(template *Template) uint {
+	minAuth := template.Acl.MinAuth
+	if len(c.TargetLimitExceeded) > 0 && template.Acl.ExceedMinAuth > minAuth {
+		minAuth = template.Acl.ExceedMinAuth
+	}
+	return minAuth
+}
+
+// Why the template can not run on the client, empty if it can
+func clientTargetError(client *RegisteredClient, acl *TemplateACL) string {
+	if client == nil {
+		return "Client is not connected"
+	}
+	if acl == nil || (len(acl.IncludedTags) == 0 && len(acl.ExcludedTags) == 0) {
+		return ""
+	}
+	client.mux.RLock()
+	defer client.mux.RUnlock()
+	for _, tag := range acl.ExcludedTags {
+		if client.HasTag(tag) {
+			return fmt.Sprintf("Client has excluded tag %s", tag)
+		}
+	}
+	for _, tag := range acl.IncludedTags {
+		if !client.HasTag(tag) {
+			return fmt.Sprintf("Client is missing tag %s", tag)
+		}
+	}
+	return ""
+}
+
+// Check the clients against the tags and limits of the template, returns why more approvals are needed if so
+func checkTemplateTargets(template *Template, clientIds []string) (string, error) {
+	acl := template.Acl
+	if acl == nil {
+		return "", nil
+	}
+	if len(acl.IncludedTags) > 0 || len(acl.ExcludedTags) > 0 {
+		for _, clientId := range clientIds {
+			if reason := clientTargetError(server.GetClient(clientId), acl); len(reason) > 0 {
+				return "", fmt.Errorf("%s: %s", clientId, reason)
+			}
+		}
+	}
+	if acl.MaxTargets == 0 && acl.MaxTargetsPercent == 0 {
+		return "", nil
+	}
+	return acl.CheckTargetLimit(len(clientIds), len(server.FindClientIds(acl.IncludedTags, acl.ExcludedTags)))
+}
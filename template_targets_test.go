@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTemplateTargetLimit(t *testing.T) {
+	acl := newTemplateAcl()
+	assert.Equal(t, 0, acl.TargetLimit(50))
+
+	acl.MaxTargets = 5
+	assert.Equal(t, 5, acl.TargetLimit(50))
+
+	// The lowest limit applies, percentages round up to at least one client
+	acl.MaxTargetsPercent = 5
+	assert.Equal(t, 3, acl.TargetLimit(50))
+	assert.Equal(t, 5, acl.TargetLimit(200))
+	assert.Equal(t, 1, acl.TargetLimit(0))
+	acl.MaxTargets = 0
+	assert.Equal(t, 10, acl.TargetLimit(200))
+}
+
+func TestTemplateCheckTargetLimit(t *testing.T) {
+	acl := newTemplateAcl()
+	acl.MinAuth = 2
+	acl.MaxTargets = 2
+
+	exceeded, err := acl.CheckTargetLimit(2, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "", exceeded)
+
+	_, err = acl.CheckTargetLimit(3, 10)
+	assert.NotNil(t, err)
+
+	acl.ExceedMinAuth = 4
+	exceeded, err = acl.CheckTargetLimit(3, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, "3 clients exceeds the limit of 2, 4 authorizations required", exceeded)
+
+	template := &Template{Acl: acl}
+	cr := newConsensusRequest()
+	assert.Equal(t, uint(2), cr.requiredAuth(template))
+	cr.TargetLimitExceeded = exceeded
+	assert.Equal(t, uint(4), cr.requiredAuth(template))
+}
+
+func TestTemplateIsValidTargetLimit(t *testing.T) {
+	acl := newTemplateAcl()
+	acl.MinAuth = 2
+	valid, _ := acl.IsValidTargetLimit()
+	assert.True(t, valid)
+
+	acl.MaxTargetsPercent = 101
+	valid, _ = acl.IsValidTargetLimit()
+	assert.False(t, valid)
+
+	acl.MaxTargetsPercent = 10
+	acl.ExceedMinAuth = 2
+	valid, _ = acl.IsValidTargetLimit()
+	assert.False(t, valid)
+}
+
+func TestClientTargetError(t *testing.T) {
+	acl := newTemplateAcl()
+	client := &RegisteredClient{ClientId: "web1", Tags: []string{"web", "prod"}}
+	assert.Equal(t, "", clientTargetError(client, acl))
+	assert.Equal(t, "", clientTargetError(client, nil))
+	assert.Equal(t, "Client is not connected", clientTargetError(nil, acl))
+
+	acl.IncludedTags = []string{"web", "eu"}
+	assert.Equal(t, "Client is missing tag eu", clientTargetError(client, acl))
+	acl.IncludedTags = []string{"web"}
+	acl.ExcludedTags = []string{"prod"}
+	assert.Equal(t, "Client has excluded tag prod", clientTargetError(client, acl))
+	acl.ExcludedTags = []string{"staging"}
+	assert.Equal(t, "", clientTargetError(client, acl))
+}
+
+func TestCheckTemplateTargets(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = &Server{clients: map[string]*RegisteredClient{
+		"web1": {ClientId: "web1", Tags: []string{"web", "prod"}},
+		"web2": {ClientId: "web2", Tags: []string{"web", "prod"}},
+		"web3": {ClientId: "web3", Tags: []string{"web", "prod"}},
+		"web4": {ClientId: "web4", Tags: []string{"web", "prod"}},
+		"db1":  {ClientId: "db1", Tags: []string{"db", "prod"}},
+	}}
+
+	template := newTemplate("Restart nginx", "Restarts the web server", "service nginx restart", true, []string{"web"}, []string{}, 1, 30, nil)
+	_, err := checkTemplateTargets(template, []string{"web1", "web2", "web3", "web4"})
+	assert.Nil(t, err)
+	_, err = checkTemplateTargets(template, []string{"web1", "db1"})
+	assert.NotNil(t, err)
+	_, err = checkTemplateTargets(template, []string{"web9"})
+	assert.NotNil(t, err)
+
+	// Half of the web servers at most
+	template.Acl.MaxTargetsPercent = 50
+	_, err = checkTemplateTargets(template, []string{"web1", "web2"})
+	assert.Nil(t, err)
+	_, err = checkTemplateTargets(template, []string{"web1", "web2", "web3"})
+	assert.NotNil(t, err)
+	template.Acl.ExceedMinAuth = 3
+	exceeded, err := checkTemplateTargets(template, []string{"web1", "web2", "web3"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", exceeded)
+
+	// Without tags any client can be targeted
+	untagged := newTemplate("Uptime", "Shows the uptime", "uptime", true, []string{}, []string{}, 1, 30, nil)
+	_, err = checkTemplateTargets(untagged, []string{"web9"})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,379 @@
+package main
+
+// Immutable versions of templates, requests execute the version they were approved against
+// @author Robin Verlangen
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TemplateVersionStore struct {
+	Versions map[string][]*TemplateVersion // By template id, oldest first
+	ConfFile string
+	mux      sync.RWMutex
+}
+
+type TemplateVersion struct {
+	TemplateId   string
+	Version      int
+	Template     *Template // Snapshot, never modified
+	CreateUserId string
+	CreateTime   int64
+	Message      string
+}
+
+type TemplateFieldDiff struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// Record the current state of a template as its next version
+func (s *TemplateVersionStore) Snapshot(template *Template, userId string, message string) *TemplateVersion {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	version := 1
+	if versions := s.Versions[template.Id]; len(versions) > 0 {
+		version = versions[len(versions)-1].Version + 1
+	}
+	template.mux.Lock()
+	template.Version = version
+	template.mux.Unlock()
+
+	v := &TemplateVersion{
+		TemplateId:   template.Id,
+		Version:      version,
+		Template:     cloneTemplate(template),
+		CreateUserId: userId,
+		CreateTime:   time.Now().Unix(),
+		Message:      message,
+	}
+	s.Versions[template.Id] = append(s.Versions[template.Id], v)
+	return v
+}
+
+// Get a specific version
+func (s *TemplateVersionStore) Get(templateId string, version int) *TemplateVersion {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, v := range s.Versions[templateId] {
+		if v.Version == version {
+			return v
+		}
+	}
+	return nil
+}
+
+// All versions of a template, oldest first
+func (s *TemplateVersionStore) List(templateId string) []*TemplateVersion {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	list := make([]*TemplateVersion, len(s.Versions[templateId]))
+	copy(list, s.Versions[templateId])
+	return list
+}
+
+// Template as it was at a version, nil if that version is unknown. Removed templates stay removed.
+func (s *TemplateVersionStore) Resolve(templateId string, version int) *Template {
+	current := server.templateStore.Get(templateId)
+	if current == nil || version < 1 || current.Version == version {
+		return current // Without a version, e.g. requests from before versioning, the current one applies
+	}
+	if v := s.Get(templateId, version); v != nil {
+		return v.Template
+	}
+	return nil
+}
+
+// Templates from before versioning get their first version
+func (s *TemplateVersionStore) ensureVersions(templateStore *TemplateStore) bool {
+	templateStore.templateMux.RLock()
+	templates := make([]*Template, 0)
+	for _, template := range templateStore.Templates {
+		templates = append(templates, template)
+	}
+	templateStore.templateMux.RUnlock()
+
+	changed := false
+	for _, template := range templates {
+		if template.Version > 0 && s.Get(template.Id, template.Version) != nil {
+			continue
+		}
+		s.Snapshot(template, "", "Initial version")
+		changed = true
+	}
+	return changed
+}
+
+// Deep copy that does not share any state with the original
+func cloneTemplate(template *Template) *Template {
+	template.mux.RLock()
+	b, je := json.Marshal(template)
+	template.mux.RUnlock()
+	if je != nil {
+		return nil
+	}
+	var clone *Template
+	if je := json.Unmarshal(b, &clone); je != nil {
+		return nil
+	}
+	return clone
+}
+
+// Field by field differences, nested fields are named with dots
+func diffTemplates(a *Template, b *Template) []*TemplateFieldDiff {
+	fa := flattenTemplate(a)
+	fb := flattenTemplate(b)
+	fields := make([]string, 0)
+	for field := range fa {
+		fields = append(fields, field)
+	}
+	for field := range fb {
+		if _, ok := fa[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	diffs := make([]*TemplateFieldDiff, 0)
+	for _, field := range fields {
+		if fa[field] != fb[field] {
+			diffs = append(diffs, &TemplateFieldDiff{
+				Field: field,
+				Old:   fa[field],
+				New:   fb[field],
+			})
+		}
+	}
+	return diffs
+}
+
+func flattenTemplate(template *Template) map[string]string {
+	res := make(map[string]string)
+	if template == nil {
+		return res
+	}
+	template.mux.RLock()
+	b, je := json.Marshal(template)
+	template.mux.RUnlock()
+	if je != nil {
+		return res
+	}
+	var v map[string]interface{}
+	if je := json.Unmarshal(b, &v); je != nil {
+		return res
+	}
+	delete(v, "Version")
+	flattenJson("", v, res)
+	return res
+}
+
+func flattenJson(prefix string, v interface{}, res map[string]string) {
+	if m, ok := v.(map[string]interface{}); ok {
+		for key, elm := range m {
+			if len(prefix) > 0 {
+				key = fmt.Sprintf("%s.%s", prefix, key)
+			}
+			flattenJson(key, elm, res)
+		}
+		return
+	}
+	if v == nil {
+		res[prefix] = ""
+		return
+	}
+	if list, ok := v.([]interface{}); ok && len(list) == 0 {
+		res[prefix] = "" // Same as no list at all
+		return
+	}
+	if s, ok := v.(string); ok {
+		res[prefix] = s
+		return
+	}
+	b, _ := json.Marshal(v)
+	res[prefix] = string(b)
+}
+
+func (s *TemplateVersionStore) save() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, je := json.Marshal(s.Versions)
+	if je != nil {
+		log.Printf("Failed to write template versions: %s", je)
+		return false
+	}
+	err := ioutil.WriteFile(s.ConfFile, bytes, 0644)
+	if err != nil {
+		log.Printf("Failed to write template versions: %s", err)
+		return false
+	}
+	return true
+}
+
+func (s *TemplateVersionStore) load() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, err := ioutil.ReadFile(s.ConfFile)
+	if err == nil {
+		var v map[string][]*TemplateVersion
+		je := json.Unmarshal(bytes, &v)
+		if je != nil {
+			log.Printf("Invalid template_versions.json: %s", je)
+			return
+		}
+		s.Versions = v
+	}
+}
+
+func newTemplateVersionStore() *TemplateVersionStore {
+	s := &TemplateVersionStore{
+		ConfFile: conf.HomeFile("template_versions.json"),
+		Versions: make(map[string][]*TemplateVersion),
+	}
+	s.load()
+	return s
+}
+
+// Version number from the url or form, 0 if not set
+func parseTemplateVersion(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(s)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("Invalid version %s", s)
+	}
+	return version, nil
+}
+
+// List versions of a template
+func GetTemplateVersions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetTemplateVersions")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	templateId := ps.ByName("templateid")
+	versions := server.templateVersionStore.List(templateId)
+	if len(versions) == 0 {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("versions", versions)
+	if template := server.templateStore.Get(templateId); template != nil {
+		jr.Set("current", template.Version)
+	}
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Differences between two versions, by default the given one against the current version
+func GetTemplateDiff(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetTemplateDiff")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	templateId := ps.ByName("templateid")
+	from, fromE := parseTemplateVersion(r.URL.Query().Get("from"))
+	to, toE := parseTemplateVersion(r.URL.Query().Get("to"))
+	if fromE != nil || toE != nil || from == 0 {
+		jr.Error("Provide the versions to compare with from and to")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if to == 0 {
+		if template := server.templateStore.Get(templateId); template != nil {
+			to = template.Version
+		}
+	}
+	a := server.templateVersionStore.Get(templateId, from)
+	b := server.templateVersionStore.Get(templateId, to)
+	if a == nil || b == nil {
+		jr.Error("Version not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("from", from)
+	jr.Set("to", to)
+	jr.Set("diff", diffTemplates(a.Template, b.Template))
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Make an old version the current one, as a new version
+func PostTemplateRestore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostTemplateRestore")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+	if !user.HasRole("admin") {
+		jr.Error("User not allowed to PostTemplateRestore")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if !checkStepUp(user, r, STEP_UP_TEMPLATE_UPDATE) {
+		jr.Error("Confirm this action with your two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	templateId := ps.ByName("templateid")
+	version, versionE := parseTemplateVersion(r.PostFormValue("version"))
+	if versionE != nil || version == 0 {
+		jr.Error("Provide the version to restore")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	v := server.templateVersionStore.Get(templateId, version)
+	if v == nil {
+		jr.Error("Version not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	template := cloneTemplate(v.Template)
+	if current := server.templateStore.Get(templateId); current != nil {
+		current.mux.RLock()
+		template.Source = current.Source
+		template.Enabled = current.Enabled // Only changed through disable and enable
+		template.Disabled = current.Disabled
+		current.mux.RUnlock()
+	}
+	if valid, err := template.IsValid(); !valid {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if err := lintBlockingError(lintTemplate(template)); err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	restored := server.templateVersionStore.Snapshot(template, user.Id, fmt.Sprintf("Restored version %d", version))
+	server.templateStore.Add(template)
+	server.templateVersionStore.save()
+	server.templateStore.save()
+	audit.Log(user, "Template", fmt.Sprintf("Restored version %d of %s as version %d", version, templateId, restored.Version))
+
+	jr.Set("template", template)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
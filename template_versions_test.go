@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTemplateVersionSnapshot(t *testing.T) {
+	s := &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)}
+	template := newTemplate("title", "description", "echo 1", true, []string{}, []string{}, 2, 10, nil)
+
+	v1 := s.Snapshot(template, "u1", "Created")
+	assert.Equal(t, 1, v1.Version)
+	assert.Equal(t, 1, template.Version)
+
+	// Snapshots do not change along with the template
+	template.Command = "echo 2"
+	template.Acl.MinAuth = 3
+	v2 := s.Snapshot(template, "u1", "Changed")
+	assert.Equal(t, 2, v2.Version)
+	assert.Equal(t, "echo 1", s.Get(template.Id, 1).Template.Command)
+	assert.Equal(t, uint(2), s.Get(template.Id, 1).Template.Acl.MinAuth)
+	assert.Equal(t, "echo 2", s.Get(template.Id, 2).Template.Command)
+	assert.Nil(t, s.Get(template.Id, 3))
+	assert.Len(t, s.List(template.Id), 2)
+}
+
+func TestDiffTemplates(t *testing.T) {
+	a := newTemplate("title", "description", "echo 1", true, []string{"web"}, []string{}, 2, 10, nil)
+	b := cloneTemplate(a)
+	b.Version = 5
+	assert.Len(t, diffTemplates(a, b), 0)
+
+	b.Command = "echo 2"
+	b.Acl.MinAuth = 3
+	b.Acl.IncludedTags = []string{"web", "db"}
+	diffs := diffTemplates(a, b)
+	assert.Len(t, diffs, 3)
+	assert.Equal(t, "Acl.IncludedTags", diffs[0].Field)
+	assert.Equal(t, `["web"]`, diffs[0].Old)
+	assert.Equal(t, `["web","db"]`, diffs[0].New)
+	assert.Equal(t, "Acl.MinAuth", diffs[1].Field)
+	assert.Equal(t, "Command", diffs[2].Field)
+	assert.Equal(t, "echo 1", diffs[2].Old)
+	assert.Equal(t, "echo 2", diffs[2].New)
+}
+
+func TestParseTemplateVersion(t *testing.T) {
+	v, err := parseTemplateVersion("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, v)
+	v, _ = parseTemplateVersion("3")
+	assert.Equal(t, 3, v)
+	_, err = parseTemplateVersion("0")
+	assert.NotNil(t, err)
+}
+
+func TestTemplateVersionResolve(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	template := newTemplate("title", "description", "echo 1", true, []string{}, []string{}, 2, 10, nil)
+	s := &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)}
+	server = &Server{templateStore: &TemplateStore{Templates: map[string]*Template{template.Id: template}}, templateVersionStore: s}
+	s.Snapshot(template, "u1", "Created")
+	template.Command = "echo 2"
+	s.Snapshot(template, "u1", "Changed")
+
+	assert.Equal(t, "echo 1", s.Resolve(template.Id, 1).Command)
+	assert.Equal(t, "echo 2", s.Resolve(template.Id, 2).Command)
+	assert.Equal(t, "echo 2", s.Resolve(template.Id, 0).Command)
+
+	// Never the current version in place of one that is gone
+	assert.Nil(t, s.Resolve(template.Id, 7))
+	cr := newConsensusRequest()
+	cr.TemplateId = template.Id
+	cr.TemplateVersion = 7
+	assert.Nil(t, cr.Template())
+}
+
+func TestTemplateVersionSnapshotBeforePublish(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	template := newTemplate("title", "description", "echo 1", true, []string{}, []string{}, 2, 10, nil)
+	s := &TemplateVersionStore{Versions: make(map[string][]*TemplateVersion)}
+	server = &Server{templateStore: &TemplateStore{Templates: make(map[string]*Template)}, templateVersionStore: s}
+	s.Snapshot(template, "u1", "Created")
+	server.templateStore.Add(template)
+
+	// Versioned but not yet published, the pinned version is still the current one
+	updated := cloneTemplate(template)
+	updated.Command = "echo 2"
+	s.Snapshot(updated, "u1", "Changed")
+	assert.Equal(t, 2, updated.Version)
+	assert.Equal(t, "echo 1", s.Resolve(template.Id, 1).Command)
+
+	// Published
+	server.templateStore.Add(updated)
+	assert.Equal(t, "echo 1", s.Resolve(template.Id, 1).Command)
+	assert.Equal(t, "echo 2", s.Resolve(template.Id, 2).Command)
+}
@@ -11,22 +11,89 @@ import (
 // Templates used to be executed on hosts
 
 type Template struct {
-	Id                string
-	Title             string // Short title
-	Description       string // Full description that explains in layman's terms what this does, so everyone can help as part of the authorization process
-	Command           string // Command to be executed
-	Enabled           bool   // Is this available for running?
-	Timeout           int    // Seconds of execution before the command is killed
-	Acl               *TemplateACL
-	ExecutionStrategy *ExecutionStrategy
-	ValidationRules   []*ExecutionValidation // Validation rules
-	mux               sync.RWMutex
+	Id                 string
+	Title              string            // Short title
+	Description        string            // Full description that explains in layman's terms what this does, so everyone can help as part of the authorization process
+	Command            string            // Command to be executed
+	Enabled            bool              // Is this available for running?
+	Disabled           *TemplateDisabled // Who disabled it and why, nil while enabled
+	Timeout            int               // Seconds of execution before the command is killed
+	Acl                *TemplateACL
+	ExecutionStrategy  *ExecutionStrategy
+	ValidationRules    []*ExecutionValidation // Validation rules
+	RollbackTemplateId string                 // Template executed on the changed hosts if execution fails
+	HealthProbe        *HealthProbe           // Probe that must pass between batches of a rolling execution
+	Version            int                    // Current version, see TemplateVersionStore
+	Slug               string                 // Stable name in template definitions
+	Source             string                 // Where the template is managed, see TEMPLATE_SOURCE_*
+	Category           string                 // Folder, nested with slashes, e.g. web/nginx
+	OwnerUserIds       []string               // Responsible for the template
+	OwnerGroups        []string
+	Labels             []string
+	RiskLevel          string // See TEMPLATE_RISK_*, empty if not assessed
+	ReadOnly           bool   // Only inspects hosts, may run as a health probe under the approval of another request
+	mux                sync.RWMutex
 }
 
 type TemplateACL struct {
 	MinAuth      uint // Minimum amount of authorization before the template is actually executed (eg 3 = requester + 2 additional approvers)
 	IncludedTags []string
 	ExcludedTags []string
+
+	ApprovalDeadline int           // Hours before an unapproved request expires, 0 for the server default
+	MinReject        uint          // Rejections that end a request, 0 means a single one
+	VetoRoles        []string      // A single rejection by a user with one of these roles ends a request
+	QuorumRules      []*QuorumRule // Must all be met on top of the minimum authorization
+
+	// Blast radius, 0 is unlimited
+	MaxTargets        int  // Clients per request
+	MaxTargetsPercent int  // Percentage of the clients matching the tags per request
+	ExceedMinAuth     uint // Authorizations for requests over the limit, 0 rejects them
+
+	// Who may request and approve, empty lists allow everyone with the global role
+	RequesterUserIds []string
+	RequesterGroups  []string
+	ApproverUserIds  []string
+	ApproverGroups   []string
+}
+
+// May the user request this template?
+func (a *TemplateACL) CanRequest(user *User) bool {
+	return aclAllows(a.RequesterUserIds, a.RequesterGroups, user)
+}
+
+// May the user approve this template?
+func (a *TemplateACL) CanApprove(user *User) bool {
+	return aclAllows(a.ApproverUserIds, a.ApproverGroups, user)
+}
+
+func aclAllows(userIds []string, groups []string, user *User) bool {
+	if len(userIds) == 0 && len(groups) == 0 {
+		return true
+	}
+	for _, userId := range userIds {
+		if userId == user.Id {
+			return true
+		}
+	}
+	for _, group := range groups {
+		if user.InGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Do the rejections end the request? Also returns the number of rejections required
+func (a *TemplateACL) IsRejected(user *User, rejections int) (bool, uint) {
+	required := a.MinReject
+	if required < 1 {
+		required = 1
+	}
+	if user != nil && user.HasAnyRole(a.VetoRoles) {
+		return true, required
+	}
+	return uint(rejections) >= required, required
 }
 
 type TemplateStore struct {
@@ -56,17 +123,25 @@ func (s *Template) DeleteValidationRule(id string) {
 
 // Validate the setup of a template
 func (s *Template) IsValid() (bool, error) {
+	server.templateStore.templateMux.RLock()
+	defer server.templateStore.templateMux.RUnlock()
+	return s.isValidAmong(server.templateStore.Templates)
+}
+
+// Validate against the templates by id it will be stored with, e.g. those of a sync that has not been applied yet
+func (s *Template) isValidAmong(templates map[string]*Template) (bool, error) {
 	if len(s.Title) < 1 {
 		return false, errors.New("Fill in a title")
 	}
 
 	// Title must be unique
-	server.templateStore.templateMux.RLock()
-	defer server.templateStore.templateMux.RUnlock()
-	for _, template := range server.templateStore.Templates {
-		if template.Title == s.Title {
+	for _, template := range templates {
+		if template.Title == s.Title && template.Id != s.Id {
 			return false, errors.New("Title is not unique")
 		}
+		if len(s.Slug) > 0 && template.GetSlug() == s.Slug && template.Id != s.Id {
+			return false, errors.New("Slug is not unique")
+		}
 	}
 
 	if len(s.Description) < 1 {
@@ -75,6 +150,18 @@ func (s *Template) IsValid() (bool, error) {
 	if len(s.Command) < 1 {
 		return false, errors.New("Fill in a command")
 	}
+	if len(s.RollbackTemplateId) > 0 && templates[s.RollbackTemplateId] == nil {
+		return false, errors.New("Rollback template not found")
+	}
+	if s.HealthProbe != nil && s.HealthProbe.Type == HEALTH_PROBE_TEMPLATE {
+		probeTemplate := templates[s.HealthProbe.TemplateId]
+		if probeTemplate == nil {
+			return false, errors.New("Probe template not found")
+		}
+		if !probeTemplate.ReadOnly {
+			return false, errors.New("Probe template must be marked read-only")
+		}
+	}
 	return true, nil
 }
 
@@ -153,6 +240,7 @@ func newTemplateAcl() *TemplateACL {
 	return &TemplateACL{
 		IncludedTags: make([]string, 0),
 		ExcludedTags: make([]string, 0),
+		VetoRoles:    make([]string, 0),
 	}
 }
 
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTemplateAclEligibility(t *testing.T) {
+	acl := newTemplateAcl()
+	dba := newUser()
+	dba.SetGroups([]string{"db"})
+	dev := newUser()
+
+	// Open to everyone by default
+	assert.True(t, acl.CanRequest(dev))
+	assert.True(t, acl.CanApprove(dev))
+
+	acl.ApproverGroups = []string{"db"}
+	assert.True(t, acl.CanApprove(dba))
+	assert.False(t, acl.CanApprove(dev))
+	assert.True(t, acl.CanRequest(dev))
+
+	acl.RequesterUserIds = []string{dev.Id}
+	assert.True(t, acl.CanRequest(dev))
+	assert.False(t, acl.CanRequest(dba))
+}
+
+func TestTemplateIsValidUniqueTitle(t *testing.T) {
+	prev := server
+	defer func() { server = prev }()
+	server = &Server{templateStore: &TemplateStore{Templates: make(map[string]*Template)}}
+
+	existing := newTemplate("restart", "description", "echo", true, []string{}, []string{}, 1, 10, nil)
+	server.templateStore.Add(existing)
+
+	// Updating itself keeps its title
+	update := newTemplate("restart", "changed", "echo 2", true, []string{}, []string{}, 1, 10, nil)
+	update.Id = existing.Id
+	valid, _ := update.IsValid()
+	assert.True(t, valid)
+
+	// Another template can not take it
+	other := newTemplate("restart", "description", "echo", true, []string{}, []string{}, 1, 10, nil)
+	valid, err := other.IsValid()
+	assert.False(t, valid)
+	assert.EqualError(t, err, "Title is not unique")
+}
+
+func TestParseExecutionStrategy(t *testing.T) {
+	strategy, err := parseExecutionStrategy("rolling")
+	assert.Nil(t, err)
+	assert.Equal(t, RollingExecutionStrategy, strategy.Strategy)
+	_, err = parseExecutionStrategy("sideways")
+	assert.EqualError(t, err, "Strategy not found")
+}
@@ -62,6 +62,20 @@ func (s *UserStore) ById(userId string) *User {
 	return nil
 }
 
+// Ids of the enabled users with a role
+func (s *UserStore) IdsWithRole(role string) []string {
+	s.usersMux.Lock()
+	defer s.usersMux.Unlock()
+
+	ids := make([]string, 0)
+	for _, user := range s.Users {
+		if user.Enabled && user.HasRole(role) {
+			ids = append(ids, user.Id)
+		}
+	}
+	return ids
+}
+
 func (s *UserStore) RemoveByName(username string) {
 	s.usersMux.Lock()
 	defer s.usersMux.Unlock()
@@ -241,6 +255,9 @@ type User struct {
 	SessionIpAddress     string // Current session IP
 	SessionLastTimestamp time.Time
 	Roles                map[string]bool
+	Groups               []string  // Teams the user belongs to, used by quorum rules
+	system               bool      // Internal user that acts on behalf of the server, e.g. for http checks
+	stepUpTimestamp      time.Time // Last second factor proof within the current session
 	mux                  sync.RWMutex
 }
 
@@ -288,6 +305,48 @@ func (u *User) HasRole(r string) bool {
 	return u.Roles[r]
 }
 
+// Has at least one of the roles
+func (u *User) HasAnyRole(roles []string) bool {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	for _, r := range roles {
+		if u.Roles[r] {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) InGroup(g string) bool {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	for _, group := range u.Groups {
+		if group == g {
+			return true
+		}
+	}
+	return false
+}
+
+// Is there a group both users are in?
+func (u *User) SharesGroup(other *User) bool {
+	other.mux.RLock()
+	groups := other.Groups
+	other.mux.RUnlock()
+	for _, group := range groups {
+		if u.InGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) SetGroups(groups []string) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.Groups = groups
+}
+
 func (u *User) AddRole(r string) {
 	u.mux.Lock()
 	defer u.mux.Unlock()
@@ -339,10 +398,28 @@ func (u *User) StartSession() string {
 	u.mux.Lock()
 	defer u.mux.Unlock()
 	u.SessionToken, _ = secureRandomString(32)
+	u.stepUpTimestamp = time.Time{}
 	audit.Log(u, "Login", "")
 	return u.SessionToken
 }
 
+// Register a second factor proof for sensitive actions
+func (u *User) StepUp() {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.stepUpTimestamp = time.Now()
+}
+
+// Was the second factor proven within the grace period?
+func (u *User) HasStepUp(gracePeriod time.Duration) bool {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	if u.stepUpTimestamp.IsZero() {
+		return false
+	}
+	return time.Now().Sub(u.stepUpTimestamp) <= gracePeriod
+}
+
 func newUser() *User {
 	id, _ := uuid.NewV4()
 	return &User{
@@ -351,6 +428,20 @@ func newUser() *User {
 	}
 }
 
+// Internal user that requests executions that were authorized up front
+func newSystemUser(username string) *User {
+	u := newUser()
+	u.Username = username
+	u.system = true
+	u.AddRole("requester")
+	return u
+}
+
+// Is this an internal user?
+func (u *User) IsSystem() bool {
+	return u.system
+}
+
 func newUserStore(confFile string) *UserStore {
 	store := &UserStore{
 		Users:    make([]*User, 0),
@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"image/png"
 	"testing"
+	"time"
 )
 
 func TestVerifyUserHas2FactorAuth(t *testing.T) {
@@ -75,3 +76,12 @@ func TestProperQrImage(t *testing.T) {
 	assert.Equal(t, 300, bounds.Max.Y) //height
 
 }
+
+func TestStepUp(t *testing.T) {
+	user := newUser()
+	assert.False(t, user.HasStepUp(5*time.Minute))
+
+	user.StepUp()
+	assert.True(t, user.HasStepUp(5*time.Minute))
+	assert.False(t, user.HasStepUp(-1*time.Second))
+}